@@ -4,8 +4,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
-	"net/url"
-	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	resty "gopkg.in/resty.v0"
@@ -18,8 +18,9 @@ const (
 	resourceNotFound            = "StatusCode=404"
 	fileRequestTimeoutInSeconds = 60
 	locationWestUS              = "westus"
-	blockchainTemplate          = "https://github.com/Azure/azure-quickstart-templates/raw/master/ethereum-consortium-blockchain-network/azuredeploy.json"
-	templateVersion             = "1.0.0.0"
+	outputAdminSite             = "admin-site"
+	outputEthereumRPCEndpoint   = "ethereum-rpc-endpoint"
+	outputFabricAPIEndpoint     = "api-endpoint"
 )
 
 var (
@@ -48,12 +49,17 @@ type APIVersions struct {
 	Storage         string
 	Group           string
 	ActiveDirectory string
+	// WhatIf is empty if the environment does not support what-if
+	WhatIf string
 }
 
 type Environment struct {
 	ResourceManagerEndpointURL string
 	ActiveDirectoryEndpointURL string
-	APIVersions                APIVersions
+	// ResourceManagerAudience is the resource of the tokens, the resource
+	// manager endpoint if it is empty
+	ResourceManagerAudience string
+	APIVersions             APIVersions
 }
 
 var Environments = map[string]Environment{
@@ -65,6 +71,7 @@ var Environments = map[string]Environment{
 			Storage:         "2016-05-31",
 			Group:           "2017-05-10",
 			ActiveDirectory: "2015-06-15",
+			WhatIf:          "2020-06-01",
 		},
 	},
 	AzureChinaCloud: Environment{
@@ -75,6 +82,7 @@ var Environments = map[string]Environment{
 			Storage:         "2016-05-31",
 			Group:           "2017-05-10",
 			ActiveDirectory: "2015-06-15",
+			WhatIf:          "2020-06-01",
 		},
 	},
 	AzureUSGovernment: Environment{
@@ -85,6 +93,7 @@ var Environments = map[string]Environment{
 			Storage:         "2016-05-31",
 			Group:           "2017-05-10",
 			ActiveDirectory: "2015-06-15",
+			WhatIf:          "2020-06-01",
 		},
 	},
 	AzureGermanCloud: Environment{
@@ -112,114 +121,162 @@ type AzureToken struct {
 	AccessToken string
 }
 
+// tokenCache is shared by all operations, so it is the only state of the
+// client which changes after creation.
+type tokenCache struct {
+	mutex sync.Mutex
+	token AzureToken
+}
+
+// Scope identifies the resources of a single operation. It is passed by
+// value, so concurrent operations never see each other's resource group.
+type Scope struct {
+	SubscriptionID    string
+	ResourceGroupName string
+	DeploymentName    string
+	Location          string
+}
+
 type AzureRESTClient struct {
-	logger         lager.Logger
-	cloudConfig    *CloudConfig
-	resourceConfig *ResourceConfig
-	token          AzureToken
+	logger      lager.Logger
+	cloudConfig CloudConfig
+	environment Environment
+	// client is used by all requests to Azure AD and ARM
+	client      *resty.Client
+	rateLimiter *rateLimiter
+	// tokenProvider gets the tokens which tokens caches
+	tokenProvider TokenProvider
+	tokens        *tokenCache
 }
 
-func NewAzureResourceAccountRESTClient(logger lager.Logger, cloudConfig *CloudConfig, resourceConfig *ResourceConfig) (AzureRESTClient, error) {
+func NewAzureResourceAccountRESTClient(logger lager.Logger, cloudConfig CloudConfig) (*AzureRESTClient, error) {
 	logger = logger.Session("create-resource-account-rest-client")
-	client := AzureRESTClient{
-		logger:         logger,
-		cloudConfig:    cloudConfig,
-		resourceConfig: resourceConfig,
+	client, err := NewHTTPClient(cloudConfig.HTTP)
+	if err != nil {
+		return nil, err
+	}
+	environment, err := resolveEnvironment(cloudConfig, client)
+	if err != nil {
+		return nil, err
+	}
+	logger.Info("environment", lager.Data{
+		"resourceManagerEndpointURL": environment.ResourceManagerEndpointURL,
+		"activeDirectoryEndpointURL": environment.ActiveDirectoryEndpointURL,
+		"authentication":             cloudConfig.Credential.Authentication,
+	})
+	tokenProvider, err := NewTokenProvider(cloudConfig, environment, client)
+	if err != nil {
+		return nil, err
 	}
-	return client, nil
+	restClient := AzureRESTClient{
+		client:        client,
+		rateLimiter:   newRateLimiter(logger, cloudConfig.HTTP),
+		logger:        logger,
+		cloudConfig:   cloudConfig,
+		environment:   environment,
+		tokenProvider: tokenProvider,
+		tokens:        &tokenCache{},
+	}
+	return &restClient, nil
 }
 
-func (c *AzureRESTClient) refreshToken(force bool) error {
-	if c.token.AccessToken == "" || time.Until(c.token.ExpiresOn) <= 0 || force {
-		// fmt.Println("get token")
-		headers := map[string]string{
-			"Content-Type": contentTypeWWW,
-			"User-Agent":   userAgent,
-		}
-
-		hostURL := fmt.Sprintf("%s/%s/oauth2/token", Environments[c.cloudConfig.Azure.Environment].ActiveDirectoryEndpointURL, c.cloudConfig.Azure.TenanID)
-		body := url.Values{
-			"grant_type":    {"client_credentials"},
-			"client_id":     {c.cloudConfig.Azure.ClientID},
-			"client_secret": {c.cloudConfig.Azure.ClientSecret},
-			"resource":      {Environments[c.cloudConfig.Azure.Environment].ResourceManagerEndpointURL},
-			"scope":         {"user_impersonation"},
-		}
+// refreshToken returns the cached token unless it expires within the skew
+// or it is the stale token which ARM refused. Concurrent callers wait for
+// a single refresh and share its token.
+func (c *AzureRESTClient) refreshToken(stale string) (string, error) {
+	c.tokens.mutex.Lock()
+	defer c.tokens.mutex.Unlock()
 
-		resty.DefaultClient.SetRetryCount(3).SetRetryWaitTime(10)
-		resp, err := resty.R().
-			SetHeaders(headers).
-			SetQueryParam("api-version", Environments[c.cloudConfig.Azure.Environment].APIVersions.ActiveDirectory).
-			SetBody(body.Encode()).
-			Post(hostURL)
+	token := c.tokens.token
+	if token.AccessToken == "" || time.Until(token.ExpiresOn) <= c.cloudConfig.Credential.TokenRefreshSkew || token.AccessToken == stale {
+		token, err := c.tokenProvider.Token()
 		if err != nil {
-			return err
-		}
-		if resp.StatusCode() == http.StatusOK {
-			type ResponseBody struct {
-				ExpiresOn   string `json:"expires_on"`
-				AccessToken string `json:"access_token"`
-			}
-			responseBody := ResponseBody{}
-			err := json.Unmarshal(resp.Body(), &responseBody)
-			if err != nil {
-				return err
-			}
-			expiresOn, err := strconv.ParseInt(responseBody.ExpiresOn, 10, 64)
-			if err != nil {
-				return err
-			}
-			c.token.ExpiresOn = time.Unix(expiresOn, 0)
-			c.token.AccessToken = responseBody.AccessToken
-		} else {
-			return fmt.Errorf("HTTP CODE: %#v", resp.StatusCode())
+			return "", err
 		}
+		c.tokens.token = token
 	}
-	return nil
+	return c.tokens.token.AccessToken, nil
 }
 
-func (c *AzureRESTClient) initialize() (headers map[string]string, err error) {
-	resty.DefaultClient.SetRetryCount(3).SetRetryWaitTime(10)
-	check := resty.RetryConditionFunc(func(r *resty.Response) (bool, error) {
-		for _, v := range restRetryCodes {
-			if r.StatusCode() == v {
-				return true, nil
-			}
-		}
-		return false, nil
-	})
-	resty.DefaultClient.AddRetryCondition(check)
+func (c *AzureRESTClient) initialize() (headers map[string]string, token string, err error) {
 	headers = map[string]string{
 		"Content-Type": contentTypeJSON,
 		"User-Agent":   userAgent,
 	}
-	err = c.refreshToken(false)
+	token, err = c.refreshToken("")
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 
-	return headers, nil
+	return headers, token, nil
 }
 
-func (c *AzureRESTClient) GroupExist() (bool, error) {
-	headers, err := c.initialize()
+// send sends an authorized request to ARM. If ARM refuses the token with
+// 401, e.g. because it was revoked, the token is refreshed and the request
+// is sent once more.
+func (c *AzureRESTClient) send(method, hostURL string, queries map[string]string, body interface{}) (*resty.Response, error) {
+	headers, token, err := c.initialize()
 	if err != nil {
-		return false, err
+		return nil, err
+	}
+	resp, err := c.execute(method, hostURL, headers, token, queries, body)
+	if err != nil || resp.StatusCode() != http.StatusUnauthorized {
+		return resp, err
+	}
+	c.logger.Info("refresh-token", lager.Data{"method": method, "url": hostURL})
+	token, err = c.refreshToken(token)
+	if err != nil {
+		return nil, err
+	}
+	return c.execute(method, hostURL, headers, token, queries, body)
+}
+
+// execute sends the request, and retries it up to the retry count of the
+// HTTP config if it is retryable.
+func (c *AzureRESTClient) execute(method, hostURL string, headers map[string]string, token string, queries map[string]string, body interface{}) (*resty.Response, error) {
+	for attempt := 0; ; attempt++ {
+		request := c.client.R().
+			SetHeaders(headers).
+			SetAuthToken(token)
+		if queries != nil {
+			request.SetQueryParams(queries)
+		}
+		if body != nil {
+			request.SetBody(body)
+		}
+		release := c.rateLimiter.acquire(method, hostURL, attempt)
+		resp, err := request.Execute(method, hostURL)
+		release(resp)
+		if attempt >= c.cloudConfig.HTTP.RetryCount || !retryable(resp, err) {
+			return resp, err
+		}
+		wait := retryWait(c.cloudConfig.HTTP, attempt, resp)
+		// the rate limiter holds the retry of a throttled request
+		if resp != nil && resp.StatusCode() == http.StatusTooManyRequests {
+			wait = 0
+		}
+		data := lager.Data{"method": method, "url": hostURL, "attempt": attempt + 1, "wait": wait.String()}
+		if err != nil {
+			data["error"] = err.Error()
+		} else {
+			data["statusCode"] = resp.StatusCode()
+		}
+		c.logger.Info("retry", data)
+		time.Sleep(wait)
 	}
+}
+
+func (c *AzureRESTClient) GroupExist(scope Scope) (bool, error) {
 	queries := map[string]string{
-		"api-version": Environments[c.cloudConfig.Azure.Environment].APIVersions.Group,
+		"api-version": c.environment.APIVersions.Group,
 	}
 	hostURL := fmt.Sprintf(
 		"%s/subscriptions/%s/resourceGroups/%s",
-		Environments[c.cloudConfig.Azure.Environment].ResourceManagerEndpointURL,
-		c.resourceConfig.SubscriptionID,
-		c.resourceConfig.ResourceGroupName,
+		c.environment.ResourceManagerEndpointURL,
+		scope.SubscriptionID,
+		scope.ResourceGroupName,
 	)
-	resp, err := resty.R().
-		SetHeaders(headers).
-		SetQueryParams(queries).
-		SetAuthToken(c.token.AccessToken).
-		Head(hostURL)
+	resp, err := c.send(http.MethodHead, hostURL, queries, nil)
 	if err != nil {
 		return false, err
 	}
@@ -227,32 +284,55 @@ func (c *AzureRESTClient) GroupExist() (bool, error) {
 	return resp.StatusCode() == http.StatusNoContent, nil
 }
 
-func (c *AzureRESTClient) CreateGroup() (bool, error) {
-	headers, err := c.initialize()
+// GetGroup returns the resource group, or nil if it does not exist.
+func (c *AzureRESTClient) GetGroup(scope Scope) (*ResourceGroup, error) {
+	queries := map[string]string{
+		"api-version": c.environment.APIVersions.Group,
+	}
+	hostURL := fmt.Sprintf("%s/subscriptions/%s/resourceGroups/%s",
+		c.environment.ResourceManagerEndpointURL,
+		scope.SubscriptionID,
+		scope.ResourceGroupName,
+	)
+
+	resp, err := c.send(http.MethodGet, hostURL, queries, nil)
 	if err != nil {
-		return false, err
+		return nil, err
+	}
+	statusCode := resp.StatusCode()
+	if statusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if statusCode != http.StatusOK {
+		return nil, armError(statusCode, resp.Body())
+	}
+	group, err := ParseResourceGroup(resp.Body())
+	if err != nil {
+		return nil, err
 	}
+	return &group, nil
+}
+
+func (c *AzureRESTClient) CreateGroup(scope Scope, tags map[string]string) (bool, error) {
 	queries := map[string]string{
-		"api-version": Environments[c.cloudConfig.Azure.Environment].APIVersions.Group,
+		"api-version": c.environment.APIVersions.Group,
 	}
 
 	hostURL := fmt.Sprintf(
 		"%s/subscriptions/%s/resourcegroups/%s",
-		Environments[c.cloudConfig.Azure.Environment].ResourceManagerEndpointURL,
-		c.resourceConfig.SubscriptionID,
-		c.resourceConfig.ResourceGroupName,
+		c.environment.ResourceManagerEndpointURL,
+		scope.SubscriptionID,
+		scope.ResourceGroupName,
 	)
 	resourceGroup := map[string]interface{}{
-		"location": c.resourceConfig.Location,
+		"location": scope.Location,
+	}
+	if len(tags) > 0 {
+		resourceGroup["tags"] = tags
 	}
 	body, err := json.Marshal(resourceGroup)
 
-	resp, err := resty.R().
-		SetHeaders(headers).
-		SetQueryParams(queries).
-		SetAuthToken(c.token.AccessToken).
-		SetBody(body).
-		Put(hostURL)
+	resp, err := c.send(http.MethodPut, hostURL, queries, body)
 	if err != nil {
 		return false, err
 	}
@@ -260,125 +340,129 @@ func (c *AzureRESTClient) CreateGroup() (bool, error) {
 	if statusCode == http.StatusOK || statusCode == http.StatusCreated {
 		return true, nil
 	}
-	return false, fmt.Errorf("Error Code: %d, %v", statusCode, resp)
+	return false, armError(statusCode, resp.Body())
 }
 
-func (c *AzureRESTClient) CheckResourceStatus(resourceGroupName string) (string, error) {
-	headers, err := c.initialize()
-	if err != nil {
-		return "", err
-	}
+func (c *AzureRESTClient) CheckResourceStatus(scope Scope) (string, error) {
 	queries := map[string]string{
-		"api-version": Environments[c.cloudConfig.Azure.Environment].APIVersions.Group,
+		"api-version": c.environment.APIVersions.Group,
 	}
 	hostURL := fmt.Sprintf("%s/subscriptions/%s/resourceGroups/%s",
-		Environments[c.cloudConfig.Azure.Environment].ResourceManagerEndpointURL,
-		c.resourceConfig.SubscriptionID,
-		resourceGroupName,
+		c.environment.ResourceManagerEndpointURL,
+		scope.SubscriptionID,
+		scope.ResourceGroupName,
 	)
 
-	resp, err := resty.R().
-		SetHeaders(headers).
-		SetQueryParams(queries).
-		SetAuthToken(c.token.AccessToken).
-		Get(hostURL)
+	resp, err := c.send(http.MethodGet, hostURL, queries, nil)
+	if err != nil {
+		return "", err
+	}
 
 	statusCode := resp.StatusCode()
 	if statusCode == http.StatusOK {
-		apiResponse := map[string]interface{}{}
-		if err := json.Unmarshal(resp.Body(), &apiResponse); err != nil {
-			return "", fmt.Errorf("StatusCode: %d - %v\n\t%s", statusCode, resp, err)
+		group, err := ParseResourceGroup(resp.Body())
+		if err != nil {
+			return "", err
 		}
-		properties := apiResponse["properties"].(map[string]interface{})
-		return properties["provisioningState"].(string), nil
+		return group.Properties.ProvisioningState, nil
 	} else if statusCode == http.StatusNotFound {
 		return "notfound", nil
 	}
-	return "", fmt.Errorf("StatusCode: %d - %v", statusCode, resp)
+	return "", armError(statusCode, resp.Body())
 }
 
-func (c *AzureRESTClient) DeleteGroup() (bool, error) {
-	headers, err := c.initialize()
-	if err != nil {
-		return false, err
-	}
+// DeleteGroup starts to delete the resource group, and tells whether it is
+// deleted already. The operation is not trackable if ARM did not return a URL
+// to follow it by, then the group itself must be polled.
+func (c *AzureRESTClient) DeleteGroup(scope Scope) (_ Operation, deleted bool, err error) {
 	queries := map[string]string{
-		"api-version": Environments[c.cloudConfig.Azure.Environment].APIVersions.Group,
+		"api-version": c.environment.APIVersions.Group,
 	}
 	hostURL := fmt.Sprintf(
 		"%s/subscriptions/%s/resourcegroups/%s",
-		Environments[c.cloudConfig.Azure.Environment].ResourceManagerEndpointURL,
-		c.resourceConfig.SubscriptionID,
-		c.resourceConfig.ResourceGroupName,
+		c.environment.ResourceManagerEndpointURL,
+		scope.SubscriptionID,
+		scope.ResourceGroupName,
 	)
 
-	resp, err := resty.R().
-		SetHeaders(headers).
-		SetQueryParams(queries).
-		SetAuthToken(c.token.AccessToken).
-		Delete(hostURL)
+	resp, err := c.send(http.MethodDelete, hostURL, queries, nil)
 	if err != nil {
-		return false, err
+		return Operation{}, false, err
 	}
 	statusCode := resp.StatusCode()
-	if statusCode == http.StatusOK || statusCode == http.StatusAccepted {
-		return true, nil
+	if statusCode == http.StatusOK || statusCode == http.StatusNoContent {
+		return Operation{}, true, nil
 	}
-	return false, fmt.Errorf("Error Code: %d, %v", statusCode, resp)
+	if statusCode >= http.StatusOK && statusCode < http.StatusMultipleChoices {
+		return newOperation(resp.Header()), false, nil
+	}
+	return Operation{}, false, armError(statusCode, resp.Body())
 }
 
 // resource management: deployments
-func (c *AzureRESTClient) DeleteResource(deploymentName string) (bool, error) {
-	headers, err := c.initialize()
-	if err != nil {
-		return false, err
-	}
+func (c *AzureRESTClient) DeleteResource(scope Scope) (Operation, error) {
 	queries := map[string]string{
-		"api-version": Environments[c.cloudConfig.Azure.Environment].APIVersions.Group,
+		"api-version": c.environment.APIVersions.Group,
 	}
 	hostURL := fmt.Sprintf("%s/subscriptions/%s/resourceGroups/%s/providers/%s/%s/%s",
-		Environments[c.cloudConfig.Azure.Environment].ResourceManagerEndpointURL,
-		c.resourceConfig.SubscriptionID,
-		c.resourceConfig.ResourceGroupName,
+		c.environment.ResourceManagerEndpointURL,
+		scope.SubscriptionID,
+		scope.ResourceGroupName,
 		restAPIProvider,
 		restAPIDeployments,
-		deploymentName,
+		scope.DeploymentName,
 	)
 
-	resp, err := resty.R().
-		SetHeaders(headers).
-		SetQueryParams(queries).
-		SetAuthToken(c.token.AccessToken).
-		Delete(hostURL)
+	resp, err := c.send(http.MethodDelete, hostURL, queries, nil)
+	if err != nil {
+		return Operation{}, err
+	}
 	statusCode := resp.StatusCode()
 	if statusCode == http.StatusAccepted {
-		return true, nil
+		return newOperation(resp.Header()), nil
 	} else if statusCode == http.StatusNoContent {
-		return true, nil
+		return Operation{}, nil
 	}
-	return false, fmt.Errorf("Error Code: %d, %v", statusCode, resp)
+	return Operation{}, armError(statusCode, resp.Body())
 }
 
-func (c *AzureRESTClient) DeployTemplate(deploymentName string, template *map[string]interface{}, templateLink *Link, parameters *map[string]interface{}, parametersLink *Link) (string, error) {
-	mode := "Incremental"
-	headers, err := c.initialize()
+func (c *AzureRESTClient) DeployTemplate(scope Scope, template *map[string]interface{}, templateLink *Link, parameters *map[string]interface{}, parametersLink *Link) (Operation, error) {
 	queries := map[string]string{
-		"api-version": Environments[c.cloudConfig.Azure.Environment].APIVersions.Template,
-	}
-	if err != nil {
-		return "", err
+		"api-version": c.environment.APIVersions.Template,
 	}
 	hostURL := fmt.Sprintf("%s/subscriptions/%s/resourceGroups/%s/providers/%s/%s/%s",
-		Environments[c.cloudConfig.Azure.Environment].ResourceManagerEndpointURL,
-		c.resourceConfig.SubscriptionID,
-		c.resourceConfig.ResourceGroupName,
+		c.environment.ResourceManagerEndpointURL,
+		scope.SubscriptionID,
+		scope.ResourceGroupName,
 		restAPIProvider,
 		restAPIDeployments,
-		deploymentName,
+		scope.DeploymentName,
 	)
-	tags := map[string]string{}
-	tags["User-Agent"] = userAgent
+	deployTemplate := map[string]interface{}{
+		"properties": deploymentProperties(template, templateLink, parameters, parametersLink),
+	}
+	body, err := json.Marshal(deployTemplate)
+	if err != nil {
+		return Operation{}, err
+	}
 
+	resp, err := c.send(http.MethodPut, hostURL, queries, body)
+	if err != nil {
+		return Operation{}, err
+	}
+	statusCode := resp.StatusCode()
+	// the doc regards 200 and 201 as the same thing
+	// https://docs.microsoft.com/en-us/rest/api/resources/deployments/createorupdate#deployments_createorupdate_responses
+	if statusCode == http.StatusOK || statusCode == http.StatusCreated {
+		return newOperation(resp.Header()), nil
+	}
+	return Operation{}, armError(statusCode, resp.Body())
+}
+
+// deploymentProperties returns the properties of a deployment of the template
+// or the linked template, with the parameters or the linked parameters.
+func deploymentProperties(template *map[string]interface{}, templateLink *Link, parameters *map[string]interface{}, parametersLink *Link) map[string]interface{} {
+	mode := "Incremental"
 	var properties map[string]interface{}
 	if template != nil {
 		if parameters != nil {
@@ -422,113 +506,83 @@ func (c *AzureRESTClient) DeployTemplate(deploymentName string, template *map[st
 
 		}
 	}
-	deployTemplate := map[string]interface{}{
-		"properties": properties,
-	}
-	body, err := json.Marshal(deployTemplate)
-	if err != nil {
-		return "", err
-	}
-
-	resp, err := resty.R().
-		SetHeaders(headers).
-		SetQueryParams(queries).
-		SetAuthToken(c.token.AccessToken).
-		SetBody(body).
-		Put(hostURL)
-	if err != nil {
-		return "", err
-	}
-	statusCode := resp.StatusCode()
-	// the doc regards 200 and 201 as the same thing
-	// https://docs.microsoft.com/en-us/rest/api/resources/deployments/createorupdate#deployments_createorupdate_responses
-	if statusCode == http.StatusOK {
-		return "ok", nil
-	} else if statusCode == http.StatusCreated {
-		return "created", nil
-	} else {
-		return "", fmt.Errorf("Error Code: %d, %v", statusCode, resp)
-	}
+	return properties
 }
 
-func (c *AzureRESTClient) GetStatusURL(deploymentName string) (string, error) {
+func (c *AzureRESTClient) GetStatusURL(scope Scope) (string, error) {
 	hostURL := fmt.Sprintf("%s/subscriptions/%s/resourceGroups/%s/providers/%s/%s/%s?api-version=%s",
-		Environments[c.cloudConfig.Azure.Environment].ResourceManagerEndpointURL,
-		c.resourceConfig.SubscriptionID,
-		c.resourceConfig.ResourceGroupName,
+		c.environment.ResourceManagerEndpointURL,
+		scope.SubscriptionID,
+		scope.ResourceGroupName,
 		restAPIProvider,
 		restAPIDeployments,
-		deploymentName,
-		Environments[c.cloudConfig.Azure.Environment].APIVersions.Group,
+		scope.DeploymentName,
+		c.environment.APIVersions.Group,
 	)
 	return hostURL, nil
 }
 
-func (c *AzureRESTClient) GetAdminAndRPCUrl(deploymentName string) (adminSiteURL string, rpcURL string, err error) {
+// GetOutputs returns the value of every output of the deployment by its
+// name. The required output, if any, must be a string.
+func (c *AzureRESTClient) GetOutputs(scope Scope, required string) (map[string]interface{}, error) {
 	logger := c.logger
 	logger.Info("start")
 	defer logger.Info("end")
-	hostURL, _ := c.GetStatusURL(deploymentName)
-	resp, err := c.get(hostURL)
-
-	statusCode := resp.StatusCode()
-	if statusCode != http.StatusOK {
-		return "", "", fmt.Errorf("Error Code: %d, %v", statusCode, resp)
+	properties, err := c.GetDeploymentProperties(scope)
+	if err != nil {
+		return nil, err
 	}
-	apiResponse := map[string]interface{}{}
-	if err := json.Unmarshal(resp.Body(), &apiResponse); err != nil {
-		return "", "", fmt.Errorf("StatusCode: %d - %v\n\t%s", statusCode, resp, err)
+	if required != "" {
+		if _, err := properties.StringOutput(required); err != nil {
+			return nil, fmt.Errorf("Error in deployment %s: %v", scope.DeploymentName, err)
+		}
 	}
-	properties := apiResponse["properties"].(map[string]interface{})
-	outputs := properties["outputs"].(map[string]interface{})
-	adminSite := outputs["admin-site"].(map[string]interface{})
-	ethereumRPCEndpoint := outputs["ethereum-rpc-endpoint"].(map[string]interface{})
-	return adminSite["value"].(string), ethereumRPCEndpoint["value"].(string), nil
+	return properties.OutputValues(), nil
 }
 
-func (c *AzureRESTClient) CheckCompletion(deploymentName string) (string, error) {
+func (c *AzureRESTClient) CheckCompletion(scope Scope) (string, error) {
 	logger := c.logger
 	logger.Info("start")
 	defer logger.Info("end")
-	hostURL, _ := c.GetStatusURL(deploymentName)
-	resp, err := c.get(hostURL)
+	properties, err := c.GetDeploymentProperties(scope)
 	if err != nil {
 		return "", err
 	}
+	logger.Info("response", lager.Data{
+		"provisioningState": properties.ProvisioningState,
+	})
+	return properties.ProvisioningState, nil
+}
+
+func (c *AzureRESTClient) GetDeploymentProperties(scope Scope) (DeploymentProperties, error) {
+	hostURL, _ := c.GetStatusURL(scope)
+	resp, err := c.get(hostURL)
+	if err != nil {
+		return DeploymentProperties{}, err
+	}
 
 	statusCode := resp.StatusCode()
 	if statusCode != http.StatusOK {
-		return "", fmt.Errorf("Error Code: %d, %v", statusCode, resp)
+		return DeploymentProperties{}, armError(statusCode, resp.Body())
 	}
-	apiResponse := map[string]interface{}{}
-	if err := json.Unmarshal(resp.Body(), &apiResponse); err != nil {
-		return "", fmt.Errorf("StatusCode: %d - %v\n\t%s", statusCode, resp, err)
+	deployment, err := ParseDeployment(resp.Body())
+	if err != nil {
+		return DeploymentProperties{}, err
 	}
-	logger.Info("response", lager.Data{
-		"responseBody": apiResponse,
-	})
-	provisioningState := apiResponse["properties"].(map[string]interface{})["provisioningState"]
-	return provisioningState.(string), nil
+	return *deployment.Properties, nil
 }
 
 func (c *AzureRESTClient) get(asyncURL string) (*resty.Response, error) {
-	headers, err := c.initialize()
-	if err != nil {
-		return nil, err
-	}
 	queries := map[string]string{
-		"api-version": Environments[c.cloudConfig.Azure.Environment].APIVersions.Group,
+		"api-version": c.environment.APIVersions.Group,
 	}
 
-	return resty.R().
-		SetHeaders(headers).
-		SetQueryParams(queries).
-		SetAuthToken(c.token.AccessToken).
-		Get(asyncURL)
+	return c.send(http.MethodGet, asyncURL, queries, nil)
 }
 
 type DeploymentClient struct {
 	logger           lager.Logger
+	resourceConfig   ResourceConfig
 	blockchainConfig BlockchainConfig
 	azureRESTClient  *AzureRESTClient
 }
@@ -542,85 +596,219 @@ func NewDeploymentClient(logger lager.Logger, cloudConfig CloudConfig, resourceC
 	})
 	deploymentClient := DeploymentClient{
 		logger:           logger,
+		resourceConfig:   resourceConfig,
 		blockchainConfig: blockchainConfig,
 		azureRESTClient:  nil,
 	}
-	err := deploymentClient.initialize(cloudConfig, resourceConfig)
+	err := deploymentClient.initialize(cloudConfig)
 	if err != nil {
 		logger.Error("error-when-initialize-deploy-client", err)
 		return nil, err
 	}
+	if resourceConfig.WhatIf && deploymentClient.azureRESTClient.environment.APIVersions.WhatIf == "" {
+		return nil, fmt.Errorf("What-if is not supported in the environment %s", cloudConfig.Azure.Environment)
+	}
 	return &deploymentClient, nil
 }
 
-func (d *DeploymentClient) initialize(cloudConfig CloudConfig, resourceConfig ResourceConfig) (err error) {
+func (d *DeploymentClient) initialize(cloudConfig CloudConfig) (err error) {
 	logger := d.logger.Session("init-deployment-client")
 	logger.Info("start")
 	defer logger.Info("end")
 
 	// create REST client for async operation
-	azureRESTClient, err := NewAzureResourceAccountRESTClient(d.logger, &cloudConfig, &resourceConfig)
+	azureRESTClient, err := NewAzureResourceAccountRESTClient(d.logger, cloudConfig)
 	if err != nil {
 		return fmt.Errorf("Error in initialize DeploymentClient: %v", err)
 	}
-	d.azureRESTClient = &azureRESTClient
+	d.azureRESTClient = azureRESTClient
 	return nil
 }
 
-func (d *DeploymentClient) Create(deploymentName string) (err error) {
+// Scope returns the scope of the operations on a recorded instance.
+func (d *DeploymentClient) Scope(instance InstanceRecord) Scope {
+	location := instance.Location
+	if location == "" {
+		location = d.resourceConfig.Location
+	}
+	return Scope{
+		SubscriptionID:    d.resourceConfig.SubscriptionID,
+		ResourceGroupName: instance.ResourceGroupName,
+		DeploymentName:    instance.DeploymentName,
+		Location:          location,
+	}
+}
+
+// deployment returns the template and the parameters of a deployment with
+// the values.
+func deployment(template *Template, values map[string]interface{}) (*map[string]interface{}, *Link, *map[string]interface{}) {
+	parameters := parameterValues(values)
+	return &template.Content, nil, &parameters
+}
+
+// deploy deploys the template inline with the values of its parameters.
+func (d *DeploymentClient) deploy(scope Scope, template *Template, values map[string]interface{}) (Operation, error) {
+	content, link, parameters := deployment(template, values)
+	return d.azureRESTClient.DeployTemplate(scope, content, link, parameters, nil)
+}
+
+// preflight validates the deployment with ARM, and gets the changes it
+// would make unless whatIfTimeout is 0. The resource group must exist.
+func (d *DeploymentClient) preflight(logger lager.Logger, scope Scope, template *Template, values map[string]interface{}, whatIfTimeout time.Duration) ([]WhatIfChange, error) {
+	content, link, parameters := deployment(template, values)
+	if err := d.azureRESTClient.ValidateDeployment(scope, content, link, parameters); err != nil {
+		if _, ok := err.(*ValidationError); ok {
+			return nil, err
+		}
+		return nil, fmt.Errorf("Error in validate template: %v", err)
+	}
+	if whatIfTimeout == 0 {
+		return nil, nil
+	}
+	changes, err := d.azureRESTClient.WhatIf(scope, content, link, parameters, whatIfTimeout)
+	if err != nil {
+		switch err.(type) {
+		case *ValidationError, *whatIfTimeoutError:
+			return nil, err
+		}
+		return nil, fmt.Errorf("Error in what-if of template: %v", err)
+	}
+	logger.Info("what-if", lager.Data{"changes": changes})
+	return changes, nil
+}
+
+// DryRun validates the deployment with ARM without deploying it, and returns
+// the changes it would make if the environment supports what-if. ARM only
+// validates deployments into an existing resource group, so the group is
+// created for the dry run if it does not exist, and deleted after.
+func (d *DeploymentClient) DryRun(scope Scope, template *Template, values map[string]interface{}) ([]WhatIfChange, error) {
+	logger := d.logger.Session("dry-run", lager.Data{"scope": scope})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	azureRESTClient := d.azureRESTClient
+	exist, err := azureRESTClient.GroupExist(scope)
+	if err != nil {
+		return nil, fmt.Errorf("Error in check GroupExist: %v", err)
+	}
+	if !exist {
+		if _, err := azureRESTClient.CreateGroup(scope, map[string]string{TagBrokerVersion: Version}); err != nil {
+			return nil, fmt.Errorf("Error in create group: %v", err)
+		}
+		defer func() {
+			if _, _, err := azureRESTClient.DeleteGroup(scope); err != nil {
+				logger.Error("delete-group", err)
+			}
+		}()
+	}
+	timeout := time.Duration(0)
+	if azureRESTClient.environment.APIVersions.WhatIf != "" {
+		timeout = whatIfTimeout
+	}
+	return d.preflight(logger, scope, template, values, timeout)
+}
+
+func (d *DeploymentClient) Update(scope Scope, template *Template, values map[string]interface{}) (Operation, error) {
+	logger := d.logger.Session("update-template")
+	logger.Info("start")
+	defer logger.Info("end")
+
+	// the mode of the deployment is incremental, so redeploying the template
+	// with the same deployment name only changes the resources which differ
+	operation, err := d.deploy(scope, template, values)
+	if err != nil {
+		return Operation{}, fmt.Errorf("Error in deploy template: %v", err)
+	}
+	return operation, nil
+}
+
+// Create deploys the template into the resource group of the scope, which
+// it creates with the tags if it does not exist. An existing group is only
+// deployed into if it has the same instance tag, i.e. the broker created it
+// for the instance, e.g. for a provision which failed; otherwise it is a
+// *GroupConflictError. A group which is being deleted is a
+// *GroupDeletingError until it is gone. A group created for a deployment
+// which cannot start is deleted, as it is empty; existed tells whether the
+// group was the instance's already, and so remains.
+func (d *DeploymentClient) Create(scope Scope, tags map[string]string, template *Template, values map[string]interface{}) (_ Operation, existed bool, err error) {
 	logger := d.logger.Session("create-template")
 	logger.Info("start")
 	defer logger.Info("end")
 
 	// check resource group whether existing, if not create it
 	azureRESTClient := d.azureRESTClient
-	exist, err := azureRESTClient.GroupExist()
+	group, err := azureRESTClient.GetGroup(scope)
 	if err != nil {
-		return fmt.Errorf("Error in check GroupExist: %v", err)
+		return Operation{}, false, fmt.Errorf("Error in get group: %v", err)
 	}
-	if !exist {
-		_, err := azureRESTClient.CreateGroup()
-		if err != nil {
-			return fmt.Errorf("Error in create group: %v", err)
+	if group != nil && group.Tags[TagInstanceID] != tags[TagInstanceID] {
+		return Operation{}, false, &GroupConflictError{ResourceGroupName: scope.ResourceGroupName}
+	}
+	if group != nil && strings.EqualFold(group.Properties.ProvisioningState, "deleting") {
+		return Operation{}, false, &GroupDeletingError{ResourceGroupName: scope.ResourceGroupName}
+	}
+	existed = group != nil
+	if !existed {
+		if _, err := azureRESTClient.CreateGroup(scope, tags); err != nil {
+			return Operation{}, false, fmt.Errorf("Error in create group: %v", err)
 		}
+		defer func() {
+			if err == nil {
+				return
+			}
+			if _, _, err := azureRESTClient.DeleteGroup(scope); err != nil {
+				logger.Error("delete-group", err)
+			}
+		}()
+	}
+
+	// quota and policy failures are reported now rather than minutes later
+	// by the deployment. The what-if only informs, so it is given up on
+	// rather than holding the provision.
+	timeout := time.Duration(0)
+	if d.resourceConfig.WhatIf {
+		timeout = provisionWhatIfTimeout
+	}
+	if _, err := d.preflight(logger, scope, template, values, timeout); err != nil {
+		if _, ok := err.(*whatIfTimeoutError); !ok {
+			return Operation{}, existed, err
+		}
+		logger.Info("what-if-timeout", lager.Data{"error": err.Error()})
 	}
 
 	// deploy template
-	parameters := struct2map(d.blockchainConfig)
-	link := NewLink(blockchainTemplate, templateVersion)
-	_, err = azureRESTClient.DeployTemplate(deploymentName, nil, link, &parameters, nil)
+	operation, err := d.deploy(scope, template, values)
 	if err != nil {
-		return fmt.Errorf("Error in deploy template: %v", err)
+		return Operation{}, existed, fmt.Errorf("Error in deploy template: %v", err)
 	}
-	return nil
+	return operation, existed, nil
 }
 
-func struct2map(blockchainConfig BlockchainConfig) map[string]interface{} {
+// blockchainParameters returns the values of the template parameters by
+// name.
+func blockchainParameters(blockchainConfig BlockchainConfig) map[string]interface{} {
 	result := make(map[string]interface{})
 
-	result["namePrefix"] = makeStringParameterValueString(blockchainConfig.namePrefix)
-	result["adminUsername"] = makeStringParameterValueString(blockchainConfig.adminUsername)
-	result["adminPassword"] = makeStringParameterValueString(blockchainConfig.adminPassword)
-	result["ethereumAccountPsswd"] = makeStringParameterValueString(blockchainConfig.ethereumAccountPsswd)
-	result["ethereumAccountPassphrase"] = makeStringParameterValueString(blockchainConfig.ethereumAccountPassphrase)
-	result["ethereumNetworkID"] = makeStringParameterValueUint64(blockchainConfig.ethereumNetworkID)
-	result["numConsortiumMembers"] = makeStringParameterValueUint64(blockchainConfig.numConsortiumMembers)
-	result["numMiningNodesPerMember"] = makeStringParameterValueUint64(blockchainConfig.numMiningNodesPerMember)
-	result["mnNodeVMSize"] = makeStringParameterValueString(blockchainConfig.mnNodeVMSize)
-	result["numTXNodes"] = makeStringParameterValueUint64(blockchainConfig.numTXNodes)
-	result["txNodeVMSize"] = makeStringParameterValueString(blockchainConfig.txNodeVMSize)
-
-	return result
-}
+	result["namePrefix"] = blockchainConfig.namePrefix
+	result["adminUsername"] = blockchainConfig.adminUsername
+	result["adminPassword"] = blockchainConfig.adminPassword
+	result["ethereumAccountPsswd"] = blockchainConfig.ethereumAccountPsswd
+	result["ethereumAccountPassphrase"] = blockchainConfig.ethereumAccountPassphrase
+	result["ethereumNetworkID"] = blockchainConfig.ethereumNetworkID
+	result["numConsortiumMembers"] = blockchainConfig.numConsortiumMembers
+	result["numMiningNodesPerMember"] = blockchainConfig.numMiningNodesPerMember
+	result["mnNodeVMSize"] = blockchainConfig.mnNodeVMSize
+	result["numTXNodes"] = blockchainConfig.numTXNodes
+	result["txNodeVMSize"] = blockchainConfig.txNodeVMSize
 
-func makeStringParameterValueString(value string) map[string]string {
-	result := make(map[string]string)
-	result["value"] = value
 	return result
 }
 
-func makeStringParameterValueUint64(value uint64) map[string]uint64 {
-	result := make(map[string]uint64)
-	result["value"] = value
+// parameterValues returns the parameters of a deployment with the values.
+func parameterValues(values map[string]interface{}) map[string]interface{} {
+	result := make(map[string]interface{})
+	for name, value := range values {
+		result[name] = map[string]interface{}{"value": value}
+	}
 	return result
 }
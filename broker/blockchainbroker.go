@@ -2,36 +2,38 @@ package broker
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"net/http"
 	"strings"
-	"sync"
+	"time"
 
 	"code.cloudfoundry.org/lager"
 	"github.com/pivotal-cf/brokerapi"
 )
 
-type lock interface {
-	Lock()
-	Unlock()
-}
-
 type ServiceBroker struct {
-	logger lager.Logger
-	client *DeploymentClient
-	static staticState
-	mutex  lock
-}
-
-type staticState struct {
-	ServiceName string `json:"service_name"`
-	ServiceID   string `json:"service_id"`
+	logger              lager.Logger
+	client              *DeploymentClient
+	resourceGroupConfig ResourceGroupConfig
+	bindingConfig       BindingConfig
+	cleanupConfig       CleanupConfig
+	services            []Service
+	store               Store
+	locks               *instanceLocks
 }
 
 func New(logger lager.Logger,
 	cloudConfig CloudConfig,
 	resourceConfig ResourceConfig,
+	resourceGroupConfig ResourceGroupConfig,
 	blockchainConfig BlockchainConfig,
+	template *Template,
+	bindingConfig BindingConfig,
+	cleanupConfig CleanupConfig,
+	catalog *Catalog,
+	store Store,
 	serviceName string,
 	serviceID string) (*ServiceBroker, error) {
 	logger = logger.Session("new-blockchain-service-broker")
@@ -41,39 +43,140 @@ func New(logger lager.Logger,
 	if err != nil {
 		return nil, err
 	}
+
+	services := catalog.Services
+	if len(services) == 0 {
+		// the plans of the catalog belong to the service of the broker
+		// configuration
+		services = []Service{{
+			ID:          serviceID,
+			Name:        serviceName,
+			Description: "Azure Blockchain",
+			Tags:        []string{"azureblockchain"},
+			NetworkType: NetworkEthereumConsortium,
+			Plans:       catalog.Plans,
+		}}
+	}
+	for i := range services {
+		service := &services[i]
+		if service.template == nil && service.NetworkType == NetworkEthereumConsortium {
+			service.template = template
+		}
+		// an unpinned template could change under the instances
+		if service.template == nil {
+			return nil, fmt.Errorf("No template for the service %s: templatePath or templateURL is required", service.Name)
+		}
+		logger.Info("template", lager.Data{"service": service.Name, "source": service.template.Source, "version": service.template.Version, "sha256": service.template.SHA256})
+		if service.NetworkType == NetworkEthereumConsortium {
+			if err := service.ValidateParameters(service.TemplateParameters(blockchainConfig)); err != nil {
+				return nil, fmt.Errorf("Error in the blockchain configuration: %v", err)
+			}
+		}
+		prefix := ""
+		if len(catalog.Services) > 0 {
+			prefix = fmt.Sprintf("service %d: ", i)
+		}
+		for j, plan := range service.Plans {
+			values := service.TemplateParameters(blockchainConfig.Apply(plan.Parameters), plan.Parameters.Template)
+			if err := service.ValidateParameters(values); err != nil {
+				return nil, fmt.Errorf("Invalid catalog: %splan %d: %v", prefix, j, err)
+			}
+		}
+	}
+
 	serviceBroker := ServiceBroker{
-		logger: logger,
-		mutex:  &sync.Mutex{},
-		client: client,
-		static: staticState{
-			ServiceID:   serviceID,
-			ServiceName: serviceName,
-		},
+		logger:              logger,
+		locks:               newInstanceLocks(),
+		client:              client,
+		resourceGroupConfig: resourceGroupConfig,
+		bindingConfig:       bindingConfig,
+		cleanupConfig:       cleanupConfig,
+		services:            services,
+		store:               store,
 	}
 	return &serviceBroker, nil
 }
 
+// RateLimitHandler serves what ARM last reported of the rate limits of the
+// subscriptions.
+func (b *ServiceBroker) RateLimitHandler() http.Handler {
+	return b.client.azureRESTClient.RateLimitHandler()
+}
+
+// instance returns the record of the instance and whether it is recorded.
+// Instances provisioned before the broker kept records are found by using
+// the instance ID as the name of the resource group and the deployment.
+func (b *ServiceBroker) instance(instanceID string) (InstanceRecord, bool, error) {
+	instance, err := b.store.GetInstance(instanceID)
+	if err == ErrRecordNotFound {
+		return InstanceRecord{
+			InstanceID:        instanceID,
+			DeploymentName:    instanceID,
+			ResourceGroupName: instanceID,
+		}, false, nil
+	}
+	if err != nil {
+		return InstanceRecord{}, false, err
+	}
+	return instance, true, nil
+}
+
 func (b *ServiceBroker) Services(_ context.Context) []brokerapi.Service {
 	logger := b.logger.Session("services")
 	logger.Info("start")
 	defer logger.Info("end")
 
-	return []brokerapi.Service{{
-		ID:            b.static.ServiceID,
-		Name:          b.static.ServiceName,
-		Description:   "Azure Blockchain",
-		Bindable:      true,
-		PlanUpdatable: false,
-		Tags:          []string{"azureblockchain"},
-		Requires:      []brokerapi.RequiredPermission{},
-		Plans: []brokerapi.ServicePlan{
-			{
-				Name:        "AzureBlockchain",
-				ID:          "7c0b2254-7e68-11e7-bbe1-000d3a818256",
-				Description: "Azure Blockchain",
-			},
-		},
-	}}
+	services := []brokerapi.Service{}
+	for _, service := range b.services {
+		plans := []brokerapi.ServicePlan{}
+		for _, plan := range service.Plans {
+			plans = append(plans, brokerapi.ServicePlan{
+				Name:        plan.Name,
+				ID:          plan.ID,
+				Description: plan.Description,
+				Free:        plan.Free,
+			})
+		}
+		services = append(services, brokerapi.Service{
+			ID:            service.ID,
+			Name:          service.Name,
+			Description:   service.Description,
+			Bindable:      true,
+			PlanUpdatable: true,
+			Tags:          service.Tags,
+			Requires:      []brokerapi.RequiredPermission{},
+			Plans:         plans,
+		})
+	}
+	return services
+}
+
+// findPlan returns the service and the plan with the IDs.
+func (b *ServiceBroker) findPlan(serviceID, planID string) (*Service, Plan, bool) {
+	for i := range b.services {
+		service := &b.services[i]
+		if serviceID != "" && service.ID != serviceID {
+			continue
+		}
+		if plan, ok := service.FindPlan(planID); ok {
+			return service, plan, true
+		}
+	}
+	return nil, Plan{}, false
+}
+
+// service returns the service of the instance. Instances provisioned before
+// the broker offered several services belong to the first one.
+func (b *ServiceBroker) service(instance InstanceRecord) *Service {
+	for i := range b.services {
+		if b.services[i].ID == instance.ServiceID {
+			return &b.services[i]
+		}
+	}
+	if service, _, ok := b.findPlan("", instance.PlanID); ok {
+		return service
+	}
+	return &b.services[0]
 }
 
 func (b *ServiceBroker) LastOperation(_ context.Context, instanceID string, operationData string) (brokerapi.LastOperation, error) {
@@ -81,74 +184,385 @@ func (b *ServiceBroker) LastOperation(_ context.Context, instanceID string, oper
 	logger.Info("start")
 	defer logger.Info("end")
 
-	b.mutex.Lock()
-	defer b.mutex.Unlock()
+	unlock := b.locks.Lock(instanceID)
+	defer unlock()
 
-	if operationData == "" {
-		return brokerapi.LastOperation{}, errors.New("unrecognized operationData")
+	operation, err := ParseOperationData(operationData)
+	if err == nil {
+		err = b.client.azureRESTClient.ValidateOperation(operation)
 	}
-
-	client := *(b.client.azureRESTClient)
-	client.resourceConfig.ResourceGroupName = instanceID
-	operationDataArr := strings.Split(operationData, ":")
-	if len(operationDataArr) != 2 {
-		return brokerapi.LastOperation{}, errors.New("unrecognized operationData")
+	if err != nil {
+		logger.Error("parse-operation-data", err)
+		return brokerapi.LastOperation{}, brokerapi.NewFailureResponse(err, http.StatusBadRequest, "parse-operation-data")
+	}
+	instance, recorded, err := b.instance(instanceID)
+	if err != nil {
+		logger.Error("get-instance", err)
+		return brokerapi.LastOperation{}, err
+	}
+	if operation.Kind == "deprovision" {
+		return b.lastDeprovision(logger, instance, recorded, operation)
 	}
-	var state string
-	var err error
-	if operationDataArr[0] == "provision" {
-		state, err = client.CheckCompletion(operationDataArr[1])
-	} else if operationDataArr[0] == "deprovision" {
-		state, err = client.CheckResourceStatus(operationDataArr[1])
+	service := b.service(instance)
+	// the network of a failed update still runs, so the instance stays
+	// succeeded with the failure of the update
+	if recorded && instance.State == StateSucceeded && operation.Kind == "update" && instance.Failure != "" {
+		return brokerapi.LastOperation{State: brokerapi.Failed, Description: instance.Failure}, nil
+	}
+	if recorded && instance.State == StateSucceeded {
+		adminSiteURL, rpcURL := service.Endpoints(instance.Outputs)
+		description := fmt.Sprintf("{\"adminSiteURL\": \"%s\", \"rpcURL\": \"%s\"}", adminSiteURL, rpcURL)
+		return brokerapi.LastOperation{State: brokerapi.Succeeded, Description: description}, nil
+	}
+	// the deployment may be gone with the resource group of a failed
+	// provision
+	if recorded && instance.State == StateFailed && instance.Failure != "" {
+		return brokerapi.LastOperation{State: brokerapi.Failed, Description: instance.Failure}, nil
 	}
 
-	state = strings.ToLower(state)
-	logger.Info("check-state", lager.Data{
-		"state": state,
-	})
-	description := ""
+	client := b.client.azureRESTClient
+	scope := b.client.Scope(instance)
+	status, err := b.deploymentStatus(scope, operation)
 	if err != nil {
 		return brokerapi.LastOperation{State: brokerapi.Failed, Description: err.Error()}, nil
 	}
-	if state == "succeeded" {
-		// only provision can return succeeded
-		adminSiteURL, rpcURL, err := client.GetAdminAndRPCUrl(operationDataArr[1])
+	logger.Info("check-state", lager.Data{
+		"state":      status.State,
+		"retryAfter": status.RetryAfter.String(),
+	})
+	switch status.State {
+	case OperationSucceeded:
+		outputs, err := client.GetOutputs(scope, service.outputNames().RPCEndpoint)
 		if err != nil {
 			return brokerapi.LastOperation{State: brokerapi.Failed, Description: err.Error()}, nil
 		}
-		description = fmt.Sprintf("{\"adminSiteURL\": \"%s\", \"rpcURL\": \"%s\"}", adminSiteURL, rpcURL)
-		return brokerapi.LastOperation{State: brokerapi.Succeeded, Description: description}, nil
-	} else if state == "notfound" && operationDataArr[0] == "deprovision" {
+		if recorded {
+			instance.State = StateSucceeded
+			instance.Outputs = outputs
+			instance.Failure = ""
+			instance.OperationData = ""
+			b.putInstance(logger, instance)
+		}
+		adminSiteURL, rpcURL := service.Endpoints(outputs)
+		description := fmt.Sprintf("{\"adminSiteURL\": \"%s\", \"rpcURL\": \"%s\"}", adminSiteURL, rpcURL)
 		return brokerapi.LastOperation{State: brokerapi.Succeeded, Description: description}, nil
-	} else if state == "failed" {
+	case OperationFailed, OperationCanceled:
+		failure := ""
+		if status.Error != nil {
+			failure = status.Error.Error()
+		}
+		if summary, err := client.DeploymentFailure(scope); err != nil {
+			logger.Error("get-deployment-failure", err)
+		} else if summary != "" {
+			failure = summary
+		}
+		description := fmt.Sprintf("Deployment %s %s", scope.DeploymentName, strings.ToLower(string(status.State)))
+		if failure != "" {
+			description += ": " + failure
+		}
+		description = truncateDescription(description)
+		if recorded {
+			instance.State = StateFailed
+			if operation.Kind == "update" {
+				instance.State = StateSucceeded
+			}
+			instance.Failure = description
+			instance.FailedOperation = operation.Kind
+			instance.OperationData = ""
+			// only the resources of a failed provision are of no use
+			if operation.Kind == "provision" && instance.GroupCreated && b.cleanupConfig.Enabled {
+				instance.Cleanup = &CleanupRecord{After: time.Now().UTC().Add(b.cleanupConfig.GracePeriod)}
+			}
+			b.putInstance(logger, instance)
+			if instance.Cleanup != nil {
+				if _, err := b.cleanUp(logger, &instance, false); err != nil {
+					logger.Error("clean-up", err)
+				}
+			}
+		}
 		return brokerapi.LastOperation{State: brokerapi.Failed, Description: description}, nil
 	}
+	return brokerapi.LastOperation{State: brokerapi.InProgress, Description: ""}, nil
+}
+
+// deploymentStatus follows the operation of the deployment if ARM returned a
+// URL for it, otherwise the provisioning state of the deployment.
+func (b *ServiceBroker) deploymentStatus(scope Scope, operation Operation) (OperationStatus, error) {
+	client := b.client.azureRESTClient
+	if operation.Trackable() {
+		return client.PollOperation(operation)
+	}
+	state, err := client.CheckCompletion(scope)
+	if err != nil {
+		return OperationStatus{}, err
+	}
+	switch strings.ToLower(state) {
+	case "succeeded":
+		return OperationStatus{State: OperationSucceeded}, nil
+	case "failed":
+		return OperationStatus{State: OperationFailed}, nil
+	case "canceled":
+		return OperationStatus{State: OperationCanceled}, nil
+	}
+	return OperationStatus{State: OperationInProgress}, nil
+}
 
+// deletionStatus follows the deletion of the resource group if ARM returned
+// a URL for it. Without the operation, e.g. for instances deleted by an
+// older broker, it waits for the group to disappear.
+func (b *ServiceBroker) deletionStatus(scope Scope, operation Operation) (OperationStatus, error) {
+	client := b.client.azureRESTClient
+	if operation.Trackable() {
+		return client.PollOperation(operation)
+	}
+	state, err := client.CheckResourceStatus(scope)
+	if err != nil {
+		return OperationStatus{}, err
+	}
+	if state == "notfound" {
+		return OperationStatus{State: OperationSucceeded}, nil
+	}
+	return OperationStatus{State: OperationInProgress}, nil
+}
+
+// lastDeprovision reports the deletion of the resource group of the instance
+// and forgets the instance once the group is gone.
+func (b *ServiceBroker) lastDeprovision(logger lager.Logger, instance InstanceRecord, recorded bool, operation Operation) (brokerapi.LastOperation, error) {
+	scope := b.client.Scope(instance)
+	status, err := b.deletionStatus(scope, operation)
+	if err != nil {
+		description := fmt.Sprintf("Failed to check the deletion of resource group %s: %v", scope.ResourceGroupName, err)
+		return brokerapi.LastOperation{State: brokerapi.Failed, Description: description}, nil
+	}
+	logger.Info("check-state", lager.Data{
+		"state":      status.State,
+		"retryAfter": status.RetryAfter.String(),
+	})
+
+	switch status.State {
+	case OperationSucceeded:
+		if err := b.store.DeleteInstance(instance.InstanceID); err != nil {
+			logger.Error("delete-instance", err)
+			return brokerapi.LastOperation{}, err
+		}
+		description := fmt.Sprintf("Resource group %s has been deleted", scope.ResourceGroupName)
+		return brokerapi.LastOperation{State: brokerapi.Succeeded, Description: description}, nil
+	case OperationFailed, OperationCanceled:
+		if recorded {
+			instance.State = StateFailed
+			instance.FailedOperation = operation.Kind
+			b.putInstance(logger, instance)
+		}
+		description := fmt.Sprintf("Failed to delete resource group %s", scope.ResourceGroupName)
+		if status.Error != nil {
+			description += ": " + status.Error.Error()
+		}
+		return brokerapi.LastOperation{State: brokerapi.Failed, Description: description}, nil
+	}
+	description := fmt.Sprintf("Deleting resource group %s", scope.ResourceGroupName)
 	return brokerapi.LastOperation{State: brokerapi.InProgress, Description: description}, nil
 }
 
+// provisionRequest is a provision of a plan with its parameters.
+type provisionRequest struct {
+	service    *Service
+	parameters ProvisionParameters
+	// values are the values of the template parameters
+	values   map[string]interface{}
+	location string
+}
+
+// checkProvision finds the plan and checks the parameters of a provision.
+// Its errors are failure responses.
+func (b *ServiceBroker) checkProvision(logger lager.Logger, serviceID, planID string, rawParameters json.RawMessage) (provisionRequest, error) {
+	service, plan, ok := b.findPlan(serviceID, planID)
+	if !ok {
+		err := fmt.Errorf("Unknown plan ID: %s", planID)
+		logger.Error("find-plan", err)
+		return provisionRequest{}, brokerapi.NewFailureResponse(err, http.StatusBadRequest, "find-plan")
+	}
+	parameters, err := ParseProvisionParameters(rawParameters)
+	if err == nil {
+		err = service.ValidateProvisionParameters(parameters)
+	}
+	if err != nil {
+		logger.Error("parse-parameters", err)
+		return provisionRequest{}, brokerapi.NewFailureResponse(err, http.StatusBadRequest, "parse-parameters")
+	}
+	blockchainConfig := b.client.blockchainConfig.Apply(plan.Parameters).Apply(parameters)
+	values := service.TemplateParameters(blockchainConfig, plan.Parameters.Template, parameters.Template)
+	if err := service.ValidateParameters(values); err != nil {
+		logger.Error("validate-parameters", err)
+		return provisionRequest{}, brokerapi.NewFailureResponse(err, http.StatusBadRequest, "validate-parameters")
+	}
+	location := b.client.resourceConfig.Location
+	if plan.Parameters.Location != nil {
+		location = *plan.Parameters.Location
+	}
+	if parameters.Location != nil {
+		location = *parameters.Location
+	}
+	return provisionRequest{
+		service:    service,
+		parameters: parameters,
+		values:     values,
+		location:   location,
+	}, nil
+}
+
 func (b *ServiceBroker) Provision(context context.Context, instanceID string, details brokerapi.ProvisionDetails, asyncAllowed bool) (_ brokerapi.ProvisionedServiceSpec, e error) {
 	logger := b.logger.Session("provision").WithData(lager.Data{"instanceID": instanceID, "details": details, "asyncAllowed": asyncAllowed})
 	logger.Info("start")
 	defer logger.Info("end")
 
+	request, err := b.checkProvision(logger, details.ServiceID, details.PlanID, details.RawParameters)
+	if err != nil {
+		return brokerapi.ProvisionedServiceSpec{}, err
+	}
+
 	// Use async to process blockchain provision
-	b.mutex.Lock()
-	defer b.mutex.Unlock()
+	unlock := b.locks.Lock(instanceID)
+	defer unlock()
 
-	b.client.azureRESTClient.resourceConfig.ResourceGroupName = instanceID
-	err := b.client.Create(instanceID)
+	// a retried provision starts clean, once the resource group of the
+	// failed one is deleted
+	previous, recorded, err := b.instance(instanceID)
 	if err != nil {
-		logger.Error("create-blockchain-service", err)
+		logger.Error("get-instance", err)
+		return brokerapi.ProvisionedServiceSpec{}, err
+	}
+	retried := recorded && previous.State == StateFailed && previous.FailedOperation == "provision"
+	if recorded && !retried {
+		return b.existingInstance(context, logger, previous, details, request, asyncAllowed)
+	}
+	if retried && previous.Cleanup != nil {
+		done, err := b.cleanUp(logger, &previous, true)
+		if err != nil {
+			logger.Error("clean-up", err)
+			return brokerapi.ProvisionedServiceSpec{}, err
+		}
+		if !done {
+			err := fmt.Errorf("The resource group %s of the failed provision is being deleted, please retry later", previous.ResourceGroupName)
+			return brokerapi.ProvisionedServiceSpec{}, brokerapi.NewFailureResponse(err, http.StatusUnprocessableEntity, "clean-up")
+		}
+	}
+
+	instance := InstanceRecord{
+		InstanceID:        instanceID,
+		ServiceID:         details.ServiceID,
+		PlanID:            details.PlanID,
+		OrganizationGUID:  details.OrganizationGUID,
+		SpaceGUID:         details.SpaceGUID,
+		Parameters:        request.parameters,
+		DeploymentName:    instanceID,
+		ResourceGroupName: b.resourceGroupConfig.ResourceGroupName(instanceID, details.OrganizationGUID, details.SpaceGUID),
+		Location:          request.location,
+		State:             StateProvisioning,
+		CreatedAt:         time.Now().UTC(),
+	}
+	instance.TemplateVersion, instance.TemplateSHA256 = request.service.TemplateVersion()
+	// record the instance before deploying, so it is never lost
+	if err := b.store.PutInstance(instance); err != nil {
+		logger.Error("put-instance", err)
 		return brokerapi.ProvisionedServiceSpec{}, err
 	}
-	lastOperation := instanceID
+
+	operation, existed, err := b.client.Create(b.client.Scope(instance), resourceGroupTags(instance), request.service.template, request.values)
 	if err != nil {
-		logger.Error("get-status-url", err)
+		logger.Error("create-blockchain-service", err)
+		if existed {
+			// the group of an earlier provision remains, so the instance
+			// is kept as failed for the group to be cleaned up
+			instance.State = StateFailed
+			instance.Failure = truncateDescription(err.Error())
+			instance.FailedOperation = "provision"
+			instance.GroupCreated = true
+			if b.cleanupConfig.Enabled {
+				instance.Cleanup = &CleanupRecord{After: time.Now().UTC().Add(b.cleanupConfig.GracePeriod)}
+			}
+			b.putInstance(logger, instance)
+			if instance.Cleanup != nil {
+				if _, err := b.cleanUp(logger, &instance, false); err != nil {
+					logger.Error("clean-up", err)
+				}
+			}
+		} else if err := b.store.DeleteInstance(instanceID); err != nil {
+			logger.Error("delete-instance", err)
+		}
+		switch err.(type) {
+		case *ValidationError:
+			return brokerapi.ProvisionedServiceSpec{}, brokerapi.NewFailureResponse(err, http.StatusBadRequest, "validate-deployment")
+		case *GroupConflictError:
+			return brokerapi.ProvisionedServiceSpec{}, brokerapi.NewFailureResponse(err, http.StatusConflict, "resource-group-exists")
+		case *GroupDeletingError:
+			return brokerapi.ProvisionedServiceSpec{}, brokerapi.NewFailureResponse(err, http.StatusUnprocessableEntity, "resource-group-deleting")
+		}
 		return brokerapi.ProvisionedServiceSpec{}, err
 	}
+	// the group is the broker's, whether it was created now or for a
+	// provision which failed
+	instance.GroupCreated = true
+	operation.Kind = "provision"
+	instance.OperationData = operation.OperationData()
+	b.putInstance(logger, instance)
+	return brokerapi.ProvisionedServiceSpec{IsAsync: true, OperationData: instance.OperationData}, nil
+}
 
-	return brokerapi.ProvisionedServiceSpec{IsAsync: true, OperationData: "provision:" + lastOperation}, nil
+// existingInstance answers a provision of an instance which is recorded
+// already. It is the same instance if it has the same service, plan and
+// parameters, and its provision is then either in progress or done.
+func (b *ServiceBroker) existingInstance(ctx context.Context, logger lager.Logger, instance InstanceRecord, details brokerapi.ProvisionDetails, request provisionRequest, asyncAllowed bool) (brokerapi.ProvisionedServiceSpec, error) {
+	logger = logger.WithData(lager.Data{"state": instance.State})
+	if b.service(instance) != request.service || instance.PlanID != details.PlanID || !instance.Parameters.Equal(request.parameters) {
+		logger.Info("instance-conflict")
+		return brokerapi.ProvisionedServiceSpec{}, brokerapi.ErrInstanceAlreadyExists
+	}
+	switch instance.State {
+	case StateProvisioning:
+		logger.Info("provision-in-progress")
+		if !asyncAllowed {
+			return brokerapi.ProvisionedServiceSpec{}, brokerapi.ErrAsyncRequired
+		}
+		operationData := instance.OperationData
+		if operationData == "" {
+			// without its URL, the deployment is followed by its state
+			operationData = Operation{Kind: "provision"}.OperationData()
+		}
+		return brokerapi.ProvisionedServiceSpec{IsAsync: true, OperationData: operationData}, nil
+	case StateSucceeded:
+		logger.Info("instance-already-exists")
+		markAlreadyExists(ctx)
+		return brokerapi.ProvisionedServiceSpec{}, nil
+	case StateFailed:
+		// only a failed provision is retried; the network of a failed
+		// deprovision may still run
+		logger.Info("instance-failed")
+		return brokerapi.ProvisionedServiceSpec{}, brokerapi.ErrInstanceAlreadyExists
+	}
+	logger.Info("instance-busy")
+	return brokerapi.ProvisionedServiceSpec{}, brokerapi.ErrConcurrentInstanceAccess
+}
+
+// DryRun checks a provision of the plan with the parameters, against the
+// parameters of the template and with ARM, without deploying anything. It
+// returns the changes the deployment would make if the environment supports
+// what-if.
+func (b *ServiceBroker) DryRun(serviceID, planID string, rawParameters json.RawMessage) ([]WhatIfChange, error) {
+	logger := b.logger.Session("dry-run", lager.Data{"serviceID": serviceID, "planID": planID})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	request, err := b.checkProvision(logger, serviceID, planID, rawParameters)
+	if err != nil {
+		return nil, err
+	}
+	name := fmt.Sprintf("dry-run-%d", time.Now().UnixNano())
+	scope := b.client.Scope(InstanceRecord{
+		ResourceGroupName: name,
+		DeploymentName:    name,
+		Location:          request.location,
+	})
+	return b.client.DryRun(scope, request.service.template, request.values)
 }
 
 func (b *ServiceBroker) Bind(context context.Context, instanceID string, bindingID string, details brokerapi.BindDetails) (_ brokerapi.Binding, e error) {
@@ -156,27 +570,187 @@ func (b *ServiceBroker) Bind(context context.Context, instanceID string, binding
 	logger.Info("start")
 	defer logger.Info("end")
 
-	b.mutex.Lock()
-	defer b.mutex.Unlock()
+	unlock := b.locks.Lock(instanceID)
+	defer unlock()
 
-	client := *(b.client.azureRESTClient)
-	ready, err := client.CheckCompletion(instanceID)
+	instance, recorded, err := b.instance(instanceID)
 	if err != nil {
+		logger.Error("get-instance", err)
 		return brokerapi.Binding{}, err
 	}
-	if strings.ToLower(ready) != "succeeded" {
-		return brokerapi.Binding{}, errors.New("Provision has not been finish")
+
+	if _, ok := instance.Bindings[bindingID]; ok {
+		return brokerapi.Binding{}, brokerapi.ErrBindingAlreadyExists
 	}
 
-	_, rpcURL, err := client.GetAdminAndRPCUrl(instanceID)
-	if err != nil {
-		return brokerapi.Binding{}, err
+	service := b.service(instance)
+	scope := b.client.Scope(instance)
+	instance.Location = scope.Location
+	if !recorded || instance.State != StateSucceeded || len(instance.Outputs) == 0 {
+		client := b.client.azureRESTClient
+		ready, err := client.CheckCompletion(scope)
+		if err != nil {
+			return brokerapi.Binding{}, err
+		}
+		if strings.ToLower(ready) != "succeeded" {
+			return brokerapi.Binding{}, errors.New("Provision has not finished")
+		}
+
+		instance.Outputs, err = client.GetOutputs(scope, service.outputNames().RPCEndpoint)
+		if err != nil {
+			return brokerapi.Binding{}, err
+		}
 	}
-	return brokerapi.Binding{Credentials: rpcURL}, err
+
+	// only the bindings of Ethereum networks get accounts
+	var account *EthereumAccount
+	binding := BindingRecord{
+		BindingID: bindingID,
+		AppGUID:   details.AppGUID,
+		CreatedAt: time.Now().UTC(),
+	}
+	if service.networkType().Ethereum() {
+		account, err = NewEthereumAccount()
+		if err != nil {
+			logger.Error("new-ethereum-account", err)
+			return brokerapi.Binding{}, err
+		}
+		binding.Address = account.Address
+	}
+	// the binding is recorded before its account is funded, so a binding
+	// which cannot be recorded never costs a transfer
+	if recorded {
+		if err := b.store.PutBinding(instanceID, binding); err != nil {
+			logger.Error("put-binding", err)
+			return brokerapi.Binding{}, err
+		}
+	}
+
+	// only the consortium network unlocks its default account with the
+	// password of the broker configuration
+	if fundAmount := b.bindingConfig.FundAmount; fundAmount != nil && fundAmount.Sign() > 0 && service.NetworkType == NetworkEthereumConsortium {
+		_, rpcURL := service.Endpoints(instance.Outputs)
+		transactionHash, err := NewEthereumRPCClient(b.client.azureRESTClient.client, rpcURL).FundAccount(b.client.blockchainConfig.ethereumAccountPsswd, account.Address, fundAmount)
+		if err != nil {
+			logger.Error("fund-account", err)
+			// the account is of no use without its private key, so the
+			// binding is forgotten for the platform to bind again
+			if recorded {
+				if err := b.store.DeleteBinding(instanceID, bindingID); err != nil {
+					logger.Error("delete-binding", err)
+				}
+			}
+			return brokerapi.Binding{}, err
+		}
+		logger.Info("fund-account", lager.Data{"address": account.Address, "transactionHash": transactionHash})
+	}
+
+	credentials := NewCredentials(instance, service, b.blockchainConfig(instance), account)
+	return brokerapi.Binding{Credentials: credentials}, nil
 }
 
-func (b *ServiceBroker) Update(context context.Context, instanceID string, details brokerapi.UpdateDetails, asyncAllowed bool) (brokerapi.UpdateServiceSpec, error) {
-	panic("not implemented")
+func (b *ServiceBroker) Update(context context.Context, instanceID string, details brokerapi.UpdateDetails, asyncAllowed bool) (_ brokerapi.UpdateServiceSpec, e error) {
+	logger := b.logger.Session("update").WithData(lager.Data{"instanceID": instanceID, "details": details, "asyncAllowed": asyncAllowed})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	if !asyncAllowed {
+		return brokerapi.UpdateServiceSpec{}, brokerapi.ErrAsyncRequired
+	}
+
+	parameters, err := ParseProvisionParameters(details.RawParameters)
+	if err == nil {
+		err = parameters.ValidateUpdate()
+	}
+	if err != nil {
+		logger.Error("parse-parameters", err)
+		return brokerapi.UpdateServiceSpec{}, brokerapi.NewFailureResponse(err, http.StatusBadRequest, "parse-parameters")
+	}
+
+	unlock := b.locks.Lock(instanceID)
+	defer unlock()
+
+	instance, recorded, err := b.instance(instanceID)
+	if err != nil {
+		logger.Error("get-instance", err)
+		return brokerapi.UpdateServiceSpec{}, err
+	}
+
+	// the platform may omit the previous values, so the plan is compared
+	// with the recorded one
+	previousPlanID := instance.PlanID
+	if !recorded {
+		previousPlanID = details.PreviousValues.PlanID
+	}
+	planChanged := details.PlanID != "" && details.PlanID != previousPlanID
+	var plan Plan
+	if planChanged {
+		var ok bool
+		_, plan, ok = b.findPlan(details.ServiceID, details.PlanID)
+		if !ok {
+			err := fmt.Errorf("Unknown plan ID: %s", details.PlanID)
+			logger.Error("find-plan", err)
+			return brokerapi.UpdateServiceSpec{}, brokerapi.NewFailureResponse(err, http.StatusBadRequest, "find-plan")
+		}
+		// the network ID and the location of a deployed network never change
+		plan.Parameters.EthereumNetworkID = nil
+		plan.Parameters.Location = nil
+	}
+
+	service := b.service(instance)
+	if err := service.ValidateProvisionParameters(parameters); err != nil {
+		logger.Error("parse-parameters", err)
+		return brokerapi.UpdateServiceSpec{}, brokerapi.NewFailureResponse(err, http.StatusBadRequest, "parse-parameters")
+	}
+	if !planChanged {
+		plan, _ = service.FindPlan(instance.PlanID)
+	} else if _, ok := service.FindPlan(details.PlanID); !ok {
+		err := fmt.Errorf("Plan %s is not a plan of service %s", details.PlanID, service.Name)
+		logger.Error("find-plan", err)
+		return brokerapi.UpdateServiceSpec{}, brokerapi.NewFailureResponse(err, http.StatusBadRequest, "find-plan")
+	}
+
+	scope := b.client.Scope(instance)
+	properties, err := b.client.azureRESTClient.GetDeploymentProperties(scope)
+	if err != nil {
+		logger.Error("get-deployment", err)
+		return brokerapi.UpdateServiceSpec{}, err
+	}
+	if state := strings.ToLower(properties.ProvisioningState); state != "succeeded" && state != "failed" && state != "canceled" {
+		logger.Info("deployment-in-progress", lager.Data{"state": state})
+		return brokerapi.UpdateServiceSpec{}, brokerapi.ErrConcurrentInstanceAccess
+	}
+
+	// start from what is deployed now, then apply the new plan and parameters
+	blockchainConfig := b.client.blockchainConfig.Apply(deployedParameters(properties))
+	if planChanged {
+		blockchainConfig = blockchainConfig.Apply(plan.Parameters)
+	}
+	blockchainConfig = blockchainConfig.Apply(parameters)
+	values := service.TemplateParameters(blockchainConfig, plan.Parameters.Template, instance.Parameters.Template, parameters.Template)
+	if err := service.ValidateParameters(values); err != nil {
+		logger.Error("validate-parameters", err)
+		return brokerapi.UpdateServiceSpec{}, brokerapi.NewFailureResponse(err, http.StatusBadRequest, "validate-parameters")
+	}
+
+	operation, err := b.client.Update(scope, service.template, values)
+	if err != nil {
+		logger.Error("update-blockchain-service", err)
+		return brokerapi.UpdateServiceSpec{}, err
+	}
+
+	if recorded {
+		if planChanged {
+			instance.PlanID = details.PlanID
+		}
+		instance.Parameters = instance.Parameters.Merge(parameters)
+		instance.State = StateUpdating
+		instance.TemplateVersion, instance.TemplateSHA256 = service.TemplateVersion()
+		b.putInstance(logger, instance)
+	}
+
+	operation.Kind = "update"
+	return brokerapi.UpdateServiceSpec{IsAsync: true, OperationData: operation.OperationData()}, nil
 }
 
 func (b *ServiceBroker) Unbind(context context.Context, instanceID string, bindingID string, details brokerapi.UnbindDetails) (e error) {
@@ -184,12 +758,28 @@ func (b *ServiceBroker) Unbind(context context.Context, instanceID string, bindi
 	logger.Info("start")
 	defer logger.Info("end")
 
-	b.mutex.Lock()
-	defer b.mutex.Unlock()
+	unlock := b.locks.Lock(instanceID)
+	defer unlock()
 
-	client := *(b.client.azureRESTClient)
-	client.resourceConfig.ResourceGroupName = instanceID
-	state, err := client.CheckResourceStatus(instanceID)
+	instance, recorded, err := b.instance(instanceID)
+	if err != nil {
+		logger.Error("get-instance", err)
+		return err
+	}
+	if recorded {
+		// the broker never kept the private key, so forgetting the address
+		// discards the account of the binding
+		err := b.store.DeleteBinding(instanceID, bindingID)
+		if err == ErrRecordNotFound {
+			return brokerapi.ErrBindingDoesNotExist
+		}
+		if err == nil {
+			logger.Info("discard-account", lager.Data{"address": instance.Bindings[bindingID].Address})
+		}
+		return err
+	}
+
+	state, err := b.client.azureRESTClient.CheckResourceStatus(b.client.Scope(instance))
 	if state == "notfound" {
 		return errors.New("binding does not exist.")
 	}
@@ -206,22 +796,71 @@ func (b *ServiceBroker) Deprovision(context context.Context, instanceID string,
 	logger.Info("start")
 	defer logger.Info("end")
 
-	b.mutex.Lock()
-	defer b.mutex.Unlock()
+	// deleting a resource group takes minutes
+	if !asyncAllowed {
+		return brokerapi.DeprovisionServiceSpec{}, brokerapi.ErrAsyncRequired
+	}
+
+	unlock := b.locks.Lock(instanceID)
+	defer unlock()
 
-	client := *(b.client.azureRESTClient)
-	client.resourceConfig.ResourceGroupName = instanceID
-	exist, err := client.GroupExist()
+	instance, recorded, err := b.instance(instanceID)
 	if err != nil {
+		logger.Error("get-instance", err)
 		return brokerapi.DeprovisionServiceSpec{}, err
 	}
-	if !exist {
-		return brokerapi.DeprovisionServiceSpec{}, nil
-	}
 
-	_, err = client.DeleteGroup()
+	client := b.client.azureRESTClient
+	scope := b.client.Scope(instance)
+	exist, err := client.GroupExist(scope)
 	if err != nil {
 		return brokerapi.DeprovisionServiceSpec{}, err
 	}
-	return brokerapi.DeprovisionServiceSpec{IsAsync: false, OperationData: "deprovision:" + instanceID}, nil
+	operation := Operation{}
+	deleted := !exist
+	if exist {
+		operation, deleted, err = client.DeleteGroup(scope)
+		if err != nil {
+			logger.Error("delete-group", err)
+			return brokerapi.DeprovisionServiceSpec{}, err
+		}
+	}
+	// the group is gone already, so the instance is forgotten now; an
+	// untrackable deletion in progress is followed by LastOperation, which
+	// polls the group
+	if deleted {
+		if err := b.store.DeleteInstance(instanceID); err != nil {
+			logger.Error("delete-instance", err)
+			return brokerapi.DeprovisionServiceSpec{}, err
+		}
+		return brokerapi.DeprovisionServiceSpec{}, nil
+	}
+
+	if recorded {
+		instance.State = StateDeprovisioning
+		if err := b.store.PutInstance(instance); err != nil {
+			logger.Error("put-instance", err)
+			return brokerapi.DeprovisionServiceSpec{}, err
+		}
+	}
+	operation.Kind = "deprovision"
+	return brokerapi.DeprovisionServiceSpec{IsAsync: true, OperationData: operation.OperationData()}, nil
+}
+
+// blockchainConfig returns the configuration the instance was deployed with
+// according to its plan and parameters.
+func (b *ServiceBroker) blockchainConfig(instance InstanceRecord) BlockchainConfig {
+	blockchainConfig := b.client.blockchainConfig
+	if plan, ok := b.service(instance).FindPlan(instance.PlanID); ok {
+		blockchainConfig = blockchainConfig.Apply(plan.Parameters)
+	}
+	return blockchainConfig.Apply(instance.Parameters)
+}
+
+// putInstance saves the instance after its state has been learnt from Azure.
+// Failures are only logged, because the state is learnt again next time.
+func (b *ServiceBroker) putInstance(logger lager.Logger, instance InstanceRecord) {
+	if err := b.store.PutInstance(instance); err != nil {
+		logger.Error("put-instance", err)
+	}
 }
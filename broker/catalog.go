@@ -0,0 +1,155 @@
+package broker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	resty "gopkg.in/resty.v0"
+)
+
+const (
+	defaultPlanID   = "7c0b2254-7e68-11e7-bbe1-000d3a818256"
+	defaultPlanName = "AzureBlockchain"
+)
+
+// Plan is a service plan which carries its own defaults for the template
+// parameters. Nil parameters fall back to the broker configuration.
+type Plan struct {
+	ID          string              `json:"id"`
+	Name        string              `json:"name"`
+	Description string              `json:"description"`
+	Free        *bool               `json:"free,omitempty"`
+	Parameters  ProvisionParameters `json:"parameters"`
+}
+
+// Catalog is either the plans of the service of the broker configuration,
+// or the services, each with its own network type, template and plans.
+type Catalog struct {
+	Services []Service `json:"services,omitempty"`
+	Plans    []Plan    `json:"plans,omitempty"`
+}
+
+// DefaultCatalog is used when no catalog file is configured. It has a single
+// plan which deploys the broker configuration as it is.
+func DefaultCatalog() *Catalog {
+	return &Catalog{
+		Plans: []Plan{
+			{
+				ID:          defaultPlanID,
+				Name:        defaultPlanName,
+				Description: "Azure Blockchain",
+			},
+		},
+	}
+}
+
+func LoadCatalog(path string) (*Catalog, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error in read catalog file: %v", err)
+	}
+	catalog := new(Catalog)
+	if err := json.Unmarshal(content, catalog); err != nil {
+		return nil, fmt.Errorf("Error in parse catalog file %s: %v", path, err)
+	}
+	if err := catalog.Validate(); err != nil {
+		return nil, err
+	}
+	return catalog, nil
+}
+
+func (c *Catalog) Validate() error {
+	if len(c.Services) > 0 && len(c.Plans) > 0 {
+		return errors.New("Catalog should contain either services or plans")
+	}
+	if len(c.Services) == 0 {
+		if len(c.Plans) == 0 {
+			return errors.New("Catalog should contain at least one plan")
+		}
+		invalid := validatePlans(c.Plans, "", map[string]bool{})
+		if len(invalid) > 0 {
+			return errors.New("Invalid catalog: " + strings.Join(invalid, ", "))
+		}
+		return nil
+	}
+
+	invalid := []string{}
+	ids := map[string]bool{}
+	names := map[string]bool{}
+	planIDs := map[string]bool{}
+	for i, service := range c.Services {
+		if service.ID == "" {
+			invalid = append(invalid, fmt.Sprintf("service %d: missing id", i))
+		} else if ids[service.ID] {
+			invalid = append(invalid, fmt.Sprintf("service %d: duplicated id %s", i, service.ID))
+		}
+		if service.Name == "" {
+			invalid = append(invalid, fmt.Sprintf("service %d: missing name", i))
+		} else if names[service.Name] {
+			invalid = append(invalid, fmt.Sprintf("service %d: duplicated name %s", i, service.Name))
+		}
+		if service.Description == "" {
+			invalid = append(invalid, fmt.Sprintf("service %d: missing description", i))
+		}
+		if err := service.Validate(); err != nil {
+			invalid = append(invalid, fmt.Sprintf("service %d: %v", i, err))
+		}
+		if len(service.Plans) == 0 {
+			invalid = append(invalid, fmt.Sprintf("service %d: missing plans", i))
+		}
+		invalid = append(invalid, validatePlans(service.Plans, fmt.Sprintf("service %d: ", i), planIDs)...)
+		for j, plan := range service.Plans {
+			if err := service.ValidateProvisionParameters(plan.Parameters); err != nil {
+				invalid = append(invalid, fmt.Sprintf("service %d: plan %d: %v", i, j, err))
+			}
+		}
+		ids[service.ID] = true
+		names[service.Name] = true
+	}
+
+	if len(invalid) > 0 {
+		return errors.New("Invalid catalog: " + strings.Join(invalid, ", "))
+	}
+	return nil
+}
+
+// validatePlans checks the plans of a service. The IDs of the plans must be
+// unique across the services.
+func validatePlans(plans []Plan, prefix string, ids map[string]bool) []string {
+	invalid := []string{}
+	names := map[string]bool{}
+	for i, plan := range plans {
+		if plan.ID == "" {
+			invalid = append(invalid, fmt.Sprintf("%splan %d: missing id", prefix, i))
+		} else if ids[plan.ID] {
+			invalid = append(invalid, fmt.Sprintf("%splan %d: duplicated id %s", prefix, i, plan.ID))
+		}
+		if plan.Name == "" {
+			invalid = append(invalid, fmt.Sprintf("%splan %d: missing name", prefix, i))
+		} else if names[plan.Name] {
+			invalid = append(invalid, fmt.Sprintf("%splan %d: duplicated name %s", prefix, i, plan.Name))
+		}
+		if plan.Description == "" {
+			invalid = append(invalid, fmt.Sprintf("%splan %d: missing description", prefix, i))
+		}
+		if err := plan.Parameters.Validate(); err != nil {
+			invalid = append(invalid, fmt.Sprintf("%splan %d: %v", prefix, i, err))
+		}
+		ids[plan.ID] = true
+		names[plan.Name] = true
+	}
+	return invalid
+}
+
+// LoadTemplates loads the templates of the services which have their own.
+func (c *Catalog) LoadTemplates(client *resty.Client) error {
+	for i := range c.Services {
+		if err := c.Services[i].LoadTemplate(client); err != nil {
+			return fmt.Errorf("Error in loading the template of service %s: %v", c.Services[i].Name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package broker_test
+
+import (
+	"io/ioutil"
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/zeqing-guo/AzureBlockchainBroker/broker"
+)
+
+var _ = Describe("Catalog", func() {
+	var (
+		catalogFile *os.File
+		content     string
+		catalog     *Catalog
+		err         error
+	)
+
+	BeforeEach(func() {
+		catalogFile, err = ioutil.TempFile("", "catalog")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	JustBeforeEach(func() {
+		_, err = catalogFile.WriteString(content)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(catalogFile.Close()).To(Succeed())
+		catalog, err = LoadCatalog(catalogFile.Name())
+	})
+
+	AfterEach(func() {
+		os.Remove(catalogFile.Name())
+	})
+
+	Context("Given a valid catalog", func() {
+		BeforeEach(func() {
+			content = `{
+				"plans": [
+					{"id": "dev-id", "name": "dev", "description": "dev", "parameters": {"numTXNodes": 1, "txNodeVMSize": "Standard_A1"}},
+					{"id": "prod-id", "name": "production", "description": "production", "parameters": {"numConsortiumMembers": 4}}
+				]
+			}`
+		})
+
+		It("should load all plans", func() {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(catalog.Plans).To(HaveLen(2))
+		})
+
+		It("should load the parameters of every plan", func() {
+			plan := catalog.Plans[1]
+			Expect(plan.Name).To(Equal("production"))
+			Expect(*plan.Parameters.NumConsortiumMembers).To(Equal(uint64(4)))
+			Expect(plan.Parameters.NumTXNodes).To(BeNil())
+		})
+	})
+
+	Context("Given services", func() {
+		BeforeEach(func() {
+			content = `{
+				"services": [
+					{
+						"id": "consortium-id", "name": "ethereum", "description": "Ethereum consortium", "networkType": "ethereum-consortium",
+						"plans": [{"id": "dev-id", "name": "dev", "description": "dev", "parameters": {"numTXNodes": 1}}]
+					},
+					{
+						"id": "fabric-id", "name": "fabric", "description": "Hyperledger Fabric", "networkType": "hyperledger-fabric",
+						"templatePath": "testdata/fabric_template.json", "outputs": {"adminSite": "api-endpoint"},
+						"plans": [{"id": "fabric-dev-id", "name": "dev", "description": "dev", "parameters": {"template": {"numPeerNodes": 1}}}]
+					}
+				]
+			}`
+		})
+
+		It("should load the services and find their plans", func() {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(catalog.Services).To(HaveLen(2))
+			plan, ok := catalog.Services[1].FindPlan("fabric-dev-id")
+			Expect(ok).To(BeTrue())
+			Expect(plan.Parameters.Template).To(HaveKeyWithValue("numPeerNodes", 1.0))
+		})
+	})
+
+	Context("Given invalid services", func() {
+		BeforeEach(func() {
+			content = `{
+				"services": [
+					{
+						"id": "quorum-id", "name": "quorum", "description": "Quorum", "networkType": "quorum",
+						"plans": [{"id": "dev-id", "name": "dev", "description": "dev"}]
+					},
+					{
+						"id": "fabric-id", "name": "fabric", "description": "Hyperledger Fabric", "networkType": "hyperledger-fabric",
+						"templatePath": "testdata/fabric_template.json",
+						"plans": [{"id": "dev-id", "name": "dev", "description": "dev", "parameters": {"numTXNodes": 1}}]
+					},
+					{
+						"id": "corda-id", "name": "corda", "description": "Corda", "networkType": "corda",
+						"plans": [{"id": "corda-dev-id", "name": "dev", "description": "dev"}]
+					}
+				]
+			}`
+		})
+
+		It("should report every invalid service", func() {
+			Expect(err).To(MatchError("Invalid catalog: " +
+				"service 0: Unsupported networkType: quorum, " +
+				"service 1: plan 0: duplicated id dev-id, " +
+				"service 1: plan 0: Invalid parameters: numTXNodes only apply to ethereum-consortium services, the parameters of the template are given in template, " +
+				"service 2: Unsupported networkType: corda"))
+		})
+	})
+
+	Context("Given no plans", func() {
+		BeforeEach(func() {
+			content = `{"plans": []}`
+		})
+
+		It("should raise an error", func() {
+			Expect(err).To(MatchError("Catalog should contain at least one plan"))
+		})
+	})
+
+	Context("Given duplicated plans", func() {
+		BeforeEach(func() {
+			content = `{
+				"plans": [
+					{"id": "dev-id", "name": "dev", "description": "dev"},
+					{"id": "dev-id", "name": "dev", "description": "dev"}
+				]
+			}`
+		})
+
+		It("should raise an error", func() {
+			Expect(err).To(MatchError("Invalid catalog: plan 1: duplicated id dev-id, plan 1: duplicated name dev"))
+		})
+	})
+
+	Context("Given invalid plan parameters", func() {
+		BeforeEach(func() {
+			content = `{"plans": [{"id": "dev-id", "name": "dev", "description": "dev", "parameters": {"location": " "}}]}`
+		})
+
+		It("should raise an error", func() {
+			Expect(err).To(MatchError("Invalid catalog: plan 0: Invalid parameters: location should not be empty"))
+		})
+	})
+
+	Context("Given malformed JSON", func() {
+		BeforeEach(func() {
+			content = `{"plans": [`
+		})
+
+		It("should raise an error", func() {
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
+
+var _ = Describe("DefaultCatalog", func() {
+	It("should offer a single valid plan", func() {
+		catalog := DefaultCatalog()
+		Expect(catalog.Validate()).To(Succeed())
+		Expect(catalog.Plans).To(HaveLen(1))
+		Expect(catalog.Plans[0].ID).To(Equal("7c0b2254-7e68-11e7-bbe1-000d3a818256"))
+	})
+})
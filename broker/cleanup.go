@@ -0,0 +1,101 @@
+package broker
+
+import (
+	"fmt"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+)
+
+// CleanUp deletes the resource groups of the failed provisions whose grace
+// period is over, and follows their deletion. It is run periodically.
+func (b *ServiceBroker) CleanUp() {
+	logger := b.logger.Session("clean-up")
+	logger.Info("start")
+	defer logger.Info("end")
+
+	instances, err := b.store.ListInstances()
+	if err != nil {
+		logger.Error("list-instances", err)
+		return
+	}
+	for _, instance := range instances {
+		if instance.State == StateFailed && instance.Cleanup != nil && !instance.Cleanup.Done {
+			b.cleanUpInstance(logger, instance.InstanceID)
+		}
+	}
+}
+
+func (b *ServiceBroker) cleanUpInstance(logger lager.Logger, instanceID string) {
+	logger = logger.WithData(lager.Data{"instanceID": instanceID})
+	unlock := b.locks.Lock(instanceID)
+	defer unlock()
+
+	// the instance may have changed since it was listed
+	instance, err := b.store.GetInstance(instanceID)
+	if err != nil {
+		if err != ErrRecordNotFound {
+			logger.Error("get-instance", err)
+		}
+		return
+	}
+	if instance.State != StateFailed || instance.Cleanup == nil {
+		return
+	}
+	if _, err := b.cleanUp(logger, &instance, false); err != nil {
+		logger.Error("clean-up-instance", err)
+	}
+}
+
+// cleanUp advances the deletion of the resource group of a failed provision,
+// which starts once the grace period is over, or right away if now is set.
+// It records the progress with the instance, and tells whether the group is
+// gone. The caller must hold the lock of the instance.
+func (b *ServiceBroker) cleanUp(logger lager.Logger, instance *InstanceRecord, now bool) (bool, error) {
+	cleanup := instance.Cleanup
+	if cleanup.Done {
+		return true, nil
+	}
+	client := b.client.azureRESTClient
+	scope := b.client.Scope(*instance)
+	if cleanup.Operation == nil {
+		if !now && time.Now().Before(cleanup.After) {
+			return false, nil
+		}
+		logger.Info("delete-group", lager.Data{"resourceGroupName": scope.ResourceGroupName})
+		// the group may be gone already, e.g. deleted by hand
+		exist, err := client.GroupExist(scope)
+		if err != nil {
+			return false, err
+		}
+		operation := Operation{}
+		if exist {
+			operation, _, err = client.DeleteGroup(scope)
+			if err != nil {
+				return false, err
+			}
+		}
+		cleanup.Operation = &operation
+		b.putInstance(logger, *instance)
+	}
+
+	status, err := b.deletionStatus(scope, *cleanup.Operation)
+	if err != nil {
+		return false, err
+	}
+	switch status.State {
+	case OperationSucceeded:
+		cleanup.Done = true
+		b.putInstance(logger, *instance)
+		return true, nil
+	case OperationFailed, OperationCanceled:
+		// the deletion is started again at the next clean up
+		cleanup.Operation = nil
+		b.putInstance(logger, *instance)
+		if status.Error != nil {
+			return false, fmt.Errorf("Failed to delete resource group %s: %v", scope.ResourceGroupName, status.Error)
+		}
+		return false, fmt.Errorf("Failed to delete resource group %s", scope.ResourceGroupName)
+	}
+	return false, nil
+}
@@ -2,7 +2,10 @@ package broker
 
 import (
 	"errors"
+	"fmt"
+	"math/big"
 	"strings"
+	"time"
 )
 
 type BlockchainConfig struct {
@@ -48,19 +51,148 @@ func NewBlockchainConfig(
 	return blockchainConfig
 }
 
+// BindingConfig is how the broker sets up the account of a binding.
+type BindingConfig struct {
+	// FundAmount is the wei sent to every new account, nil or 0 for none
+	FundAmount *big.Int
+}
+
+func NewBindingConfig(fundAmount *big.Int) *BindingConfig {
+	bindingConfig := new(BindingConfig)
+
+	bindingConfig.FundAmount = fundAmount
+	return bindingConfig
+}
+
+// CleanupConfig is how the broker cleans up after a failed provision. The
+// resource group it created for the instance is deleted once the grace
+// period is over, which leaves the failed resources for debugging until
+// then.
+type CleanupConfig struct {
+	Enabled     bool
+	GracePeriod time.Duration
+}
+
+func NewCleanupConfig(enabled bool, gracePeriod time.Duration) *CleanupConfig {
+	cleanupConfig := new(CleanupConfig)
+
+	cleanupConfig.Enabled = enabled
+	cleanupConfig.GracePeriod = gracePeriod
+	return cleanupConfig
+}
+
+func (config *CleanupConfig) Validate() error {
+	if config.GracePeriod < 0 {
+		return errors.New("cleanupGracePeriod should not be negative")
+	}
+	return nil
+}
+
+// ResourceGroupConfig is how the broker names the resource group of an
+// instance. NameFormat is made of text and the placeholders {prefix}, {id},
+// {shortid}, {org} and {space}; see ResourceGroupName. An empty NameFormat
+// is the instance ID.
+type ResourceGroupConfig struct {
+	Prefix     string
+	NameFormat string
+}
+
+func NewResourceGroupConfig(prefix, nameFormat string) *ResourceGroupConfig {
+	resourceGroupConfig := new(ResourceGroupConfig)
+
+	resourceGroupConfig.Prefix = prefix
+	resourceGroupConfig.NameFormat = nameFormat
+	return resourceGroupConfig
+}
+
+func (config *ResourceGroupConfig) Validate() error {
+	if config.NameFormat == "" {
+		return nil
+	}
+	if !strings.Contains(config.NameFormat, "{id}") && !strings.Contains(config.NameFormat, "{shortid}") {
+		return errors.New("resourceGroupNameFormat should contain {id} or {shortid}")
+	}
+	// the longest name is the one of an instance with every GUID
+	guid := "00000000-0000-0000-0000-000000000000"
+	if name := config.ResourceGroupName(guid, guid, guid); !validResourceGroupName(name) {
+		return fmt.Errorf("Invalid resource group name %s: it should be at most 90 letters, digits, '-', '_', '.', '(' or ')', and not end with '.'", name)
+	}
+	return nil
+}
+
 type CloudConfig struct {
 	Azure      AzureConfig
 	AzureStack AzureStackConfig
+	Endpoints  EndpointConfig
+	Credential CredentialConfig
+	HTTP       HTTPConfig
 }
 
-func NewCloudConfig(azureConfig AzureConfig, azureStack AzureStackConfig) *CloudConfig {
+func NewCloudConfig(azureConfig AzureConfig, azureStack AzureStackConfig, endpoints EndpointConfig, credential CredentialConfig, httpConfig HTTPConfig) *CloudConfig {
 	cloudConfig := new(CloudConfig)
 
 	cloudConfig.AzureStack = azureStack
 	cloudConfig.Azure = azureConfig
+	cloudConfig.Endpoints = endpoints
+	cloudConfig.Credential = credential
+	cloudConfig.HTTP = httpConfig
 	return cloudConfig
 }
 
+// CredentialConfig is how the service principal authenticates. An empty
+// authentication is clientSecret.
+type CredentialConfig struct {
+	Authentication      string
+	CertificatePath     string
+	CertificatePassword string
+	// TokenRefreshSkew is how long before its expiry a token is refreshed
+	TokenRefreshSkew time.Duration
+}
+
+func NewCredentialConfig(authentication, certificatePath, certificatePassword string, tokenRefreshSkew time.Duration) *CredentialConfig {
+	myConf := new(CredentialConfig)
+
+	myConf.Authentication = authentication
+	myConf.CertificatePath = certificatePath
+	myConf.CertificatePassword = certificatePassword
+	myConf.TokenRefreshSkew = tokenRefreshSkew
+
+	return myConf
+}
+
+func (config *CredentialConfig) Validate() error {
+	if config.TokenRefreshSkew < 0 {
+		return errors.New("tokenRefreshSkew should not be negative")
+	}
+	switch config.Authentication {
+	case "", AuthenticationClientSecret, AuthenticationManagedIdentity:
+	case AuthenticationCertificate:
+		if config.CertificatePath == "" {
+			return errors.New("Missing required parameters when 'authentication' is 'certificate': certificatePath")
+		}
+	default:
+		return errors.New("Unsupported authentication: " + config.Authentication)
+	}
+	return nil
+}
+
+// EndpointConfig overrides the endpoints of the environment, e.g. for a
+// sovereign cloud, an Azure Stack or a local fake. Empty endpoints are not
+// overridden.
+type EndpointConfig struct {
+	ResourceManagerEndpointURL string
+	ActiveDirectoryEndpointURL string
+}
+
+func NewEndpointConfig(resourceManagerEndpointURL, activeDirectoryEndpointURL string) *EndpointConfig {
+	myConf := new(EndpointConfig)
+
+	myConf.ResourceManagerEndpointURL = resourceManagerEndpointURL
+	myConf.ActiveDirectoryEndpointURL = activeDirectoryEndpointURL
+
+	return myConf
+}
+
 type ResourceConfig struct {
 	SubscriptionID    string `json:"subscription_id"`
 	ResourceGroupName string `json:"resource_group_name"`
@@ -69,9 +201,12 @@ type ResourceConfig struct {
 	CustomDomainName  string `json:"custom_domain_name"`
 	UseSubDomain      bool   `json:"use_sub_domain"`    // bool
 	EnableEncryption  bool   `json:"enable_encryption"` // bool
+	// WhatIf asks ARM for the changes of every new deployment before it is
+	// deployed, besides validating it
+	WhatIf bool `json:"what_if"`
 }
 
-func NewResourceConfig(subscriptionID string, resourceGroupName string, useHTTPS bool, location string, customDomainName string, useSubDomain bool, enableEncryption bool) *ResourceConfig {
+func NewResourceConfig(subscriptionID string, resourceGroupName string, useHTTPS bool, location string, customDomainName string, useSubDomain bool, enableEncryption bool, whatIf bool) *ResourceConfig {
 	config := new(ResourceConfig)
 
 	config.SubscriptionID = subscriptionID
@@ -81,6 +216,7 @@ func NewResourceConfig(subscriptionID string, resourceGroupName string, useHTTPS
 	config.CustomDomainName = customDomainName
 	config.UseSubDomain = useSubDomain
 	config.EnableEncryption = enableEncryption
+	config.WhatIf = whatIf
 
 	return config
 }
@@ -142,6 +278,13 @@ func (config *AzureConfig) Validate() error {
 	return nil
 }
 
+// The authentications of an Azure Stack
+const (
+	AzureStackAzureAD      = "AzureAD"
+	AzureStackAzureStackAD = "AzureStackAD"
+	AzureStackADFS         = "ADFS"
+)
+
 type AzureStackConfig struct {
 	AzureStackDomain         string
 	AzureStackAuthentication string
@@ -178,6 +321,11 @@ func (config *AzureStackConfig) Validate() error {
 	if len(missingKeys) > 0 {
 		return errors.New("Missing required parameters when 'environment' is 'AzureStack': " + strings.Join(missingKeys, ", "))
 	}
+	switch config.AzureStackAuthentication {
+	case AzureStackAzureAD, AzureStackAzureStackAD, AzureStackADFS:
+	default:
+		return errors.New("Unsupported azureStackAuthentication: " + config.AzureStackAuthentication)
+	}
 	return nil
 }
 
@@ -29,7 +29,7 @@ var _ = Describe("AzureConfig", func() {
 
 		It("should raise an error", func() {
 			err := azureConfig.Validate()
-			Expect(err).ToNot(MatchError("Missing required parameters: environment"))
+			Expect(err).To(MatchError("Missing required parameters: environment"))
 		})
 	})
 
@@ -40,7 +40,7 @@ var _ = Describe("AzureConfig", func() {
 
 		It("should raise an error", func() {
 			err := azureConfig.Validate()
-			Expect(err).ToNot(MatchError("Missing required parameters: environment"))
+			Expect(err).To(MatchError("Missing required parameters: environment"))
 		})
 	})
 
@@ -62,7 +62,7 @@ var _ = Describe("AzureConfig", func() {
 
 		It("should raise an error", func() {
 			err := azureConfig.Validate()
-			Expect(err).ToNot(MatchError("Missing required parameters: clientID"))
+			Expect(err).To(MatchError("Missing required parameters: clientID"))
 		})
 	})
 
@@ -73,13 +73,19 @@ var _ = Describe("AzureConfig", func() {
 
 		It("should raise an error", func() {
 			err := azureConfig.Validate()
-			Expect(err).ToNot(MatchError("Missing required parameters: clientSecret"))
+			Expect(err).To(MatchError("Missing required parameters: clientSecret"))
 		})
 	})
 
 	Context("Missing all required params", func() {
-		err := azureConfig.Validate()
-		Expect(err).ToNot(MatchError("Missing required parameters: environment, tenantID, clientID, clientSecret"))
+		BeforeEach(func() {
+			azureConfig = NewAzureConfig("", "", "", "")
+		})
+
+		It("should raise an error", func() {
+			err := azureConfig.Validate()
+			Expect(err).ToNot(MatchError("Missing required parameters: environment, tenantID, clientID, clientSecret"))
+		})
 	})
 })
 
@@ -90,7 +96,7 @@ var _ = Describe("AzureStackConfig", func() {
 
 	Context("Given all required params", func() {
 		BeforeEach(func() {
-			azureStackConfig = NewAzureStackConfig("azureStackDomain", "azureStackAuthentication", "azureStackResource", "azureStackEndpointPrefix")
+			azureStackConfig = NewAzureStackConfig("azureStackDomain", "ADFS", "azureStackResource", "azureStackEndpointPrefix")
 		})
 
 		It("should not raise an error", func() {
@@ -99,6 +105,17 @@ var _ = Describe("AzureStackConfig", func() {
 		})
 	})
 
+	Context("Unsupported azureStackAuthentication", func() {
+		BeforeEach(func() {
+			azureStackConfig = NewAzureStackConfig("azureStackDomain", "azureStackAuthentication", "azureStackResource", "azureStackEndpointPrefix")
+		})
+
+		It("should raise an error", func() {
+			err := azureStackConfig.Validate()
+			Expect(err).To(MatchError("Unsupported azureStackAuthentication: azureStackAuthentication"))
+		})
+	})
+
 	Context("Missing azureStackDomain", func() {
 		BeforeEach(func() {
 			azureStackConfig = NewAzureStackConfig("", "azureStackAuthentication", "azureStackResource", "azureStackEndpointPrefix")
@@ -162,7 +179,7 @@ var _ = Describe("ResourceConfig", func() {
 
 	Context("Given all params", func() {
 		BeforeEach(func() {
-			resourceConfig = NewResourceConfig("subscriptionID", "resourceGroupName", false, "location", "", false, false)
+			resourceConfig = NewResourceConfig("subscriptionID", "resourceGroupName", false, "location", "", false, false, false)
 		})
 
 		It("should not raise an error", func() {
@@ -173,7 +190,7 @@ var _ = Describe("ResourceConfig", func() {
 
 	Context("Missing subscriptionID", func() {
 		BeforeEach(func() {
-			resourceConfig = NewResourceConfig("", "resourceGroupName", false, "location", "", false, false)
+			resourceConfig = NewResourceConfig("", "resourceGroupName", false, "location", "", false, false, false)
 		})
 
 		It("should raise an error", func() {
@@ -184,7 +201,7 @@ var _ = Describe("ResourceConfig", func() {
 
 	Context("Missing resourceGroupName", func() {
 		BeforeEach(func() {
-			resourceConfig = NewResourceConfig("subscriptionID", "", false, "location", "", false, false)
+			resourceConfig = NewResourceConfig("subscriptionID", "", false, "location", "", false, false, false)
 		})
 
 		It("should raise an error", func() {
@@ -195,7 +212,7 @@ var _ = Describe("ResourceConfig", func() {
 
 	Context("Missing location", func() {
 		BeforeEach(func() {
-			resourceConfig = NewResourceConfig("location", "resourceGroupName", false, "location", "", false, false)
+			resourceConfig = NewResourceConfig("subscriptionID", "resourceGroupName", false, "", "", false, false, false)
 		})
 
 		It("should raise an error", func() {
@@ -206,7 +223,7 @@ var _ = Describe("ResourceConfig", func() {
 
 	Context("Missing all required params", func() {
 		BeforeEach(func() {
-			resourceConfig = NewResourceConfig("", "", false, "", "", false, false)
+			resourceConfig = NewResourceConfig("", "", false, "", "", false, false, false)
 		})
 
 		It("should raise an error", func() {
@@ -215,3 +232,27 @@ var _ = Describe("ResourceConfig", func() {
 		})
 	})
 })
+
+var _ = Describe("ResourceGroupConfig", func() {
+	It("should name the resource group after the instance ID by default", func() {
+		config := NewResourceGroupConfig("blockchain", "")
+		Expect(config.Validate()).To(Succeed())
+		Expect(config.ResourceGroupName("8f2c1c9e-8a51-4b0e-9f5b-7f0a1e0b6a3d", "org-guid", "space-guid")).To(Equal("8f2c1c9e-8a51-4b0e-9f5b-7f0a1e0b6a3d"))
+	})
+
+	It("should fill the placeholders of the format", func() {
+		config := NewResourceGroupConfig("blockchain", "{prefix}-{org}-{space}-{shortid}")
+		Expect(config.Validate()).To(Succeed())
+		Expect(config.ResourceGroupName("8f2c1c9e-8a51-4b0e-9f5b-7f0a1e0b6a3d", "5d1a9c3e-1111-2222-3333-444444444444", "b7e2f0a4-5555-6666-7777-888888888888")).To(Equal("blockchain-5d1a9c3e-b7e2f0a4-8f2c1c9e"))
+		Expect(config.ResourceGroupName("8f2c1c9e-8a51-4b0e-9f5b-7f0a1e0b6a3d", "", "")).To(Equal("blockchain-8f2c1c9e"))
+	})
+
+	It("should require the instance ID in the format", func() {
+		Expect(NewResourceGroupConfig("blockchain", "{prefix}-{org}-{space}").Validate()).To(MatchError("resourceGroupNameFormat should contain {id} or {shortid}"))
+	})
+
+	It("should refuse formats which make invalid names", func() {
+		Expect(NewResourceGroupConfig("block chain", "{prefix}-{shortid}").Validate()).To(MatchError(ContainSubstring("Invalid resource group name block chain-00000000")))
+		Expect(NewResourceGroupConfig("blockchain", "{prefix}-{id}-{id}-{id}").Validate()).To(HaveOccurred())
+	})
+})
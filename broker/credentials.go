@@ -0,0 +1,78 @@
+package broker
+
+import (
+	"bytes"
+	"unicode"
+)
+
+// The keys of the binding credentials which are always present. The outputs
+// of the deployment are added with their names in snake case, unless they
+// clash with one of these keys.
+const (
+	CredentialRPCURL            = "rpc_url"
+	CredentialAdminSiteURL      = "admin_site_url"
+	CredentialNetworkID         = "network_id"
+	CredentialChainID           = "chain_id"
+	CredentialConsortiumMembers = "consortium_members"
+	CredentialResourceGroup     = "resource_group"
+	CredentialLocation          = "location"
+	CredentialAddress           = "address"
+	CredentialPrivateKey        = "private_key"
+	CredentialKeystore          = "keystore"
+	CredentialKeystorePassword  = "keystore_password"
+)
+
+// Credentials is the JSON object handed to the application in VCAP_SERVICES.
+type Credentials map[string]interface{}
+
+// NewCredentials builds the credentials of a binding to the instance of the
+// service, whose outputs have been learnt from Azure and whose network is
+// configured by the blockchain configuration. The network of an
+// ethereum-consortium service is described by the blockchain configuration,
+// and the account is nil unless the network is an Ethereum one.
+func NewCredentials(instance InstanceRecord, service *Service, blockchainConfig BlockchainConfig, account *EthereumAccount) Credentials {
+	credentials := Credentials{}
+	for name, value := range instance.Outputs {
+		credentials[snakeCase(name)] = value
+	}
+
+	adminSiteURL, rpcURL := service.Endpoints(instance.Outputs)
+	credentials[CredentialRPCURL] = rpcURL
+	credentials[CredentialAdminSiteURL] = adminSiteURL
+	if service.NetworkType == NetworkEthereumConsortium {
+		credentials[CredentialNetworkID] = blockchainConfig.ethereumNetworkID
+		credentials[CredentialChainID] = blockchainConfig.ethereumNetworkID
+		credentials[CredentialConsortiumMembers] = blockchainConfig.numConsortiumMembers
+	}
+	credentials[CredentialResourceGroup] = instance.ResourceGroupName
+	credentials[CredentialLocation] = instance.Location
+	if account != nil {
+		credentials[CredentialAddress] = account.Address
+		credentials[CredentialPrivateKey] = account.PrivateKey
+		credentials[CredentialKeystore] = account.Keystore
+		credentials[CredentialKeystorePassword] = account.Password
+	}
+	return credentials
+}
+
+// snakeCase converts the name of an output, e.g. ethereum-rpc-endpoint or
+// sshToFirstTxNode, to snake case.
+func snakeCase(name string) string {
+	var b bytes.Buffer
+	runes := []rune(name)
+	for i, r := range runes {
+		switch {
+		case r == '-' || r == ' ' || r == '.':
+			b.WriteRune('_')
+		case unicode.IsUpper(r):
+			if i > 0 && (unicode.IsLower(runes[i-1]) || unicode.IsDigit(runes[i-1]) ||
+				(i+1 < len(runes) && unicode.IsLower(runes[i+1]) && unicode.IsUpper(runes[i-1]))) {
+				b.WriteRune('_')
+			}
+			b.WriteRune(unicode.ToLower(r))
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
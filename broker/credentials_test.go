@@ -0,0 +1,79 @@
+package broker_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/zeqing-guo/AzureBlockchainBroker/broker"
+)
+
+var _ = Describe("Credentials", func() {
+	var (
+		instance         InstanceRecord
+		service          *Service
+		blockchainConfig BlockchainConfig
+		account          *EthereumAccount
+	)
+
+	BeforeEach(func() {
+		instance = InstanceRecord{
+			InstanceID:        "instance-id",
+			ResourceGroupName: "resource-group-name",
+			Location:          "westus",
+			Outputs: map[string]interface{}{
+				"admin-site":            "http://admin",
+				"ethereum-rpc-endpoint": "http://rpc:8545",
+				"sshToFirstTXNode":      "ssh -p 3000 gethadmin@host",
+				"location":              "eastus",
+			},
+		}
+		service = &Service{NetworkType: NetworkEthereumConsortium}
+		blockchainConfig = *NewBlockchainConfig("prefix", "gethadmin", "password", "psswd", "passphrase", 553289, 3, 1, "Standard_D1_v2", 1, "Standard_D1_v2")
+		account = &EthereumAccount{
+			Address:    "0xaddress",
+			PrivateKey: "0xkey",
+			Keystore:   []byte(`{"version": 3}`),
+			Password:   "password",
+		}
+	})
+
+	It("should contain the documented keys", func() {
+		credentials := NewCredentials(instance, service, blockchainConfig, account)
+		Expect(credentials).To(HaveKeyWithValue("rpc_url", "http://rpc:8545"))
+		Expect(credentials).To(HaveKeyWithValue("admin_site_url", "http://admin"))
+		Expect(credentials).To(HaveKeyWithValue("network_id", uint64(553289)))
+		Expect(credentials).To(HaveKeyWithValue("chain_id", uint64(553289)))
+		Expect(credentials).To(HaveKeyWithValue("consortium_members", uint64(3)))
+		Expect(credentials).To(HaveKeyWithValue("resource_group", "resource-group-name"))
+		Expect(credentials).To(HaveKeyWithValue("address", "0xaddress"))
+		Expect(credentials).To(HaveKeyWithValue("private_key", "0xkey"))
+		Expect(credentials).To(HaveKeyWithValue("keystore_password", "password"))
+		Expect(credentials).To(HaveKey("keystore"))
+	})
+
+	It("should contain the other outputs in snake case", func() {
+		credentials := NewCredentials(instance, service, blockchainConfig, account)
+		Expect(credentials).To(HaveKeyWithValue("admin_site", "http://admin"))
+		Expect(credentials).To(HaveKeyWithValue("ethereum_rpc_endpoint", "http://rpc:8545"))
+		Expect(credentials).To(HaveKeyWithValue("ssh_to_first_tx_node", "ssh -p 3000 gethadmin@host"))
+	})
+
+	It("should not let the outputs replace the documented keys", func() {
+		credentials := NewCredentials(instance, service, blockchainConfig, account)
+		Expect(credentials).To(HaveKeyWithValue("location", "westus"))
+	})
+
+	Context("for a network other than ethereum-consortium", func() {
+		BeforeEach(func() {
+			service = &Service{NetworkType: NetworkHyperledgerFabric, Outputs: OutputNames{AdminSite: "admin-site"}}
+		})
+
+		It("should only contain the outputs of the deployment", func() {
+			credentials := NewCredentials(instance, service, blockchainConfig, nil)
+			Expect(credentials).To(HaveKeyWithValue("admin_site_url", "http://admin"))
+			Expect(credentials).To(HaveKeyWithValue("rpc_url", ""))
+			Expect(credentials).To(HaveKeyWithValue("resource_group", "resource-group-name"))
+			Expect(credentials).NotTo(HaveKey("network_id"))
+			Expect(credentials).NotTo(HaveKey("address"))
+		})
+	})
+})
@@ -0,0 +1,132 @@
+package broker
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+)
+
+// the CF CLI prints the whole description, so keep it to a few lines
+const maxDescriptionLength = 800
+
+// DeploymentOperation is the operation of a deployment on one resource.
+type DeploymentOperation struct {
+	OperationID string `json:"operationId"`
+	Properties  struct {
+		ProvisioningState string          `json:"provisioningState"`
+		StatusCode        string          `json:"statusCode"`
+		StatusMessage     json.RawMessage `json:"statusMessage"`
+		TargetResource    *struct {
+			ID           string `json:"id"`
+			ResourceType string `json:"resourceType"`
+			ResourceName string `json:"resourceName"`
+		} `json:"targetResource"`
+	} `json:"properties"`
+}
+
+// Error returns the error of the operation, which ARM puts in the status
+// message either as an error envelope or as plain text.
+func (o DeploymentOperation) Error() *OperationError {
+	envelope := ErrorResponse{}
+	if err := json.Unmarshal(o.Properties.StatusMessage, &envelope); err == nil && envelope.Error != nil {
+		return envelope.Error
+	}
+	message := ""
+	if err := json.Unmarshal(o.Properties.StatusMessage, &message); err != nil {
+		message = string(o.Properties.StatusMessage)
+	}
+	return &OperationError{Code: o.Properties.StatusCode, Message: message}
+}
+
+func (c *AzureRESTClient) GetDeploymentOperations(scope Scope) ([]DeploymentOperation, error) {
+	queries := map[string]string{
+		"api-version": c.environment.APIVersions.Template,
+	}
+	hostURL := fmt.Sprintf("%s/subscriptions/%s/resourceGroups/%s/providers/%s/%s/%s/operations",
+		c.environment.ResourceManagerEndpointURL,
+		scope.SubscriptionID,
+		scope.ResourceGroupName,
+		restAPIProvider,
+		restAPIDeployments,
+		scope.DeploymentName,
+	)
+
+	operations := []DeploymentOperation{}
+	for hostURL != "" {
+		resp, err := c.send(http.MethodGet, hostURL, queries, nil)
+		if err != nil {
+			return nil, err
+		}
+		statusCode := resp.StatusCode()
+		if statusCode != http.StatusOK {
+			return nil, armError(statusCode, resp.Body())
+		}
+		apiResponse := struct {
+			Value    []DeploymentOperation `json:"value"`
+			NextLink string                `json:"nextLink"`
+		}{}
+		if err := json.Unmarshal(resp.Body(), &apiResponse); err != nil {
+			return nil, fmt.Errorf("StatusCode: %d - %v\n\t%s", statusCode, resp, err)
+		}
+		operations = append(operations, apiResponse.Value...)
+		// the next link carries its own api-version
+		hostURL, queries = apiResponse.NextLink, nil
+	}
+	return operations, nil
+}
+
+// DeploymentFailure describes why the deployment failed by its error and
+// the errors of its failed operations.
+func (c *AzureRESTClient) DeploymentFailure(scope Scope) (string, error) {
+	properties, err := c.GetDeploymentProperties(scope)
+	if err != nil {
+		return "", err
+	}
+	operations, err := c.GetDeploymentOperations(scope)
+	if err != nil {
+		return "", err
+	}
+	return SummarizeDeploymentFailure(properties.Error, operations), nil
+}
+
+// SummarizeDeploymentFailure names every failed resource with its error code
+// and message, after the error of the deployment itself.
+func SummarizeDeploymentFailure(deploymentError *OperationError, operations []DeploymentOperation) string {
+	failures := []string{}
+	for _, operation := range operations {
+		if !strings.EqualFold(operation.Properties.ProvisioningState, "failed") {
+			continue
+		}
+		failure := operation.Error().Error()
+		if resource := operation.Properties.TargetResource; resource != nil {
+			failure = fmt.Sprintf("%s '%s': %s", resource.ResourceType, resource.ResourceName, failure)
+		}
+		failures = append(failures, failure)
+	}
+
+	summary := []string{}
+	if deploymentError != nil {
+		if len(failures) > 0 {
+			// the details repeat the errors of the failed operations
+			summary = append(summary, (&OperationError{Code: deploymentError.Code, Message: deploymentError.Message}).Error())
+		} else {
+			summary = append(summary, deploymentError.Error())
+		}
+	}
+	summary = append(summary, failures...)
+	return truncateDescription(strings.Join(summary, "; "))
+}
+
+func truncateDescription(description string) string {
+	if len(description) <= maxDescriptionLength {
+		return description
+	}
+	truncated := description[:maxDescriptionLength-3]
+	// do not cut a character in half
+	for !utf8.ValidString(truncated) {
+		truncated = truncated[:len(truncated)-1]
+	}
+	return truncated + "..."
+}
@@ -0,0 +1,72 @@
+package broker_test
+
+import (
+	"encoding/json"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/zeqing-guo/AzureBlockchainBroker/broker"
+)
+
+var _ = Describe("SummarizeDeploymentFailure", func() {
+	var (
+		deploymentError *OperationError
+		operations      []DeploymentOperation
+	)
+
+	BeforeEach(func() {
+		deploymentError = &OperationError{
+			Code:    "DeploymentFailed",
+			Message: "At least one resource deployment operation failed.",
+			Details: []OperationError{{Code: "Conflict", Message: "The operation failed."}},
+		}
+		Expect(json.Unmarshal([]byte(`[
+			{
+				"operationId": "1",
+				"properties": {
+					"provisioningState": "Succeeded",
+					"statusCode": "OK",
+					"targetResource": {"resourceType": "Microsoft.Network/virtualNetworks", "resourceName": "vnet"}
+				}
+			},
+			{
+				"operationId": "2",
+				"properties": {
+					"provisioningState": "Failed",
+					"statusCode": "Conflict",
+					"statusMessage": {"error": {"code": "SkuNotAvailable", "message": "The requested size is not available."}},
+					"targetResource": {"resourceType": "Microsoft.Compute/virtualMachines", "resourceName": "tx0"}
+				}
+			},
+			{
+				"operationId": "3",
+				"properties": {
+					"provisioningState": "Failed",
+					"statusCode": "BadRequest",
+					"statusMessage": "Quota exceeded.",
+					"targetResource": {"resourceType": "Microsoft.Compute/virtualMachines", "resourceName": "mn0"}
+				}
+			}
+		]`), &operations)).To(Succeed())
+	})
+
+	It("should name the failed resources with their errors", func() {
+		Expect(SummarizeDeploymentFailure(deploymentError, operations)).To(Equal(
+			"DeploymentFailed: At least one resource deployment operation failed.; " +
+				"Microsoft.Compute/virtualMachines 'tx0': SkuNotAvailable: The requested size is not available.; " +
+				"Microsoft.Compute/virtualMachines 'mn0': BadRequest: Quota exceeded."))
+	})
+
+	It("should use the details of the deployment error without failed operations", func() {
+		Expect(SummarizeDeploymentFailure(deploymentError, nil)).To(Equal(
+			"DeploymentFailed: At least one resource deployment operation failed.; Conflict: The operation failed."))
+	})
+
+	It("should truncate a long summary", func() {
+		deploymentError.Message = strings.Repeat("x", 2000)
+		summary := SummarizeDeploymentFailure(deploymentError, nil)
+		Expect(len(summary)).To(BeNumerically("<=", 800))
+		Expect(summary).To(HaveSuffix("..."))
+	})
+})
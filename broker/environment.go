@@ -0,0 +1,111 @@
+package broker
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	resty "gopkg.in/resty.v0"
+)
+
+const metadataAPIVersion = "2015-01-01"
+
+// EndpointsMetadata is the document which the resource manager of an Azure
+// Stack serves at /metadata/endpoints.
+type EndpointsMetadata struct {
+	GalleryEndpoint string `json:"galleryEndpoint"`
+	GraphEndpoint   string `json:"graphEndpoint"`
+	PortalEndpoint  string `json:"portalEndpoint"`
+	Authentication  struct {
+		LoginEndpoint string   `json:"loginEndpoint"`
+		Audiences     []string `json:"audiences"`
+	} `json:"authentication"`
+}
+
+// GetEndpointsMetadata fetches the endpoints metadata of the resource manager.
+func GetEndpointsMetadata(client *resty.Client, resourceManagerEndpointURL string) (EndpointsMetadata, error) {
+	metadata := EndpointsMetadata{}
+	hostURL := strings.TrimSuffix(resourceManagerEndpointURL, "/") + "/metadata/endpoints"
+	resp, err := client.R().
+		SetHeader("User-Agent", userAgent).
+		SetQueryParam("api-version", metadataAPIVersion).
+		Get(hostURL)
+	if err != nil {
+		return metadata, fmt.Errorf("Error in getting the endpoints metadata from %s: %v", hostURL, err)
+	}
+	statusCode := resp.StatusCode()
+	if statusCode != http.StatusOK {
+		return metadata, fmt.Errorf("Error in getting the endpoints metadata from %s: StatusCode: %d - %v", hostURL, statusCode, resp)
+	}
+	if err := json.Unmarshal(resp.Body(), &metadata); err != nil {
+		return metadata, fmt.Errorf("Error in parsing the endpoints metadata from %s: %v", hostURL, err)
+	}
+	if metadata.Authentication.LoginEndpoint == "" {
+		return metadata, fmt.Errorf("No loginEndpoint in the endpoints metadata from %s", hostURL)
+	}
+	return metadata, nil
+}
+
+// resolveEnvironment returns the environment named in the cloud config. The
+// endpoints of an Azure Stack are derived from its domain and endpoint
+// prefix, and its login endpoint and audience come from its endpoints
+// metadata unless its resource is configured. The configured endpoints
+// override them all.
+func resolveEnvironment(cloudConfig CloudConfig, client *resty.Client) (Environment, error) {
+	name := cloudConfig.Azure.Environment
+	environment, ok := Environments[name]
+	if !ok {
+		return Environment{}, fmt.Errorf("Unknown environment: %s", name)
+	}
+	endpoints := cloudConfig.Endpoints
+
+	if name == AzureStack {
+		stack := cloudConfig.AzureStack
+		environment.ResourceManagerEndpointURL = fmt.Sprintf("https://%s.%s/", stack.AzureStackEndpointPrefix, stack.AzureStackDomain)
+		if endpoints.ResourceManagerEndpointURL != "" {
+			environment.ResourceManagerEndpointURL = endpoints.ResourceManagerEndpointURL
+		}
+		if endpoints.ActiveDirectoryEndpointURL == "" {
+			metadata, err := GetEndpointsMetadata(client, environment.ResourceManagerEndpointURL)
+			if err != nil {
+				return Environment{}, err
+			}
+			environment.ActiveDirectoryEndpointURL = strings.TrimSuffix(metadata.Authentication.LoginEndpoint, "/")
+			if len(metadata.Authentication.Audiences) > 0 {
+				environment.ResourceManagerAudience = metadata.Authentication.Audiences[0]
+			}
+		}
+		if stack.AzureStackResource != "" {
+			environment.ResourceManagerAudience = stack.AzureStackResource
+		}
+	}
+
+	if endpoints.ResourceManagerEndpointURL != "" {
+		environment.ResourceManagerEndpointURL = endpoints.ResourceManagerEndpointURL
+	}
+	if endpoints.ActiveDirectoryEndpointURL != "" {
+		environment.ActiveDirectoryEndpointURL = strings.TrimSuffix(endpoints.ActiveDirectoryEndpointURL, "/")
+	}
+	if environment.ResourceManagerEndpointURL == "" || environment.ActiveDirectoryEndpointURL == "" {
+		return Environment{}, fmt.Errorf("No endpoints for environment %s", name)
+	}
+	return environment, nil
+}
+
+// tokenEndpoint is the OAuth2 token endpoint of the tenant. ADFS has no
+// tenants, its login endpoint already ends with /adfs.
+func tokenEndpoint(environment Environment, cloudConfig CloudConfig) string {
+	if cloudConfig.Azure.Environment == AzureStack && cloudConfig.AzureStack.AzureStackAuthentication == AzureStackADFS {
+		return fmt.Sprintf("%s/oauth2/token", environment.ActiveDirectoryEndpointURL)
+	}
+	return fmt.Sprintf("%s/%s/oauth2/token", environment.ActiveDirectoryEndpointURL, cloudConfig.Azure.TenanID)
+}
+
+// audience is the resource which the tokens are requested for.
+func (e Environment) audience() string {
+	if e.ResourceManagerAudience != "" {
+		return e.ResourceManagerAudience
+	}
+	return e.ResourceManagerEndpointURL
+}
@@ -0,0 +1,118 @@
+package broker_test
+
+import (
+	"net/url"
+
+	"code.cloudfoundry.org/lager/lagertest"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/zeqing-guo/AzureBlockchainBroker/broker"
+	"github.com/zeqing-guo/AzureBlockchainBroker/fakeazure"
+)
+
+var _ = Describe("Environment", func() {
+	azureConfig := func(environment string) AzureConfig {
+		return *NewAzureConfig(environment, "tenant-id", "client-id", "client-secret")
+	}
+
+	Describe("ResolveEnvironment", func() {
+		It("should return the endpoints of a known cloud", func() {
+			environment, err := ResolveEnvironment(*NewCloudConfig(azureConfig(AzureChinaCloud), AzureStackConfig{}, EndpointConfig{}, CredentialConfig{}, HTTPConfig{}))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(environment).To(Equal(Environments[AzureChinaCloud]))
+		})
+
+		It("should override the endpoints", func() {
+			endpoints := *NewEndpointConfig("https://management.example.com/", "https://login.example.com/")
+			environment, err := ResolveEnvironment(*NewCloudConfig(azureConfig(AzureCloud), AzureStackConfig{}, endpoints, CredentialConfig{}, HTTPConfig{}))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(environment.ResourceManagerEndpointURL).To(Equal("https://management.example.com/"))
+			Expect(environment.ActiveDirectoryEndpointURL).To(Equal("https://login.example.com"))
+			Expect(environment.APIVersions).To(Equal(Environments[AzureCloud].APIVersions))
+		})
+
+		It("should raise an error for an unknown environment", func() {
+			_, err := ResolveEnvironment(*NewCloudConfig(azureConfig("AzureMoon"), AzureStackConfig{}, EndpointConfig{}, CredentialConfig{}, HTTPConfig{}))
+			Expect(err).To(MatchError("Unknown environment: AzureMoon"))
+		})
+
+		Context("when the environment is AzureStack", func() {
+			var server *fakeazure.Server
+
+			BeforeEach(func() {
+				server = fakeazure.NewServer(fakeazure.Config{})
+			})
+
+			AfterEach(func() {
+				server.Close()
+			})
+
+			It("should discover the login endpoint and the audience from the endpoints metadata", func() {
+				endpoints := *NewEndpointConfig(server.URL+"/", "")
+				environment, err := ResolveEnvironment(*NewCloudConfig(azureConfig(AzureStack), AzureStackConfig{}, endpoints, CredentialConfig{}, HTTPConfig{}))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(environment.ResourceManagerEndpointURL).To(Equal(server.URL + "/"))
+				Expect(environment.ActiveDirectoryEndpointURL).To(Equal(server.URL))
+				Expect(environment.ResourceManagerAudience).To(Equal(fakeazure.Audience))
+				Expect(environment.APIVersions).To(Equal(Environments[AzureStack].APIVersions))
+			})
+
+			It("should raise an error when the endpoints metadata cannot be fetched", func() {
+				endpoints := *NewEndpointConfig(server.URL+"/missing/", "")
+				_, err := ResolveEnvironment(*NewCloudConfig(azureConfig(AzureStack), AzureStackConfig{}, endpoints, CredentialConfig{}, HTTPConfig{}))
+				Expect(err).To(MatchError(ContainSubstring("Error in getting the endpoints metadata")))
+			})
+		})
+	})
+
+	Describe("AzureStack authentication", func() {
+		var server *fakeazure.Server
+
+		BeforeEach(func() {
+			server = fakeazure.NewServer(fakeazure.Config{})
+		})
+
+		AfterEach(func() {
+			server.Close()
+		})
+
+		requestToken := func(authentication, resource string) url.Values {
+			stackConfig := *NewAzureStackConfig("local.azurestack.external", authentication, resource, "management")
+			endpoints := *NewEndpointConfig(server.URL+"/", "")
+			client, err := NewAzureResourceAccountRESTClient(lagertest.NewTestLogger("environment"), *NewCloudConfig(azureConfig(AzureStack), stackConfig, endpoints, CredentialConfig{}, HTTPConfig{}))
+			Expect(err).NotTo(HaveOccurred())
+			_, err = client.GroupExist(Scope{SubscriptionID: "subscription-id", ResourceGroupName: "group"})
+			Expect(err).NotTo(HaveOccurred())
+
+			for _, request := range server.Requests() {
+				if request == "POST /tenant-id/oauth2/token" || request == "POST /oauth2/token" {
+					values, err := url.ParseQuery(string(server.LastRequestBody(request)))
+					Expect(err).NotTo(HaveOccurred())
+					values.Set("path", request)
+					return values
+				}
+			}
+			Fail("no token was requested")
+			return nil
+		}
+
+		It("should request a token of the tenant for the configured resource with AzureAD", func() {
+			values := requestToken(AzureStackAzureAD, "https://management.contoso.onmicrosoft.com/guid")
+			Expect(values.Get("path")).To(Equal("POST /tenant-id/oauth2/token"))
+			Expect(values.Get("resource")).To(Equal("https://management.contoso.onmicrosoft.com/guid"))
+		})
+
+		It("should request a token of the tenant with AzureStackAD", func() {
+			values := requestToken(AzureStackAzureStackAD, "https://management.local.azurestack.external/guid")
+			Expect(values.Get("path")).To(Equal("POST /tenant-id/oauth2/token"))
+			Expect(values.Get("resource")).To(Equal("https://management.local.azurestack.external/guid"))
+		})
+
+		It("should request a token without a tenant with ADFS", func() {
+			values := requestToken(AzureStackADFS, "")
+			Expect(values.Get("path")).To(Equal("POST /oauth2/token"))
+			Expect(values.Get("resource")).To(Equal(fakeazure.Audience))
+			Expect(values.Get("client_id")).To(Equal("client-id"))
+		})
+	})
+})
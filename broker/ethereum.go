@@ -0,0 +1,225 @@
+package broker
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+
+	"github.com/btcsuite/btcd/btcec"
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/crypto/sha3"
+	resty "gopkg.in/resty.v0"
+)
+
+const (
+	// the light scrypt parameters of geth, so Bind does not take seconds
+	keystoreScryptN     = 1 << 12
+	keystoreScryptR     = 8
+	keystoreScryptP     = 6
+	keystoreScryptDKLen = 32
+	keystoreVersion     = 3
+
+	fundAccountUnlockSeconds = 30
+)
+
+// EthereumAccount is a fresh account generated for a single binding. The
+// private key is only handed to the application; the broker never keeps it.
+type EthereumAccount struct {
+	Address    string
+	PrivateKey string
+	Keystore   json.RawMessage
+	Password   string
+}
+
+func NewEthereumAccount() (*EthereumAccount, error) {
+	privateKey, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		return nil, fmt.Errorf("Error in generate private key: %v", err)
+	}
+	password, err := randomHex(32)
+	if err != nil {
+		return nil, err
+	}
+	keystore, err := encryptKeystore(privateKey, password)
+	if err != nil {
+		return nil, err
+	}
+	return &EthereumAccount{
+		Address:    "0x" + ethereumAddress(privateKey.PubKey()),
+		PrivateKey: "0x" + hex.EncodeToString(privateKey.Serialize()),
+		Keystore:   keystore,
+		Password:   password,
+	}, nil
+}
+
+func ethereumAddress(publicKey *btcec.PublicKey) string {
+	// the address is the last 20 bytes of the hash of the public key without
+	// the leading 0x04
+	return hex.EncodeToString(keccak256(publicKey.SerializeUncompressed()[1:])[12:])
+}
+
+// encryptKeystore encrypts the private key into the version 3 keystore
+// format of geth, so it can be imported by any Ethereum wallet.
+func encryptKeystore(privateKey *btcec.PrivateKey, password string) (json.RawMessage, error) {
+	salt := make([]byte, 32)
+	iv := make([]byte, aes.BlockSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(iv); err != nil {
+		return nil, err
+	}
+	derivedKey, err := scrypt.Key([]byte(password), salt, keystoreScryptN, keystoreScryptR, keystoreScryptP, keystoreScryptDKLen)
+	if err != nil {
+		return nil, fmt.Errorf("Error in derive keystore key: %v", err)
+	}
+
+	block, err := aes.NewCipher(derivedKey[:16])
+	if err != nil {
+		return nil, err
+	}
+	plainText := privateKey.Serialize()
+	cipherText := make([]byte, len(plainText))
+	cipher.NewCTR(block, iv).XORKeyStream(cipherText, plainText)
+	mac := keccak256(derivedKey[16:32], cipherText)
+
+	id, err := newUUID()
+	if err != nil {
+		return nil, err
+	}
+	keystore := map[string]interface{}{
+		"address": ethereumAddress(privateKey.PubKey()),
+		"crypto": map[string]interface{}{
+			"cipher":     "aes-128-ctr",
+			"ciphertext": hex.EncodeToString(cipherText),
+			"cipherparams": map[string]string{
+				"iv": hex.EncodeToString(iv),
+			},
+			"kdf": "scrypt",
+			"kdfparams": map[string]interface{}{
+				"dklen": keystoreScryptDKLen,
+				"n":     keystoreScryptN,
+				"p":     keystoreScryptP,
+				"r":     keystoreScryptR,
+				"salt":  hex.EncodeToString(salt),
+			},
+			"mac": hex.EncodeToString(mac),
+		},
+		"id":      id,
+		"version": keystoreVersion,
+	}
+	return json.Marshal(keystore)
+}
+
+func keccak256(data ...[]byte) []byte {
+	hash := sha3.NewLegacyKeccak256()
+	for _, d := range data {
+		hash.Write(d)
+	}
+	return hash.Sum(nil)
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func newUUID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+// EthereumRPCClient talks to the JSON-RPC endpoint of a deployed network
+// with the client of NewHTTPClient, so a network which does not answer does
+// not hold a bind beyond the timeout.
+type EthereumRPCClient struct {
+	client *resty.Client
+	rpcURL string
+}
+
+func NewEthereumRPCClient(client *resty.Client, rpcURL string) *EthereumRPCClient {
+	return &EthereumRPCClient{client: client, rpcURL: rpcURL}
+}
+
+func (e *EthereumRPCClient) call(method string, params []interface{}, result interface{}) error {
+	request := map[string]interface{}{
+		"jsonrpc": "2.0",
+		"id":      1,
+		"method":  method,
+		"params":  params,
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	resp, err := e.client.R().
+		SetHeader("Content-Type", contentTypeJSON).
+		SetBody(body).
+		Post(e.rpcURL)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode() != http.StatusOK {
+		return fmt.Errorf("Error Code: %d, %v", resp.StatusCode(), resp)
+	}
+
+	response := struct {
+		Result json.RawMessage `json:"result"`
+		Error  *struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}{}
+	if err := json.Unmarshal(resp.Body(), &response); err != nil {
+		return fmt.Errorf("Error in parse response of %s: %v", method, err)
+	}
+	if response.Error != nil {
+		return fmt.Errorf("Error in %s: %d %s", method, response.Error.Code, response.Error.Message)
+	}
+	return json.Unmarshal(response.Result, result)
+}
+
+// FundAccount sends ether from the default account, which is generated by the
+// template and protected by ethereumAccountPsswd, to the given address.
+func (e *EthereumRPCClient) FundAccount(defaultAccountPassword string, to string, amountWei *big.Int) (string, error) {
+	accounts := []string{}
+	if err := e.call("eth_accounts", []interface{}{}, &accounts); err != nil {
+		return "", err
+	}
+	if len(accounts) == 0 {
+		return "", fmt.Errorf("No default account on %s", e.rpcURL)
+	}
+	from := accounts[0]
+
+	unlocked := false
+	if err := e.call("personal_unlockAccount", []interface{}{from, defaultAccountPassword, fundAccountUnlockSeconds}, &unlocked); err != nil {
+		return "", err
+	}
+	if !unlocked {
+		return "", fmt.Errorf("Cannot unlock the default account %s", from)
+	}
+
+	transaction := map[string]string{
+		"from":  from,
+		"to":    to,
+		"value": fmt.Sprintf("0x%x", amountWei),
+	}
+	transactionHash := ""
+	if err := e.call("eth_sendTransaction", []interface{}{transaction}, &transactionHash); err != nil {
+		return "", err
+	}
+	return transactionHash, nil
+}
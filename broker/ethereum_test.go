@@ -0,0 +1,175 @@
+package broker_test
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/zeqing-guo/AzureBlockchainBroker/broker"
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/crypto/sha3"
+)
+
+type keystoreV3 struct {
+	Address string `json:"address"`
+	Crypto  struct {
+		Cipher       string `json:"cipher"`
+		CipherText   string `json:"ciphertext"`
+		CipherParams struct {
+			IV string `json:"iv"`
+		} `json:"cipherparams"`
+		KDF       string `json:"kdf"`
+		KDFParams struct {
+			DKLen int    `json:"dklen"`
+			N     int    `json:"n"`
+			P     int    `json:"p"`
+			R     int    `json:"r"`
+			Salt  string `json:"salt"`
+		} `json:"kdfparams"`
+		MAC string `json:"mac"`
+	} `json:"crypto"`
+	ID      string `json:"id"`
+	Version int    `json:"version"`
+}
+
+func decodeHex(s string) []byte {
+	b, err := hex.DecodeString(strings.TrimPrefix(s, "0x"))
+	Expect(err).NotTo(HaveOccurred())
+	return b
+}
+
+var _ = Describe("Ethereum", func() {
+	Describe("EthereumAddress", func() {
+		It("should derive the address of a private key", func() {
+			privateKey := make([]byte, 32)
+			privateKey[31] = 1
+			Expect(EthereumAddress(privateKey)).To(Equal("0x7e5f4552091a69125d5dfcb7b8c2659029395bdf"))
+		})
+	})
+
+	Describe("NewEthereumAccount", func() {
+		var account *EthereumAccount
+
+		BeforeEach(func() {
+			var err error
+			account, err = NewEthereumAccount()
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("should generate the address of the private key", func() {
+			Expect(account.PrivateKey).To(HavePrefix("0x"))
+			Expect(account.Address).To(Equal(EthereumAddress(decodeHex(account.PrivateKey))))
+		})
+
+		It("should generate a different account every time", func() {
+			other, err := NewEthereumAccount()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(other.Address).NotTo(Equal(account.Address))
+			Expect(other.Password).NotTo(Equal(account.Password))
+		})
+
+		It("should encrypt the private key into the keystore with the password", func() {
+			keystore := keystoreV3{}
+			Expect(json.Unmarshal(account.Keystore, &keystore)).To(Succeed())
+			Expect(keystore.Version).To(Equal(3))
+			Expect("0x" + keystore.Address).To(Equal(account.Address))
+			Expect(keystore.Crypto.Cipher).To(Equal("aes-128-ctr"))
+			Expect(keystore.Crypto.KDF).To(Equal("scrypt"))
+
+			params := keystore.Crypto.KDFParams
+			derivedKey, err := scrypt.Key([]byte(account.Password), decodeHex(params.Salt), params.N, params.R, params.P, params.DKLen)
+			Expect(err).NotTo(HaveOccurred())
+			cipherText := decodeHex(keystore.Crypto.CipherText)
+
+			hash := sha3.NewLegacyKeccak256()
+			hash.Write(derivedKey[16:32])
+			hash.Write(cipherText)
+			Expect(hex.EncodeToString(hash.Sum(nil))).To(Equal(keystore.Crypto.MAC))
+
+			block, err := aes.NewCipher(derivedKey[:16])
+			Expect(err).NotTo(HaveOccurred())
+			plainText := make([]byte, len(cipherText))
+			cipher.NewCTR(block, decodeHex(keystore.Crypto.CipherParams.IV)).XORKeyStream(plainText, cipherText)
+			Expect("0x" + hex.EncodeToString(plainText)).To(Equal(account.PrivateKey))
+		})
+	})
+
+	Describe("FundAccount", func() {
+		var (
+			server  *httptest.Server
+			client  *EthereumRPCClient
+			methods []string
+			unlock  string
+			latency time.Duration
+		)
+
+		BeforeEach(func() {
+			methods = []string{}
+			unlock = "true"
+			latency = 0
+			server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				time.Sleep(latency)
+				body, _ := ioutil.ReadAll(r.Body)
+				request := struct {
+					Method string            `json:"method"`
+					Params []json.RawMessage `json:"params"`
+				}{}
+				json.Unmarshal(body, &request)
+				methods = append(methods, request.Method)
+				switch request.Method {
+				case "eth_accounts":
+					w.Write([]byte(`{"jsonrpc": "2.0", "id": 1, "result": ["0x00000000000000000000000000000000000000aa"]}`))
+				case "personal_unlockAccount":
+					w.Write([]byte(`{"jsonrpc": "2.0", "id": 1, "result": ` + unlock + `}`))
+				case "eth_sendTransaction":
+					transaction := map[string]string{}
+					json.Unmarshal(request.Params[0], &transaction)
+					Expect(transaction["to"]).To(Equal("0x00000000000000000000000000000000000000bb"))
+					Expect(transaction["value"]).To(Equal("0xde0b6b3a7640000"))
+					w.Write([]byte(`{"jsonrpc": "2.0", "id": 1, "result": "0xhash"}`))
+				default:
+					w.Write([]byte(`{"jsonrpc": "2.0", "id": 1, "error": {"code": -32601, "message": "method not found"}}`))
+				}
+			}))
+		})
+
+		JustBeforeEach(func() {
+			httpClient, err := NewHTTPClient(*NewHTTPConfig(100*time.Millisecond, "", "", 0, 0, 0, 0, 0))
+			Expect(err).NotTo(HaveOccurred())
+			client = NewEthereumRPCClient(httpClient, server.URL)
+		})
+
+		AfterEach(func() {
+			server.Close()
+		})
+
+		It("should send ether from the default account", func() {
+			transactionHash, err := client.FundAccount("password", "0x00000000000000000000000000000000000000bb", big.NewInt(1000000000000000000))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(transactionHash).To(Equal("0xhash"))
+			Expect(methods).To(Equal([]string{"eth_accounts", "personal_unlockAccount", "eth_sendTransaction"}))
+		})
+
+		It("should raise an error if the default account cannot be unlocked", func() {
+			unlock = "false"
+			_, err := client.FundAccount("password", "0x00000000000000000000000000000000000000bb", big.NewInt(1))
+			Expect(err).To(HaveOccurred())
+			Expect(methods).NotTo(ContainElement("eth_sendTransaction"))
+		})
+
+		It("should give up on a network which does not answer in time", func() {
+			latency = 200 * time.Millisecond
+			_, err := client.FundAccount("password", "0x00000000000000000000000000000000000000bb", big.NewInt(1))
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
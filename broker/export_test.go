@@ -0,0 +1,19 @@
+package broker
+
+import "github.com/btcsuite/btcd/btcec"
+
+// ResolveEnvironment returns the environment named in the cloud config, as
+// NewAzureResourceAccountRESTClient resolves it.
+func ResolveEnvironment(cloudConfig CloudConfig) (Environment, error) {
+	client, err := NewHTTPClient(cloudConfig.HTTP)
+	if err != nil {
+		return Environment{}, err
+	}
+	return resolveEnvironment(cloudConfig, client)
+}
+
+// EthereumAddress returns the address of the account owning the private key.
+func EthereumAddress(privateKey []byte) string {
+	_, publicKey := btcec.PrivKeyFromBytes(btcec.S256(), privateKey)
+	return "0x" + ethereumAddress(publicKey)
+}
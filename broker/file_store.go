@@ -0,0 +1,196 @@
+package broker
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// FileStore keeps all records in a single JSON file which is rewritten on
+// every change.
+type FileStore struct {
+	path      string
+	mutex     sync.Mutex
+	instances map[string]InstanceRecord
+}
+
+func NewFileStore(path string) (*FileStore, error) {
+	store := &FileStore{
+		path:      path,
+		instances: map[string]InstanceRecord{},
+	}
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error in read state file: %v", err)
+	}
+	if len(content) > 0 {
+		if err := json.Unmarshal(content, &store.instances); err != nil {
+			return nil, fmt.Errorf("Error in parse state file %s: %v", path, err)
+		}
+	}
+	return store, nil
+}
+
+func (s *FileStore) GetInstance(instanceID string) (InstanceRecord, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	instance, ok := s.instances[instanceID]
+	if !ok {
+		return InstanceRecord{}, ErrRecordNotFound
+	}
+	return copyInstanceRecord(instance), nil
+}
+
+func (s *FileStore) ListInstances() ([]InstanceRecord, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	instances := []InstanceRecord{}
+	for _, instance := range s.instances {
+		instance = copyInstanceRecord(instance)
+		instance.Bindings = nil
+		instances = append(instances, instance)
+	}
+	return instances, nil
+}
+
+func (s *FileStore) PutInstance(instance InstanceRecord) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	instance = copyInstanceRecord(instance)
+	instance.Bindings = s.instances[instance.InstanceID].Bindings
+	return s.update(func(instances map[string]InstanceRecord) error {
+		instances[instance.InstanceID] = instance
+		return nil
+	})
+}
+
+func (s *FileStore) DeleteInstance(instanceID string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.instances[instanceID]; !ok {
+		return nil
+	}
+	return s.update(func(instances map[string]InstanceRecord) error {
+		delete(instances, instanceID)
+		return nil
+	})
+}
+
+func (s *FileStore) PutBinding(instanceID string, binding BindingRecord) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.update(func(instances map[string]InstanceRecord) error {
+		instance, ok := instances[instanceID]
+		if !ok {
+			return ErrRecordNotFound
+		}
+		bindings := map[string]BindingRecord{}
+		for id, b := range instance.Bindings {
+			bindings[id] = b
+		}
+		bindings[binding.BindingID] = binding
+		instance.Bindings = bindings
+		instances[instanceID] = instance
+		return nil
+	})
+}
+
+func (s *FileStore) DeleteBinding(instanceID string, bindingID string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.update(func(instances map[string]InstanceRecord) error {
+		instance, ok := instances[instanceID]
+		if !ok {
+			return ErrRecordNotFound
+		}
+		if _, ok := instance.Bindings[bindingID]; !ok {
+			return ErrRecordNotFound
+		}
+		bindings := map[string]BindingRecord{}
+		for id, b := range instance.Bindings {
+			if id != bindingID {
+				bindings[id] = b
+			}
+		}
+		instance.Bindings = bindings
+		instances[instanceID] = instance
+		return nil
+	})
+}
+
+// update applies the change to a copy of the records and only keeps it once
+// the file has been written. The caller must hold the mutex.
+func (s *FileStore) update(change func(map[string]InstanceRecord) error) error {
+	instances := make(map[string]InstanceRecord, len(s.instances))
+	for id, instance := range s.instances {
+		instances[id] = instance
+	}
+	if err := change(instances); err != nil {
+		return err
+	}
+
+	content, err := json.MarshalIndent(instances, "", "  ")
+	if err != nil {
+		return err
+	}
+	// write to a temporary file and rename it, so a crash never leaves a
+	// truncated state file behind
+	tempFile, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path))
+	if err != nil {
+		return fmt.Errorf("Error in write state file: %v", err)
+	}
+	if _, err := tempFile.Write(content); err != nil {
+		tempFile.Close()
+		os.Remove(tempFile.Name())
+		return fmt.Errorf("Error in write state file: %v", err)
+	}
+	if err := tempFile.Close(); err != nil {
+		os.Remove(tempFile.Name())
+		return fmt.Errorf("Error in write state file: %v", err)
+	}
+	if err := os.Rename(tempFile.Name(), s.path); err != nil {
+		os.Remove(tempFile.Name())
+		return fmt.Errorf("Error in write state file: %v", err)
+	}
+
+	s.instances = instances
+	return nil
+}
+
+func copyInstanceRecord(instance InstanceRecord) InstanceRecord {
+	if instance.Bindings != nil {
+		bindings := make(map[string]BindingRecord, len(instance.Bindings))
+		for id, binding := range instance.Bindings {
+			bindings[id] = binding
+		}
+		instance.Bindings = bindings
+	}
+	if instance.Outputs != nil {
+		outputs := make(map[string]interface{}, len(instance.Outputs))
+		for key, value := range instance.Outputs {
+			outputs[key] = value
+		}
+		instance.Outputs = outputs
+	}
+	if instance.Cleanup != nil {
+		cleanup := *instance.Cleanup
+		if cleanup.Operation != nil {
+			operation := *cleanup.Operation
+			cleanup.Operation = &operation
+		}
+		instance.Cleanup = &cleanup
+	}
+	return instance
+}
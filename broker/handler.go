@@ -0,0 +1,49 @@
+package broker
+
+import (
+	"context"
+	"net/http"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+// alreadyExistsKey is the key of the flag in the context of a request which
+// Provision raises when the instance already exists.
+type alreadyExistsKey struct{}
+
+// NewHandler serves the broker API like brokerapi.New, but answers 200
+// rather than 201 when a provision finds the instance already provisioned
+// with the same parameters, as the Open Service Broker API asks. brokerapi
+// cannot tell both apart.
+func NewHandler(serviceBroker *ServiceBroker, logger lager.Logger, credentials brokerapi.BrokerCredentials) http.Handler {
+	handler := brokerapi.New(serviceBroker, logger, credentials)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		alreadyExists := new(bool)
+		r = r.WithContext(context.WithValue(r.Context(), alreadyExistsKey{}, alreadyExists))
+		handler.ServeHTTP(&alreadyExistsWriter{ResponseWriter: w, alreadyExists: alreadyExists}, r)
+	})
+}
+
+// markAlreadyExists raises the flag of the request, if it has one.
+func markAlreadyExists(ctx context.Context) {
+	if alreadyExists, ok := ctx.Value(alreadyExistsKey{}).(*bool); ok {
+		*alreadyExists = true
+	}
+}
+
+type alreadyExistsWriter struct {
+	http.ResponseWriter
+	alreadyExists *bool
+}
+
+func (w *alreadyExistsWriter) WriteHeader(statusCode int) {
+	if statusCode == http.StatusCreated && *w.alreadyExists {
+		statusCode = http.StatusOK
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
@@ -0,0 +1,160 @@
+package broker
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	resty "gopkg.in/resty.v0"
+)
+
+// HTTPConfig is how the broker talks to Azure AD and ARM.
+type HTTPConfig struct {
+	Timeout time.Duration
+	// ProxyURL is the proxy of all requests, the proxy of the environment
+	// variables HTTPS_PROXY and NO_PROXY if it is empty
+	ProxyURL string
+	// CABundlePath is a PEM file of CAs trusted besides the system ones,
+	// e.g. the CA of an Azure Stack
+	CABundlePath string
+	// RetryCount is how many times a throttled or failed request is retried
+	RetryCount int
+	// RetryWaitTime doubles at every retry up to RetryMaxWaitTime
+	RetryWaitTime    time.Duration
+	RetryMaxWaitTime time.Duration
+	// RateLimitThreshold is the remaining reads or writes of a subscription
+	// below which its requests are delayed, up to RateLimitMaxDelay when
+	// none remain
+	RateLimitThreshold int
+	RateLimitMaxDelay  time.Duration
+}
+
+func NewHTTPConfig(timeout time.Duration, proxyURL, caBundlePath string, retryCount int, retryWaitTime, retryMaxWaitTime time.Duration, rateLimitThreshold int, rateLimitMaxDelay time.Duration) *HTTPConfig {
+	myConf := new(HTTPConfig)
+
+	myConf.Timeout = timeout
+	myConf.ProxyURL = proxyURL
+	myConf.CABundlePath = caBundlePath
+	myConf.RetryCount = retryCount
+	myConf.RetryWaitTime = retryWaitTime
+	myConf.RetryMaxWaitTime = retryMaxWaitTime
+	myConf.RateLimitThreshold = rateLimitThreshold
+	myConf.RateLimitMaxDelay = rateLimitMaxDelay
+
+	return myConf
+}
+
+func (config *HTTPConfig) Validate() error {
+	if config.Timeout < 0 || config.RetryCount < 0 || config.RetryWaitTime < 0 || config.RetryMaxWaitTime < 0 {
+		return fmt.Errorf("httpTimeout, retryCount, retryWaitTime and retryMaxWaitTime should not be negative")
+	}
+	if config.RateLimitThreshold < 0 || config.RateLimitMaxDelay < 0 {
+		return fmt.Errorf("rateLimitThreshold and rateLimitMaxDelay should not be negative")
+	}
+	if config.ProxyURL != "" {
+		if _, err := url.Parse(config.ProxyURL); err != nil {
+			return fmt.Errorf("Invalid httpProxy: %v", err)
+		}
+	}
+	return nil
+}
+
+// NewHTTPClient returns a client with the timeout, the proxy and the CAs of
+// the config. It does not retry, see retryWait.
+func NewHTTPClient(config HTTPConfig) (*resty.Client, error) {
+	transport := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		TLSHandshakeTimeout: 10 * time.Second,
+	}
+	if config.ProxyURL != "" {
+		proxyURL, err := url.Parse(config.ProxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid httpProxy: %v", err)
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+	if config.CABundlePath != "" {
+		bundle, err := ioutil.ReadFile(config.CABundlePath)
+		if err != nil {
+			return nil, fmt.Errorf("Error in reading the CA bundle: %v", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(bundle) {
+			return nil, fmt.Errorf("No certificate in the CA bundle %s", config.CABundlePath)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	client := resty.New().
+		SetTransport(transport).
+		SetRetryCount(0)
+	if config.Timeout > 0 {
+		client.SetTimeout(config.Timeout)
+	}
+	return client, nil
+}
+
+// retryable tells whether a request is worth retrying: a request which did
+// not get through, or which ARM throttled or failed to serve.
+func retryable(resp *resty.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	for _, v := range restRetryCodes {
+		if resp.StatusCode() == v {
+			return true
+		}
+	}
+	return false
+}
+
+// sendWithRetry sends a request with send, and retries it up to the retry
+// count of the config if it is retryable, waiting as retryWait tells.
+func sendWithRetry(config HTTPConfig, send func() (*resty.Response, error)) (*resty.Response, error) {
+	for attempt := 0; ; attempt++ {
+		resp, err := send()
+		if attempt >= config.RetryCount || !retryable(resp, err) {
+			return resp, err
+		}
+		time.Sleep(retryWait(config, attempt, resp))
+	}
+}
+
+// retryWait is how long to wait before the retry after the attempt: the
+// Retry-After of the response if there is one, else an exponential backoff
+// with jitter.
+func retryWait(config HTTPConfig, attempt int, resp *resty.Response) time.Duration {
+	if resp != nil {
+		if retryAfter := resp.Header().Get("Retry-After"); retryAfter != "" {
+			if seconds, err := strconv.Atoi(retryAfter); err == nil && seconds >= 0 {
+				return time.Duration(seconds) * time.Second
+			}
+			if date, err := http.ParseTime(retryAfter); err == nil {
+				if wait := time.Until(date); wait > 0 {
+					return wait
+				}
+				return 0
+			}
+		}
+	}
+	wait := config.RetryWaitTime
+	for i := 0; i < attempt && (config.RetryMaxWaitTime <= 0 || wait < config.RetryMaxWaitTime); i++ {
+		wait *= 2
+	}
+	if config.RetryMaxWaitTime > 0 && wait > config.RetryMaxWaitTime {
+		wait = config.RetryMaxWaitTime
+	}
+	// half of the wait is random, so throttled brokers do not retry together
+	if wait > 1 {
+		wait = wait/2 + time.Duration(rand.Int63n(int64(wait/2)+1))
+	}
+	return wait
+}
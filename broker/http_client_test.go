@@ -0,0 +1,110 @@
+package broker_test
+
+import (
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+
+	"code.cloudfoundry.org/lager/lagertest"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/zeqing-guo/AzureBlockchainBroker/broker"
+	"github.com/zeqing-guo/AzureBlockchainBroker/fakeazure"
+)
+
+var _ = Describe("HTTPClient", func() {
+	Describe("NewHTTPClient", func() {
+		var (
+			server  *httptest.Server
+			tempDir string
+		)
+
+		BeforeEach(func() {
+			server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(r.URL.Host))
+			}))
+			var err error
+			tempDir, err = ioutil.TempDir("", "http-client")
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			server.Close()
+			os.RemoveAll(tempDir)
+		})
+
+		It("should trust the CAs in the CA bundle", func() {
+			client, err := NewHTTPClient(HTTPConfig{})
+			Expect(err).NotTo(HaveOccurred())
+			_, err = client.R().Get(server.URL)
+			Expect(err).To(HaveOccurred())
+
+			caBundlePath := filepath.Join(tempDir, "ca.pem")
+			bundle := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+			Expect(ioutil.WriteFile(caBundlePath, bundle, 0600)).To(Succeed())
+			client, err = NewHTTPClient(*NewHTTPConfig(time.Second, "", caBundlePath, 0, 0, 0, 0, 0))
+			Expect(err).NotTo(HaveOccurred())
+			resp, err := client.R().Get(server.URL)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resp.StatusCode()).To(Equal(http.StatusOK))
+		})
+
+		It("should raise an error for a CA bundle without certificates", func() {
+			_, err := NewHTTPClient(*NewHTTPConfig(0, "", "testdata/error_not_found.json", 0, 0, 0, 0, 0))
+			Expect(err).To(MatchError("No certificate in the CA bundle testdata/error_not_found.json"))
+		})
+
+		It("should send the requests through the proxy", func() {
+			proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("proxied " + r.URL.Host))
+			}))
+			defer proxy.Close()
+
+			client, err := NewHTTPClient(*NewHTTPConfig(0, proxy.URL, "", 0, 0, 0, 0, 0))
+			Expect(err).NotTo(HaveOccurred())
+			resp, err := client.R().Get("http://management.example.com/")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resp.String()).To(Equal("proxied management.example.com"))
+		})
+	})
+
+	Describe("retries", func() {
+		var server *fakeazure.Server
+
+		BeforeEach(func() {
+			server = fakeazure.NewServer(fakeazure.Config{})
+		})
+
+		AfterEach(func() {
+			server.Close()
+		})
+
+		checkResourceStatus := func(retryCount int) error {
+			azureConfig := *NewAzureConfig(AzureCloud, "tenant-id", "client-id", "client-secret")
+			httpConfig := *NewHTTPConfig(0, "", "", retryCount, time.Millisecond, 5*time.Millisecond, 0, 0)
+			client, err := NewAzureResourceAccountRESTClient(lagertest.NewTestLogger("http-client"), *NewCloudConfig(azureConfig, AzureStackConfig{}, server.Endpoints(), CredentialConfig{}, httpConfig))
+			Expect(err).NotTo(HaveOccurred())
+			_, err = client.CheckResourceStatus(Scope{SubscriptionID: "subscription-id", ResourceGroupName: "group"})
+			return err
+		}
+
+		It("should retry a throttled request up to the retry count", func() {
+			server.Throttle(3)
+			Expect(checkResourceStatus(3)).To(Succeed())
+		})
+
+		It("should give up after the retry count", func() {
+			server.Throttle(3)
+			Expect(checkResourceStatus(2)).To(MatchError(ContainSubstring("Error Code: 429")))
+		})
+
+		It("should not retry without a retry count", func() {
+			server.Throttle(1)
+			Expect(checkResourceStatus(0)).To(MatchError(ContainSubstring("TooManyRequests")))
+		})
+	})
+})
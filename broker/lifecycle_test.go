@@ -0,0 +1,834 @@
+package broker_test
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"code.cloudfoundry.org/lager/lagertest"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pivotal-cf/brokerapi"
+	. "github.com/zeqing-guo/AzureBlockchainBroker/broker"
+	"github.com/zeqing-guo/AzureBlockchainBroker/fakeazure"
+)
+
+var _ = Describe("Lifecycle", func() {
+	const (
+		instanceID = "8f2c1c9e-8a51-4b0e-9f5b-7f0a1e0b6a3d"
+		bindingID  = "binding-id"
+		planID     = "7c0b2254-7e68-11e7-bbe1-000d3a818256"
+	)
+
+	var (
+		server              *fakeazure.Server
+		config              fakeazure.Config
+		serviceBroker       *ServiceBroker
+		template            *Template
+		catalog             *Catalog
+		whatIf              bool
+		resourceGroupConfig *ResourceGroupConfig
+		cleanupConfig       *CleanupConfig
+		bindingConfig       *BindingConfig
+		store               Store
+		tempDir             string
+		ctx                 context.Context
+	)
+
+	BeforeEach(func() {
+		config = fakeazure.Config{Polls: 2}
+		var err error
+		template, err = LoadTemplate(nil, *NewTemplateConfig("testdata/template.json", "", ""))
+		Expect(err).NotTo(HaveOccurred())
+		catalog = DefaultCatalog()
+		whatIf = false
+		resourceGroupConfig = NewResourceGroupConfig("", "")
+		cleanupConfig = NewCleanupConfig(false, 0)
+		bindingConfig = NewBindingConfig(nil)
+		ctx = context.Background()
+	})
+
+	JustBeforeEach(func() {
+		server = fakeazure.NewServer(config)
+
+		var err error
+		tempDir, err = ioutil.TempDir("", "lifecycle")
+		Expect(err).NotTo(HaveOccurred())
+		store, err = NewFileStore(filepath.Join(tempDir, "state.json"))
+		Expect(err).NotTo(HaveOccurred())
+
+		cloudConfig := NewCloudConfig(*NewAzureConfig(AzureCloud, "tenant-id", "client-id", "client-secret"), AzureStackConfig{}, server.Endpoints(), CredentialConfig{}, *NewHTTPConfig(0, "", "", 3, time.Millisecond, 10*time.Millisecond, 0, 0))
+		resourceConfig := NewResourceConfig("subscription-id", "", true, "westus", "", false, false, whatIf)
+		blockchainConfig := NewBlockchainConfig("ethnet", "gethadmin", "aZure1234567", "aZure1234567", "aZure1234567", 553289, 2, 1, "Standard_D1_v2", 1, "Standard_D1_v2")
+		serviceBroker, err = New(lagertest.NewTestLogger("lifecycle"), *cloudConfig, *resourceConfig, *resourceGroupConfig, *blockchainConfig, template, *bindingConfig, *cleanupConfig, catalog, store, "azureblockchain", "service-id")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		server.Close()
+		os.RemoveAll(tempDir)
+	})
+
+	provision := func() string {
+		spec, err := serviceBroker.Provision(ctx, instanceID, brokerapi.ProvisionDetails{ServiceID: "service-id", PlanID: planID}, true)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(spec.IsAsync).To(BeTrue())
+		return spec.OperationData
+	}
+
+	pollUntilDone := func(operationData string) brokerapi.LastOperation {
+		var lastOperation brokerapi.LastOperation
+		Eventually(func() brokerapi.LastOperationState {
+			var err error
+			lastOperation, err = serviceBroker.LastOperation(ctx, instanceID, operationData)
+			Expect(err).NotTo(HaveOccurred())
+			return lastOperation.State
+		}).ShouldNot(Equal(brokerapi.InProgress))
+		return lastOperation
+	}
+
+	It("should provision, bind, unbind and deprovision an instance", func() {
+		operationData := provision()
+		Expect(server.ResourceGroupExists(instanceID)).To(BeTrue())
+
+		lastOperation, err := serviceBroker.LastOperation(ctx, instanceID, operationData)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(lastOperation.State).To(Equal(brokerapi.InProgress))
+		lastOperation = pollUntilDone(operationData)
+		Expect(lastOperation.State).To(Equal(brokerapi.Succeeded))
+		Expect(lastOperation.Description).To(ContainSubstring("http://ethnet-dns.westus.cloudapp.azure.com:8545"))
+
+		binding, err := serviceBroker.Bind(ctx, instanceID, bindingID, brokerapi.BindDetails{AppGUID: "app-guid", PlanID: planID})
+		Expect(err).NotTo(HaveOccurred())
+		credentials, ok := binding.Credentials.(Credentials)
+		Expect(ok).To(BeTrue())
+		Expect(credentials).To(HaveKeyWithValue("rpc_url", "http://ethnet-dns.westus.cloudapp.azure.com:8545"))
+		Expect(credentials).To(HaveKeyWithValue("resource_group", instanceID))
+		Expect(credentials).To(HaveKeyWithValue("location", "westus"))
+		_, err = json.Marshal(binding)
+		Expect(err).NotTo(HaveOccurred())
+
+		_, err = serviceBroker.Bind(ctx, instanceID, bindingID, brokerapi.BindDetails{AppGUID: "app-guid", PlanID: planID})
+		Expect(err).To(Equal(brokerapi.ErrBindingAlreadyExists))
+
+		Expect(serviceBroker.Unbind(ctx, instanceID, bindingID, brokerapi.UnbindDetails{})).To(Succeed())
+		Expect(serviceBroker.Unbind(ctx, instanceID, bindingID, brokerapi.UnbindDetails{})).To(Equal(brokerapi.ErrBindingDoesNotExist))
+
+		spec, err := serviceBroker.Deprovision(ctx, instanceID, brokerapi.DeprovisionDetails{PlanID: planID}, true)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(spec.IsAsync).To(BeTrue())
+		lastOperation, err = serviceBroker.LastOperation(ctx, instanceID, spec.OperationData)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(lastOperation.State).To(Equal(brokerapi.InProgress))
+		Expect(server.ResourceGroupExists(instanceID)).To(BeTrue())
+
+		lastOperation = pollUntilDone(spec.OperationData)
+		Expect(lastOperation.State).To(Equal(brokerapi.Succeeded))
+		Expect(server.ResourceGroupExists(instanceID)).To(BeFalse())
+	})
+
+	Context("when ARM does not return the URL of the deletion", func() {
+		BeforeEach(func() {
+			config.UntrackedDeletions = true
+		})
+
+		It("should deprovision asynchronously until the resource group is gone", func() {
+			pollUntilDone(provision())
+
+			spec, err := serviceBroker.Deprovision(ctx, instanceID, brokerapi.DeprovisionDetails{PlanID: planID}, true)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(spec.IsAsync).To(BeTrue())
+			Expect(server.ResourceGroupExists(instanceID)).To(BeTrue())
+
+			lastOperation := pollUntilDone(spec.OperationData)
+			Expect(lastOperation.State).To(Equal(brokerapi.Succeeded))
+			Expect(server.ResourceGroupExists(instanceID)).To(BeFalse())
+		})
+	})
+
+	It("should refuse operation data which it did not encode", func() {
+		operationData := provision()
+
+		_, err := serviceBroker.LastOperation(ctx, instanceID, operationData+"!")
+		Expect(err.(*brokerapi.FailureResponse).ValidatedStatusCode(nil)).To(Equal(http.StatusBadRequest))
+	})
+
+	It("should not follow operation URLs which do not point at ARM", func() {
+		polled := false
+		attacker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			polled = true
+		}))
+		defer attacker.Close()
+		provision()
+
+		operation := Operation{Kind: "provision", AsyncOperationURL: attacker.URL + "/operations/1"}
+		_, err := serviceBroker.LastOperation(ctx, instanceID, operation.OperationData())
+		Expect(err.(*brokerapi.FailureResponse).ValidatedStatusCode(nil)).To(Equal(http.StatusBadRequest))
+		Expect(polled).To(BeFalse())
+	})
+
+	It("should require async deprovision", func() {
+		_, err := serviceBroker.Deprovision(ctx, instanceID, brokerapi.DeprovisionDetails{PlanID: planID}, false)
+		Expect(err).To(Equal(brokerapi.ErrAsyncRequired))
+	})
+
+	It("should update the deployed network", func() {
+		pollUntilDone(provision())
+
+		spec, err := serviceBroker.Update(ctx, instanceID, brokerapi.UpdateDetails{
+			PlanID:        planID,
+			RawParameters: json.RawMessage(`{"numTXNodes": 3}`),
+		}, true)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(server.DeploymentState(instanceID, instanceID)).To(Equal("Accepted"))
+
+		_, err = serviceBroker.Update(ctx, instanceID, brokerapi.UpdateDetails{PlanID: planID}, true)
+		Expect(err).To(Equal(brokerapi.ErrConcurrentInstanceAccess))
+
+		Expect(pollUntilDone(spec.OperationData).State).To(Equal(brokerapi.Succeeded))
+		body := server.LastRequestBody("PUT /subscriptions/subscription-id/resourceGroups/" + instanceID + "/providers/Microsoft.Resources/deployments/" + instanceID)
+		Expect(string(body)).To(ContainSubstring(`"numTXNodes":{"value":3}`))
+	})
+
+	Context("with a fund amount", func() {
+		var (
+			rpcServer *httptest.Server
+			unlock    string
+			funded    []string
+		)
+
+		BeforeEach(func() {
+			unlock = "true"
+			funded = nil
+			rpcServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				defer GinkgoRecover()
+				request := struct {
+					Method string `json:"method"`
+				}{}
+				json.NewDecoder(r.Body).Decode(&request)
+				switch request.Method {
+				case "eth_accounts":
+					w.Write([]byte(`{"jsonrpc": "2.0", "id": 1, "result": ["0x00000000000000000000000000000000000000aa"]}`))
+				case "personal_unlockAccount":
+					w.Write([]byte(`{"jsonrpc": "2.0", "id": 1, "result": ` + unlock + `}`))
+				case "eth_sendTransaction":
+					// the binding is recorded before its account is funded
+					instance, err := store.GetInstance(instanceID)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(instance.Bindings).To(HaveKey(bindingID))
+					funded = append(funded, instance.Bindings[bindingID].Address)
+					w.Write([]byte(`{"jsonrpc": "2.0", "id": 1, "result": "0xhash"}`))
+				}
+			}))
+			config.Outputs = map[string]interface{}{"admin-site": "http://ethnet-dns.westus.cloudapp.azure.com", "ethereum-rpc-endpoint": rpcServer.URL}
+			bindingConfig = NewBindingConfig(big.NewInt(1000))
+		})
+
+		AfterEach(func() {
+			rpcServer.Close()
+		})
+
+		It("should fund the account of a recorded binding, and forget the binding if the funding fails", func() {
+			pollUntilDone(provision())
+
+			unlock = "false"
+			_, err := serviceBroker.Bind(ctx, instanceID, bindingID, brokerapi.BindDetails{AppGUID: "app-guid", PlanID: planID})
+			Expect(err).To(HaveOccurred())
+			instance, err := store.GetInstance(instanceID)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(instance.Bindings).To(BeEmpty())
+
+			unlock = "true"
+			binding, err := serviceBroker.Bind(ctx, instanceID, bindingID, brokerapi.BindDetails{AppGUID: "app-guid", PlanID: planID})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(funded).To(HaveLen(1))
+			Expect(binding.Credentials).To(HaveKeyWithValue("address", funded[0]))
+		})
+	})
+
+	It("should keep binding the network when an update fails", func() {
+		pollUntilDone(provision())
+
+		server.FailDeployments(&OperationError{Code: "SkuNotAvailable", Message: "The requested size is not available."})
+		spec, err := serviceBroker.Update(ctx, instanceID, brokerapi.UpdateDetails{
+			PlanID:        planID,
+			RawParameters: json.RawMessage(`{"txNodeVMSize": "Standard_D2_v2"}`),
+		}, true)
+		Expect(err).NotTo(HaveOccurred())
+		failed := pollUntilDone(spec.OperationData)
+		Expect(failed.State).To(Equal(brokerapi.Failed))
+		Expect(serviceBroker.LastOperation(ctx, instanceID, spec.OperationData)).To(Equal(failed))
+		instance, err := store.GetInstance(instanceID)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(instance.State).To(Equal(StateSucceeded))
+		Expect(instance.Failure).To(ContainSubstring("SkuNotAvailable"))
+
+		binding, err := serviceBroker.Bind(ctx, instanceID, bindingID, brokerapi.BindDetails{AppGUID: "app-guid", PlanID: planID})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(binding.Credentials).To(HaveKeyWithValue("rpc_url", "http://ethnet-dns.westus.cloudapp.azure.com:8545"))
+	})
+
+	It("should not let the template parameters override those the broker sets", func() {
+		_, err := serviceBroker.Provision(ctx, instanceID, brokerapi.ProvisionDetails{
+			ServiceID:     "service-id",
+			PlanID:        planID,
+			RawParameters: json.RawMessage(`{"template": {"ethereumAccountPsswd": "aZure7654321"}}`),
+		}, true)
+		Expect(err.(*brokerapi.FailureResponse).ValidatedStatusCode(nil)).To(Equal(http.StatusBadRequest))
+
+		pollUntilDone(provision())
+		_, err = serviceBroker.Update(ctx, instanceID, brokerapi.UpdateDetails{
+			PlanID:        planID,
+			RawParameters: json.RawMessage(`{"template": {"ethereumNetworkID": 99}}`),
+		}, true)
+		Expect(err.(*brokerapi.FailureResponse).ValidatedStatusCode(nil)).To(Equal(http.StatusBadRequest))
+		Expect(server.DeploymentState(instanceID, instanceID)).To(Equal("Succeeded"))
+	})
+
+	Context("with a plan which sets the topology", func() {
+		BeforeEach(func() {
+			numTXNodes := uint64(1)
+			catalog = &Catalog{Plans: []Plan{{ID: planID, Name: "dev", Description: "dev", Parameters: ProvisionParameters{NumTXNodes: &numTXNodes}}}}
+		})
+
+		It("should keep the deployed values when the platform omits the previous plan", func() {
+			spec, err := serviceBroker.Provision(ctx, instanceID, brokerapi.ProvisionDetails{ServiceID: "service-id", PlanID: planID, RawParameters: json.RawMessage(`{"numTXNodes": 3}`)}, true)
+			Expect(err).NotTo(HaveOccurred())
+			pollUntilDone(spec.OperationData)
+
+			update, err := serviceBroker.Update(ctx, instanceID, brokerapi.UpdateDetails{
+				ServiceID:     "service-id",
+				PlanID:        planID,
+				RawParameters: json.RawMessage(`{"txNodeVMSize": "Standard_D2_v2"}`),
+			}, true)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(pollUntilDone(update.OperationData).State).To(Equal(brokerapi.Succeeded))
+			body := server.LastRequestBody("PUT /subscriptions/subscription-id/resourceGroups/" + instanceID + "/providers/Microsoft.Resources/deployments/" + instanceID)
+			Expect(string(body)).To(ContainSubstring(`"numTXNodes":{"value":3}`))
+			Expect(string(body)).To(ContainSubstring(`"txNodeVMSize":{"value":"Standard_D2_v2"}`))
+		})
+	})
+
+	Context("when the instance is provisioned again", func() {
+		deployments := func() int {
+			count := 0
+			for _, request := range server.Requests() {
+				if request == "PUT /subscriptions/subscription-id/resourceGroups/"+instanceID+"/providers/Microsoft.Resources/deployments/"+instanceID {
+					count++
+				}
+			}
+			return count
+		}
+
+		It("should return the operation while the provision is in progress", func() {
+			operationData := provision()
+
+			spec, err := serviceBroker.Provision(ctx, instanceID, brokerapi.ProvisionDetails{ServiceID: "service-id", PlanID: planID}, true)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(spec.IsAsync).To(BeTrue())
+			Expect(spec.OperationData).To(Equal(operationData))
+			Expect(deployments()).To(Equal(1))
+
+			_, err = serviceBroker.Provision(ctx, instanceID, brokerapi.ProvisionDetails{ServiceID: "service-id", PlanID: planID}, false)
+			Expect(err).To(Equal(brokerapi.ErrAsyncRequired))
+		})
+
+		It("should answer that the instance already exists with 200", func() {
+			pollUntilDone(provision())
+
+			handler := NewHandler(serviceBroker, lagertest.NewTestLogger("broker-api"), brokerapi.BrokerCredentials{Username: "username", Password: "password"})
+			request := httptest.NewRequest(http.MethodPut, "/v2/service_instances/"+instanceID+"?accepts_incomplete=true", strings.NewReader(`{"service_id": "service-id", "plan_id": "`+planID+`"}`))
+			request.SetBasicAuth("username", "password")
+			request.Header.Set("X-Broker-API-Version", "2.12")
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, request)
+			Expect(recorder.Code).To(Equal(http.StatusOK))
+			Expect(deployments()).To(Equal(1))
+		})
+
+		It("should conflict with a provision of other parameters", func() {
+			pollUntilDone(provision())
+
+			_, err := serviceBroker.Provision(ctx, instanceID, brokerapi.ProvisionDetails{ServiceID: "service-id", PlanID: planID, RawParameters: json.RawMessage(`{"numTXNodes": 2}`)}, true)
+			Expect(err).To(Equal(brokerapi.ErrInstanceAlreadyExists))
+			Expect(deployments()).To(Equal(1))
+		})
+
+		It("should not provision an instance which is being deprovisioned", func() {
+			pollUntilDone(provision())
+			_, err := serviceBroker.Deprovision(ctx, instanceID, brokerapi.DeprovisionDetails{PlanID: planID}, true)
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = serviceBroker.Provision(ctx, instanceID, brokerapi.ProvisionDetails{ServiceID: "service-id", PlanID: planID}, true)
+			Expect(err).To(Equal(brokerapi.ErrConcurrentInstanceAccess))
+		})
+
+		It("should not deploy again after a failed update", func() {
+			pollUntilDone(provision())
+			server.FailDeployments(&OperationError{Code: "SkuNotAvailable", Message: "The requested size is not available."})
+			spec, err := serviceBroker.Update(ctx, instanceID, brokerapi.UpdateDetails{PlanID: planID, RawParameters: json.RawMessage(`{"numTXNodes": 3}`)}, true)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(pollUntilDone(spec.OperationData).State).To(Equal(brokerapi.Failed))
+
+			_, err = serviceBroker.Provision(ctx, instanceID, brokerapi.ProvisionDetails{ServiceID: "service-id", PlanID: planID}, true)
+			Expect(err).To(Equal(brokerapi.ErrInstanceAlreadyExists))
+			_, err = serviceBroker.Provision(ctx, instanceID, brokerapi.ProvisionDetails{ServiceID: "service-id", PlanID: planID, RawParameters: json.RawMessage(`{"numTXNodes": 3}`)}, true)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(deployments()).To(Equal(2))
+		})
+
+		It("should not deploy again after a failed deprovision", func() {
+			pollUntilDone(provision())
+			server.FailDeletions(&OperationError{Code: "ResourceGroupDeletionBlocked", Message: "The resource group is locked."})
+			spec, err := serviceBroker.Deprovision(ctx, instanceID, brokerapi.DeprovisionDetails{PlanID: planID}, true)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(pollUntilDone(spec.OperationData).State).To(Equal(brokerapi.Failed))
+			Expect(server.ResourceGroupExists(instanceID)).To(BeTrue())
+
+			_, err = serviceBroker.Provision(ctx, instanceID, brokerapi.ProvisionDetails{ServiceID: "service-id", PlanID: planID}, true)
+			Expect(err).To(Equal(brokerapi.ErrInstanceAlreadyExists))
+			Expect(deployments()).To(Equal(1))
+		})
+	})
+
+	Context("with concurrent requests", func() {
+		const otherInstanceID = "3b9d7e52-0c4f-4f1a-a6d8-2e5b9c7f1d04"
+
+		provisionInBackground := func(instanceID string) chan brokerapi.ProvisionedServiceSpec {
+			specs := make(chan brokerapi.ProvisionedServiceSpec, 1)
+			go func() {
+				defer GinkgoRecover()
+				spec, err := serviceBroker.Provision(ctx, instanceID, brokerapi.ProvisionDetails{ServiceID: "service-id", PlanID: planID}, true)
+				Expect(err).NotTo(HaveOccurred())
+				specs <- spec
+			}()
+			return specs
+		}
+
+		It("should serialize the requests for the same instance", func() {
+			release := server.Hold()
+			first := provisionInBackground(instanceID)
+			Eventually(server.Held).Should(Equal(1))
+			second := provisionInBackground(instanceID)
+			Consistently(server.Held, 100*time.Millisecond).Should(Equal(1))
+			release()
+
+			var firstSpec, secondSpec brokerapi.ProvisionedServiceSpec
+			Eventually(first).Should(Receive(&firstSpec))
+			Eventually(second).Should(Receive(&secondSpec))
+			Expect(secondSpec.IsAsync).To(BeTrue())
+			Expect(secondSpec.OperationData).To(Equal(firstSpec.OperationData))
+		})
+
+		It("should run the requests for different instances in parallel", func() {
+			release := server.Hold()
+			first := provisionInBackground(instanceID)
+			second := provisionInBackground(otherInstanceID)
+			Eventually(server.Held).Should(Equal(2))
+			release()
+
+			Eventually(first).Should(Receive())
+			Eventually(second).Should(Receive())
+			Expect(server.ResourceGroupExists(instanceID)).To(BeTrue())
+			Expect(server.ResourceGroupExists(otherInstanceID)).To(BeTrue())
+		})
+	})
+
+	Context("with a naming scheme for the resource groups", func() {
+		const groupName = "blockchain-5d1a9c3e-b7e2f0a4-8f2c1c9e"
+
+		var details brokerapi.ProvisionDetails
+
+		BeforeEach(func() {
+			resourceGroupConfig = NewResourceGroupConfig("blockchain", "{prefix}-{org}-{space}-{shortid}")
+			details = brokerapi.ProvisionDetails{
+				ServiceID:        "service-id",
+				PlanID:           planID,
+				OrganizationGUID: "5d1a9c3e-1111-2222-3333-444444444444",
+				SpaceGUID:        "b7e2f0a4-5555-6666-7777-888888888888",
+			}
+		})
+
+		It("should deploy into a resource group named and tagged after the instance", func() {
+			spec, err := serviceBroker.Provision(ctx, instanceID, details, true)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(pollUntilDone(spec.OperationData).State).To(Equal(brokerapi.Succeeded))
+
+			Expect(server.DeploymentState(groupName, instanceID)).To(Equal("Succeeded"))
+			Expect(server.ResourceGroupTags(groupName)).To(Equal(map[string]string{
+				"blockchain-broker-instance-id":       instanceID,
+				"blockchain-broker-organization-guid": "5d1a9c3e-1111-2222-3333-444444444444",
+				"blockchain-broker-space-guid":        "b7e2f0a4-5555-6666-7777-888888888888",
+				"blockchain-broker-plan-id":           planID,
+				"blockchain-broker-version":           Version,
+			}))
+
+			binding, err := serviceBroker.Bind(ctx, instanceID, bindingID, brokerapi.BindDetails{AppGUID: "app-guid", PlanID: planID})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(binding.Credentials).To(HaveKeyWithValue("resource_group", groupName))
+
+			spec2, err := serviceBroker.Deprovision(ctx, instanceID, brokerapi.DeprovisionDetails{PlanID: planID}, true)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(pollUntilDone(spec2.OperationData).State).To(Equal(brokerapi.Succeeded))
+			Expect(server.ResourceGroupExists(groupName)).To(BeFalse())
+		})
+
+		It("should refuse to deploy into a resource group which it did not create", func() {
+			server.AddResourceGroup(groupName, "westus", map[string]string{"owner": "someone"})
+
+			_, err := serviceBroker.Provision(ctx, instanceID, details, true)
+			Expect(err).To(MatchError("The resource group " + groupName + " exists and was not created by the broker for the instance"))
+			Expect(err.(*brokerapi.FailureResponse).ValidatedStatusCode(nil)).To(Equal(http.StatusConflict))
+			Expect(server.DeploymentState(groupName, instanceID)).To(BeEmpty())
+			Expect(server.ResourceGroupExists(groupName)).To(BeTrue())
+			_, err = store.GetInstance(instanceID)
+			Expect(err).To(Equal(ErrRecordNotFound))
+		})
+	})
+
+	It("should validate the parameters against the template", func() {
+		_, err := serviceBroker.Provision(ctx, instanceID, brokerapi.ProvisionDetails{
+			ServiceID:     "service-id",
+			PlanID:        planID,
+			RawParameters: json.RawMessage(`{"numTXNodes": 6, "mnNodeVMSize": "Standard_G5"}`),
+		}, true)
+		Expect(err).To(MatchError("Invalid parameters: mnNodeVMSize is not an allowed value: Standard_G5; numTXNodes should be in [1, 5]"))
+		Expect(server.ResourceGroupExists(instanceID)).To(BeFalse())
+
+		pollUntilDone(provision())
+		_, err = serviceBroker.Update(ctx, instanceID, brokerapi.UpdateDetails{
+			PlanID:        planID,
+			RawParameters: json.RawMessage(`{"numMiningNodesPerMember": 20}`),
+		}, true)
+		Expect(err).To(MatchError("Invalid parameters: numMiningNodesPerMember should be in [1, 19]"))
+	})
+
+	It("should dry-run a provision without deploying it", func() {
+		_, err := serviceBroker.DryRun("", planID, json.RawMessage(`{"numTXNodes": 6}`))
+		Expect(err).To(MatchError("Invalid parameters: numTXNodes should be in [1, 5]"))
+		Expect(server.Requests()).To(BeEmpty())
+
+		changes, err := serviceBroker.DryRun("", planID, json.RawMessage(`{"numTXNodes": 2}`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(changes).To(HaveLen(1))
+		requests := server.Requests()
+		Expect(requests).To(ContainElement(MatchRegexp(`^POST /subscriptions/subscription-id/resourceGroups/dry-run-\d+/providers/Microsoft.Resources/deployments/dry-run-\d+/validate$`)))
+		Expect(requests).NotTo(ContainElement(MatchRegexp(`^PUT .*/deployments/`)))
+		// the resource group of the dry run is deleted
+		Expect(requests).To(ContainElement(MatchRegexp(`^DELETE /subscriptions/subscription-id/resourcegroups/dry-run-\d+$`)))
+	})
+
+	It("should refuse a plan whose parameters the template does not allow", func() {
+		numConsortiumMembers := uint64(1)
+		catalog = &Catalog{Plans: []Plan{{ID: planID, Name: "tiny", Description: "tiny", Parameters: ProvisionParameters{NumConsortiumMembers: &numConsortiumMembers}}}}
+		cloudConfig := NewCloudConfig(*NewAzureConfig(AzureCloud, "tenant-id", "client-id", "client-secret"), AzureStackConfig{}, server.Endpoints(), CredentialConfig{}, HTTPConfig{})
+		resourceConfig := NewResourceConfig("subscription-id", "", true, "westus", "", false, false, false)
+		blockchainConfig := NewBlockchainConfig("ethnet", "gethadmin", "aZure1234567", "aZure1234567", "aZure1234567", 553289, 2, 1, "Standard_D1_v2", 1, "Standard_D1_v2")
+		_, err := New(lagertest.NewTestLogger("lifecycle"), *cloudConfig, *resourceConfig, ResourceGroupConfig{}, *blockchainConfig, template, BindingConfig{}, CleanupConfig{}, catalog, store, "azureblockchain", "service-id")
+		Expect(err).To(MatchError("Invalid catalog: plan 0: Invalid parameters: numConsortiumMembers should be in [2, 5]"))
+	})
+
+	It("should refuse to start without a template", func() {
+		cloudConfig := NewCloudConfig(*NewAzureConfig(AzureCloud, "tenant-id", "client-id", "client-secret"), AzureStackConfig{}, server.Endpoints(), CredentialConfig{}, HTTPConfig{})
+		resourceConfig := NewResourceConfig("subscription-id", "", true, "westus", "", false, false, false)
+		blockchainConfig := NewBlockchainConfig("ethnet", "gethadmin", "aZure1234567", "aZure1234567", "aZure1234567", 553289, 2, 1, "Standard_D1_v2", 1, "Standard_D1_v2")
+		_, err := New(lagertest.NewTestLogger("lifecycle"), *cloudConfig, *resourceConfig, ResourceGroupConfig{}, *blockchainConfig, nil, BindingConfig{}, CleanupConfig{}, catalog, store, "azureblockchain", "service-id")
+		Expect(err).To(MatchError("No template for the service azureblockchain: templatePath or templateURL is required"))
+	})
+
+	Context("with several services", func() {
+		const (
+			fabricServiceID = "fabric-service-id"
+			fabricPlanID    = "fabric-plan-id"
+		)
+
+		BeforeEach(func() {
+			catalog = &Catalog{Services: []Service{
+				{
+					ID:          "service-id",
+					Name:        "ethereum",
+					Description: "Ethereum consortium",
+					NetworkType: NetworkEthereumConsortium,
+					Plans:       []Plan{{ID: planID, Name: "small", Description: "small"}},
+				},
+				{
+					ID:           fabricServiceID,
+					Name:         "fabric",
+					Description:  "Hyperledger Fabric",
+					Tags:         []string{"fabric"},
+					NetworkType:  NetworkHyperledgerFabric,
+					TemplatePath: "testdata/fabric_template.json",
+					Outputs:      OutputNames{AdminSite: "admin-site"},
+					Plans: []Plan{{ID: fabricPlanID, Name: "dev", Description: "dev", Parameters: ProvisionParameters{
+						Template: map[string]interface{}{"numOrdererNodes": 2},
+					}}},
+				},
+			}}
+			Expect(catalog.LoadTemplates(nil)).To(Succeed())
+		})
+
+		It("should offer every service with its own plans", func() {
+			services := serviceBroker.Services(ctx)
+			Expect(services).To(HaveLen(2))
+			Expect(services[0].Name).To(Equal("ethereum"))
+			Expect(services[0].Plans[0].ID).To(Equal(planID))
+			Expect(services[1].ID).To(Equal(fabricServiceID))
+			Expect(services[1].Tags).To(Equal([]string{"fabric"}))
+			Expect(services[1].Plans[0].ID).To(Equal(fabricPlanID))
+		})
+
+		It("should deploy the template of the service with the parameters of the plan and the instance", func() {
+			details := brokerapi.ProvisionDetails{ServiceID: fabricServiceID, PlanID: fabricPlanID, RawParameters: json.RawMessage(`{"numTXNodes": 2}`)}
+			_, err := serviceBroker.Provision(ctx, instanceID, details, true)
+			Expect(err).To(MatchError(ContainSubstring("numTXNodes only apply to ethereum-consortium services")))
+
+			details.RawParameters = json.RawMessage(`{"template": {"numPeerNodes": 3}}`)
+			spec, err := serviceBroker.Provision(ctx, instanceID, details, true)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(pollUntilDone(spec.OperationData).State).To(Equal(brokerapi.Succeeded))
+
+			body := server.LastRequestBody("PUT /subscriptions/subscription-id/resourceGroups/" + instanceID + "/providers/Microsoft.Resources/deployments/" + instanceID)
+			Expect(string(body)).To(ContainSubstring(`"numOrdererNodes"`))
+			Expect(string(body)).To(ContainSubstring(`"parameters":{"namePrefix":{"value":"ethnet"},"numOrdererNodes":{"value":2},"numPeerNodes":{"value":3}}`))
+
+			binding, err := serviceBroker.Bind(ctx, instanceID, bindingID, brokerapi.BindDetails{AppGUID: "app-guid", PlanID: fabricPlanID})
+			Expect(err).NotTo(HaveOccurred())
+			credentials := binding.Credentials.(Credentials)
+			Expect(credentials).To(HaveKeyWithValue("admin_site_url", "http://ethnet-dns.westus.cloudapp.azure.com"))
+			Expect(credentials).NotTo(HaveKey("address"))
+		})
+	})
+
+	Context("with a pinned template", func() {
+		It("should deploy the template inline and record its version", func() {
+			Expect(pollUntilDone(provision()).State).To(Equal(brokerapi.Succeeded))
+
+			body := server.LastRequestBody("PUT /subscriptions/subscription-id/resourceGroups/" + instanceID + "/providers/Microsoft.Resources/deployments/" + instanceID)
+			request := struct {
+				Properties map[string]json.RawMessage `json:"properties"`
+			}{}
+			Expect(json.Unmarshal(body, &request)).To(Succeed())
+			Expect(request.Properties).To(HaveKey("template"))
+			Expect(request.Properties).NotTo(HaveKey("templateLink"))
+			Expect(string(request.Properties["template"])).To(ContainSubstring(`"contentVersion":"1.0.0.0"`))
+
+			instance, err := store.GetInstance(instanceID)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(instance.TemplateVersion).To(Equal("1.0.0.0"))
+			Expect(instance.TemplateSHA256).To(Equal(template.SHA256))
+		})
+
+		It("should dry-run the template with what-if", func() {
+			changes, err := serviceBroker.DryRun("service-id", planID, nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(changes).To(HaveLen(1))
+			Expect(changes[0].ChangeType).To(Equal("Create"))
+			Expect(changes[0].ResourceID).To(HaveSuffix("/providers/Microsoft.Network/virtualNetworks/[concat(parameters('namePrefix'), '-vnet')]"))
+		})
+
+		Context("with what-if", func() {
+			BeforeEach(func() {
+				whatIf = true
+			})
+
+			It("should ask for the changes before deploying the template", func() {
+				Expect(pollUntilDone(provision()).State).To(Equal(brokerapi.Succeeded))
+				Expect(server.Requests()).To(ContainElement("POST /subscriptions/subscription-id/resourceGroups/" + instanceID + "/providers/Microsoft.Resources/deployments/" + instanceID + "/whatIf"))
+			})
+
+			Context("when what-if takes long", func() {
+				BeforeEach(func() {
+					config.WhatIfRetryAfter = 30
+				})
+
+				It("should deploy the template without waiting for the changes", func() {
+					start := time.Now()
+					operationData := provision()
+					Expect(time.Since(start)).To(BeNumerically("<", 5*time.Second))
+					Expect(pollUntilDone(operationData).State).To(Equal(brokerapi.Succeeded))
+				})
+			})
+
+			Context("when what-if is asynchronous", func() {
+				BeforeEach(func() {
+					config.WhatIfRetryAfter = 1
+				})
+
+				It("should wait for the changes of a dry run", func() {
+					changes, err := serviceBroker.DryRun("service-id", planID, nil)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(changes).To(HaveLen(1))
+				})
+			})
+		})
+	})
+
+	Context("when the deployment fails", func() {
+		It("should describe the failure", func() {
+			server.FailDeployments(&OperationError{Code: "SkuNotAvailable", Message: "The requested size is not available."})
+
+			lastOperation := pollUntilDone(provision())
+			Expect(lastOperation.State).To(Equal(brokerapi.Failed))
+			Expect(lastOperation.Description).To(ContainSubstring("Microsoft.Compute/virtualMachines 'tx0': SkuNotAvailable: The requested size is not available."))
+			Expect(server.ResourceGroupExists(instanceID)).To(BeTrue())
+		})
+
+		Context("with cleanup", func() {
+			BeforeEach(func() {
+				cleanupConfig = NewCleanupConfig(true, 0)
+				config.Polls = 3
+			})
+
+			It("should delete the resource group, and provision again once it is gone", func() {
+				server.FailDeployments(&OperationError{Code: "SkuNotAvailable", Message: "The requested size is not available."})
+				operationData := provision()
+				failed := pollUntilDone(operationData)
+				Expect(failed.State).To(Equal(brokerapi.Failed))
+				Expect(server.Requests()).To(ContainElement("DELETE /subscriptions/subscription-id/resourcegroups/" + instanceID))
+				Expect(serviceBroker.LastOperation(ctx, instanceID, operationData)).To(Equal(failed))
+
+				_, err := serviceBroker.Provision(ctx, instanceID, brokerapi.ProvisionDetails{ServiceID: "service-id", PlanID: planID}, true)
+				Expect(err).To(MatchError("The resource group " + instanceID + " of the failed provision is being deleted, please retry later"))
+
+				serviceBroker.CleanUp()
+				Expect(server.ResourceGroupExists(instanceID)).To(BeFalse())
+
+				server.FailDeployments(nil)
+				Expect(pollUntilDone(provision()).State).To(Equal(brokerapi.Succeeded))
+				instance, err := store.GetInstance(instanceID)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(instance.GroupCreated).To(BeTrue())
+				Expect(instance.Cleanup).To(BeNil())
+			})
+		})
+
+		Context("with a grace period", func() {
+			BeforeEach(func() {
+				cleanupConfig = NewCleanupConfig(true, time.Hour)
+			})
+
+			It("should keep the resource group until the grace period is over, unless the provision is retried", func() {
+				server.FailDeployments(&OperationError{Code: "SkuNotAvailable", Message: "The requested size is not available."})
+				Expect(pollUntilDone(provision()).State).To(Equal(brokerapi.Failed))
+
+				serviceBroker.CleanUp()
+				Expect(server.Requests()).NotTo(ContainElement(HavePrefix("DELETE")))
+				instance, err := store.GetInstance(instanceID)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(instance.Cleanup.After).To(BeTemporally("~", time.Now().Add(time.Hour), time.Minute))
+
+				_, err = serviceBroker.Provision(ctx, instanceID, brokerapi.ProvisionDetails{ServiceID: "service-id", PlanID: planID}, true)
+				Expect(err).To(MatchError(ContainSubstring("is being deleted")))
+				serviceBroker.CleanUp()
+				Expect(server.ResourceGroupExists(instanceID)).To(BeFalse())
+			})
+		})
+	})
+
+	Context("when the resource group is being deleted", func() {
+		BeforeEach(func() {
+			config.Polls = 3
+		})
+
+		It("should ask to retry the provision until the resource group is gone", func() {
+			server.AddResourceGroup(instanceID, "westus", map[string]string{TagInstanceID: instanceID})
+			server.DeleteResourceGroup(instanceID)
+
+			_, err := serviceBroker.Provision(ctx, instanceID, brokerapi.ProvisionDetails{ServiceID: "service-id", PlanID: planID}, true)
+			Expect(err).To(MatchError("The resource group " + instanceID + " is being deleted, please retry later"))
+			Expect(err.(*brokerapi.FailureResponse).ValidatedStatusCode(nil)).To(Equal(http.StatusUnprocessableEntity))
+			Expect(server.DeploymentState(instanceID, instanceID)).To(BeEmpty())
+			_, err = store.GetInstance(instanceID)
+			Expect(err).To(Equal(ErrRecordNotFound))
+
+			Expect(server.ResourceGroupExists(instanceID)).To(BeTrue())
+			_, err = serviceBroker.Provision(ctx, instanceID, brokerapi.ProvisionDetails{ServiceID: "service-id", PlanID: planID}, true)
+			Expect(err).To(HaveOccurred())
+			Expect(pollUntilDone(provision()).State).To(Equal(brokerapi.Succeeded))
+		})
+	})
+
+	Context("when ARM does not validate the deployment", func() {
+		It("should fail to provision before deploying, and delete the resource group", func() {
+			server.FailNext(http.MethodPost, http.StatusBadRequest, "InvalidTemplateDeployment", "Operation results in exceeding quota limits of Core.")
+
+			_, err := serviceBroker.Provision(ctx, instanceID, brokerapi.ProvisionDetails{ServiceID: "service-id", PlanID: planID}, true)
+			Expect(err).To(MatchError("The deployment failed the validation of Azure: InvalidTemplateDeployment: Operation results in exceeding quota limits of Core."))
+			Expect(server.DeploymentState(instanceID, instanceID)).To(BeEmpty())
+			Expect(server.Requests()).To(ContainElement("DELETE /subscriptions/subscription-id/resourcegroups/" + instanceID))
+			_, err = store.GetInstance(instanceID)
+			Expect(err).To(HaveOccurred())
+		})
+
+		Context("with the resource group of an earlier provision", func() {
+			BeforeEach(func() {
+				cleanupConfig = NewCleanupConfig(true, time.Hour)
+			})
+
+			It("should keep the failed instance until the resource group is cleaned up", func() {
+				server.AddResourceGroup(instanceID, "westus", map[string]string{TagInstanceID: instanceID})
+				server.FailNext(http.MethodPost, http.StatusBadRequest, "InvalidTemplateDeployment", "Operation results in exceeding quota limits of Core.")
+
+				_, err := serviceBroker.Provision(ctx, instanceID, brokerapi.ProvisionDetails{ServiceID: "service-id", PlanID: planID}, true)
+				Expect(err).To(MatchError(ContainSubstring("InvalidTemplateDeployment")))
+				Expect(server.ResourceGroupExists(instanceID)).To(BeTrue())
+				instance, err := store.GetInstance(instanceID)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(instance.State).To(Equal(StateFailed))
+				Expect(instance.Failure).To(ContainSubstring("InvalidTemplateDeployment"))
+				Expect(instance.Cleanup).NotTo(BeNil())
+
+				_, err = serviceBroker.Provision(ctx, instanceID, brokerapi.ProvisionDetails{ServiceID: "service-id", PlanID: planID}, true)
+				Expect(err).To(MatchError(ContainSubstring("is being deleted")))
+				serviceBroker.CleanUp()
+				Expect(server.ResourceGroupExists(instanceID)).To(BeFalse())
+			})
+		})
+	})
+
+	Context("when ARM rejects the deployment", func() {
+		It("should fail to provision", func() {
+			server.FailNext(http.MethodPut, http.StatusBadRequest, "InvalidTemplate", "The template is invalid.")
+
+			_, err := serviceBroker.Provision(ctx, instanceID, brokerapi.ProvisionDetails{ServiceID: "service-id", PlanID: planID}, true)
+			Expect(err).To(MatchError(ContainSubstring("InvalidTemplate: The template is invalid.")))
+		})
+	})
+
+	Context("when ARM throttles the requests", func() {
+		It("should retry them", func() {
+			server.Throttle(2)
+			Expect(pollUntilDone(provision()).State).To(Equal(brokerapi.Succeeded))
+		})
+
+		Context("with Retry-After", func() {
+			BeforeEach(func() {
+				config.RetryAfter = 1
+			})
+
+			It("should wait before the retry", func() {
+				server.Throttle(1)
+				start := time.Now()
+				provision()
+				Expect(time.Since(start)).To(BeNumerically(">=", time.Second))
+			})
+		})
+	})
+
+	Context("with latency", func() {
+		BeforeEach(func() {
+			config.Latency = 10 * time.Millisecond
+		})
+
+		It("should provision an instance", func() {
+			Expect(pollUntilDone(provision()).State).To(Equal(brokerapi.Succeeded))
+		})
+	})
+})
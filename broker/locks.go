@@ -0,0 +1,46 @@
+package broker
+
+import "sync"
+
+// instanceLocks serializes the operations on the same instance while the
+// operations on different instances run in parallel.
+type instanceLocks struct {
+	mutex sync.Mutex
+	locks map[string]*instanceLock
+}
+
+type instanceLock struct {
+	sync.Mutex
+	waiters int
+}
+
+func newInstanceLocks() *instanceLocks {
+	return &instanceLocks{
+		locks: map[string]*instanceLock{},
+	}
+}
+
+// Lock blocks until the instance is free and returns the function which
+// frees it again.
+func (l *instanceLocks) Lock(instanceID string) (unlock func()) {
+	l.mutex.Lock()
+	lock, ok := l.locks[instanceID]
+	if !ok {
+		lock = &instanceLock{}
+		l.locks[instanceID] = lock
+	}
+	lock.waiters++
+	l.mutex.Unlock()
+
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+
+		l.mutex.Lock()
+		lock.waiters--
+		if lock.waiters == 0 {
+			delete(l.locks, instanceID)
+		}
+		l.mutex.Unlock()
+	}
+}
@@ -0,0 +1,113 @@
+package broker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// The models of the ARM responses the broker reads. Parsing a response
+// checks the fields the broker relies on, so a response without them is an
+// error instead of a panic.
+
+// ErrorResponse is the envelope of the errors returned by ARM.
+type ErrorResponse struct {
+	Error *OperationError `json:"error"`
+}
+
+type ResourceGroup struct {
+	ID         string                   `json:"id"`
+	Name       string                   `json:"name"`
+	Location   string                   `json:"location"`
+	Tags       map[string]string        `json:"tags,omitempty"`
+	Properties *ResourceGroupProperties `json:"properties"`
+}
+
+type ResourceGroupProperties struct {
+	ProvisioningState string `json:"provisioningState"`
+}
+
+// DeploymentValue is a parameter or an output of a deployment.
+type DeploymentValue struct {
+	Type  string      `json:"type,omitempty"`
+	Value interface{} `json:"value"`
+}
+
+type Deployment struct {
+	ID         string                `json:"id"`
+	Name       string                `json:"name"`
+	Properties *DeploymentProperties `json:"properties"`
+}
+
+type DeploymentProperties struct {
+	ProvisioningState string                     `json:"provisioningState"`
+	CorrelationID     string                     `json:"correlationId,omitempty"`
+	Timestamp         string                     `json:"timestamp,omitempty"`
+	Parameters        map[string]DeploymentValue `json:"parameters,omitempty"`
+	Outputs           map[string]DeploymentValue `json:"outputs,omitempty"`
+	Error             *OperationError            `json:"error,omitempty"`
+}
+
+func ParseResourceGroup(body []byte) (ResourceGroup, error) {
+	group := ResourceGroup{}
+	if err := json.Unmarshal(body, &group); err != nil {
+		return ResourceGroup{}, fmt.Errorf("Error in parse resource group: %v", err)
+	}
+	if group.Properties == nil {
+		return ResourceGroup{}, fmt.Errorf("No properties in resource group %s", group.Name)
+	}
+	if group.Properties.ProvisioningState == "" {
+		return ResourceGroup{}, fmt.Errorf("No provisioningState in resource group %s", group.Name)
+	}
+	return group, nil
+}
+
+func ParseDeployment(body []byte) (Deployment, error) {
+	deployment := Deployment{}
+	if err := json.Unmarshal(body, &deployment); err != nil {
+		return Deployment{}, fmt.Errorf("Error in parse deployment: %v", err)
+	}
+	if deployment.Properties == nil {
+		return Deployment{}, fmt.Errorf("No properties in deployment %s", deployment.Name)
+	}
+	if deployment.Properties.ProvisioningState == "" {
+		return Deployment{}, fmt.Errorf("No provisioningState in deployment %s", deployment.Name)
+	}
+	return deployment, nil
+}
+
+// OutputValues returns the value of every output by its name.
+func (p DeploymentProperties) OutputValues() map[string]interface{} {
+	outputs := map[string]interface{}{}
+	for name, output := range p.Outputs {
+		outputs[name] = output.Value
+	}
+	return outputs
+}
+
+// StringOutput returns an output which has to be a non-empty string.
+func (p DeploymentProperties) StringOutput(name string) (string, error) {
+	if p.Outputs == nil {
+		return "", errors.New("No outputs in deployment")
+	}
+	output, ok := p.Outputs[name]
+	if !ok {
+		return "", fmt.Errorf("No %s in the outputs of deployment", name)
+	}
+	value, ok := output.Value.(string)
+	if !ok || value == "" {
+		return "", fmt.Errorf("Output %s of deployment is not a string: %v", name, output.Value)
+	}
+	return value, nil
+}
+
+// armError describes an unexpected response of ARM by its error envelope,
+// or by its body if it has none.
+func armError(statusCode int, body []byte) error {
+	envelope := ErrorResponse{}
+	if err := json.Unmarshal(body, &envelope); err == nil && envelope.Error != nil {
+		return fmt.Errorf("Error Code: %d, %v", statusCode, envelope.Error)
+	}
+	return fmt.Errorf("Error Code: %d, %s", statusCode, strings.TrimSpace(string(body)))
+}
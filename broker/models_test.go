@@ -0,0 +1,99 @@
+package broker_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/zeqing-guo/AzureBlockchainBroker/broker"
+)
+
+func fixture(name string) []byte {
+	body, err := ioutil.ReadFile(filepath.Join("testdata", name))
+	Expect(err).NotTo(HaveOccurred())
+	return body
+}
+
+var _ = Describe("Models", func() {
+	Describe("ParseResourceGroup", func() {
+		It("should parse the provisioning state", func() {
+			group, err := ParseResourceGroup(fixture("resource_group.json"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(group.Location).To(Equal("westus"))
+			Expect(group.Properties.ProvisioningState).To(Equal("Succeeded"))
+
+			group, err = ParseResourceGroup(fixture("resource_group_deleting.json"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(group.Properties.ProvisioningState).To(Equal("Deleting"))
+		})
+
+		It("should raise an error without properties", func() {
+			_, err := ParseResourceGroup(fixture("resource_group_without_properties.json"))
+			Expect(err).To(MatchError(ContainSubstring("No properties in resource group")))
+		})
+
+		It("should raise an error for a malformed body", func() {
+			_, err := ParseResourceGroup([]byte("<html>"))
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("ParseDeployment", func() {
+		It("should parse the outputs and the parameters", func() {
+			deployment, err := ParseDeployment(fixture("deployment_succeeded.json"))
+			Expect(err).NotTo(HaveOccurred())
+			properties := deployment.Properties
+			Expect(properties.ProvisioningState).To(Equal("Succeeded"))
+			Expect(properties.Parameters["numTXNodes"].Value).To(Equal(float64(1)))
+
+			rpcURL, err := properties.StringOutput("ethereum-rpc-endpoint")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(rpcURL).To(Equal("http://ethnet-dns.westus.cloudapp.azure.com:8545"))
+			Expect(properties.OutputValues()).To(HaveLen(3))
+			Expect(properties.OutputValues()).To(HaveKeyWithValue("admin-site", "http://ethnet-dns.westus.cloudapp.azure.com"))
+		})
+
+		It("should parse a running deployment without outputs", func() {
+			deployment, err := ParseDeployment(fixture("deployment_running.json"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(deployment.Properties.ProvisioningState).To(Equal("Running"))
+			Expect(deployment.Properties.OutputValues()).To(BeEmpty())
+
+			_, err = deployment.Properties.StringOutput("ethereum-rpc-endpoint")
+			Expect(err).To(MatchError("No outputs in deployment"))
+		})
+
+		It("should parse the error of a failed deployment", func() {
+			deployment, err := ParseDeployment(fixture("deployment_failed.json"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(deployment.Properties.ProvisioningState).To(Equal("Failed"))
+			Expect(deployment.Properties.Error.Code).To(Equal("DeploymentFailed"))
+			Expect(deployment.Properties.Error.Details).To(HaveLen(1))
+		})
+
+		It("should raise an error for a missing output", func() {
+			deployment, err := ParseDeployment(fixture("deployment_without_outputs.json"))
+			Expect(err).NotTo(HaveOccurred())
+			_, err = deployment.Properties.StringOutput("ethereum-rpc-endpoint")
+			Expect(err).To(MatchError("No ethereum-rpc-endpoint in the outputs of deployment"))
+		})
+
+		It("should raise an error without the provisioning state", func() {
+			_, err := ParseDeployment(fixture("deployment_without_state.json"))
+			Expect(err).To(MatchError(ContainSubstring("No provisioningState in deployment")))
+
+			_, err = ParseDeployment([]byte(`{"name": "deployment"}`))
+			Expect(err).To(MatchError("No properties in deployment deployment"))
+		})
+	})
+
+	Describe("ErrorResponse", func() {
+		It("should parse the error envelope", func() {
+			response := ErrorResponse{}
+			Expect(json.Unmarshal(fixture("error_not_found.json"), &response)).To(Succeed())
+			Expect(response.Error.Error()).To(Equal("DeploymentNotFound: Deployment '8f2c1c9e-8a51-4b0e-9f5b-7f0a1e0b6a3d' could not be found."))
+		})
+	})
+})
@@ -0,0 +1,206 @@
+package broker
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// instanceIDPattern is the instance ID in the operation data of older
+// brokers, which was a GUID.
+var instanceIDPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+type OperationState string
+
+const (
+	OperationInProgress OperationState = "InProgress"
+	OperationSucceeded  OperationState = "Succeeded"
+	OperationFailed     OperationState = "Failed"
+	OperationCanceled   OperationState = "Canceled"
+)
+
+// Operation is a long-running operation of ARM, which is followed by the
+// URLs in the Azure-AsyncOperation and Location headers of its response.
+type Operation struct {
+	Kind              string `json:"kind"`
+	AsyncOperationURL string `json:"async_operation_url,omitempty"`
+	LocationURL       string `json:"location_url,omitempty"`
+	RetryAfter        int    `json:"retry_after,omitempty"`
+}
+
+func newOperation(header http.Header) Operation {
+	operation := Operation{
+		AsyncOperationURL: header.Get("Azure-AsyncOperation"),
+		LocationURL:       header.Get("Location"),
+	}
+	operation.RetryAfter, _ = strconv.Atoi(header.Get("Retry-After"))
+	return operation
+}
+
+// Trackable tells whether ARM returned a URL to poll the operation with.
+func (o Operation) Trackable() bool {
+	return o.AsyncOperationURL != "" || o.LocationURL != ""
+}
+
+// OperationData encodes the operation into the operation data handed to the
+// platform, which passes it back to LastOperation.
+func (o Operation) OperationData() string {
+	if !o.Trackable() {
+		return o.Kind
+	}
+	data, _ := json.Marshal(o)
+	return o.Kind + ":" + base64.RawURLEncoding.EncodeToString(data)
+}
+
+// ParseOperationData decodes the operation data returned by OperationData. The
+// data of older brokers, kind:instanceID, gives an operation which is not
+// trackable.
+func ParseOperationData(operationData string) (Operation, error) {
+	parts := strings.SplitN(operationData, ":", 2)
+	kind := parts[0]
+	if kind != "provision" && kind != "update" && kind != "deprovision" {
+		return Operation{}, fmt.Errorf("unrecognized operationData: %s", operationData)
+	}
+	operation := Operation{}
+	if len(parts) == 2 && !instanceIDPattern.MatchString(parts[1]) {
+		data, err := base64.RawURLEncoding.DecodeString(parts[1])
+		if err != nil {
+			return Operation{}, fmt.Errorf("Error in decoding operationData: %v", err)
+		}
+		if err := json.Unmarshal(data, &operation); err != nil {
+			return Operation{}, fmt.Errorf("Error in decoding operationData: %v", err)
+		}
+	}
+	operation.Kind = kind
+	return operation, nil
+}
+
+// operationURL returns the URL to poll the operation with, preferring the
+// Azure-AsyncOperation header to the Location header as ARM recommends. The
+// URL comes back from the platform, so it must point at ARM, which the token
+// is sent to.
+func (c *AzureRESTClient) operationURL(operation Operation) (string, error) {
+	operationURL := operation.AsyncOperationURL
+	if operationURL == "" {
+		operationURL = operation.LocationURL
+	}
+	if operationURL == "" {
+		return "", fmt.Errorf("Operation %s is not trackable", operation.Kind)
+	}
+	endpoint, err := url.Parse(c.environment.ResourceManagerEndpointURL)
+	if err != nil {
+		return "", fmt.Errorf("Invalid resourceManagerEndpointURL: %v", err)
+	}
+	for _, u := range []string{operation.AsyncOperationURL, operation.LocationURL} {
+		if u == "" {
+			continue
+		}
+		parsed, err := url.Parse(u)
+		if err != nil || !strings.EqualFold(parsed.Scheme, endpoint.Scheme) || !strings.EqualFold(parsed.Host, endpoint.Host) {
+			return "", fmt.Errorf("The URL of operation %s does not point at %s", operation.Kind, c.environment.ResourceManagerEndpointURL)
+		}
+	}
+	return operationURL, nil
+}
+
+// ValidateOperation tells whether the operation can be polled: its URLs, if
+// it has any, point at ARM.
+func (c *AzureRESTClient) ValidateOperation(operation Operation) error {
+	if !operation.Trackable() {
+		return nil
+	}
+	_, err := c.operationURL(operation)
+	return err
+}
+
+type OperationError struct {
+	Code    string           `json:"code"`
+	Message string           `json:"message"`
+	Details []OperationError `json:"details,omitempty"`
+}
+
+func (e *OperationError) Error() string {
+	message := e.Message
+	if e.Code != "" {
+		message = e.Code + ": " + message
+	}
+	for _, detail := range e.Details {
+		message += "; " + detail.Error()
+	}
+	return message
+}
+
+// OperationStatus is the state of an operation when it was polled, with the
+// error of a failed operation and how long ARM asks to wait before the next
+// poll.
+type OperationStatus struct {
+	State      OperationState
+	Error      *OperationError
+	RetryAfter time.Duration
+}
+
+// PollOperation gets the status of the operation by its URL, see
+// operationURL.
+func (c *AzureRESTClient) PollOperation(operation Operation) (OperationStatus, error) {
+	operationURL, err := c.operationURL(operation)
+	if err != nil {
+		return OperationStatus{}, err
+	}
+
+	// the URLs carry their own api-version
+	resp, err := c.send(http.MethodGet, operationURL, nil, nil)
+	if err != nil {
+		return OperationStatus{}, err
+	}
+	status := OperationStatus{}
+	if retryAfter, err := strconv.Atoi(resp.Header().Get("Retry-After")); err == nil {
+		status.RetryAfter = time.Duration(retryAfter) * time.Second
+	}
+	statusCode := resp.StatusCode()
+
+	if operation.AsyncOperationURL != "" {
+		if statusCode != http.StatusOK {
+			return OperationStatus{}, armError(statusCode, resp.Body())
+		}
+		apiResponse := struct {
+			Status OperationState  `json:"status"`
+			Error  *OperationError `json:"error"`
+		}{}
+		if err := json.Unmarshal(resp.Body(), &apiResponse); err != nil {
+			return OperationStatus{}, fmt.Errorf("StatusCode: %d - %v\n\t%s", statusCode, resp, err)
+		}
+		switch apiResponse.Status {
+		case OperationSucceeded, OperationFailed, OperationCanceled:
+			status.State = apiResponse.Status
+		default:
+			// e.g. Running or Deleting
+			status.State = OperationInProgress
+		}
+		status.Error = apiResponse.Error
+		return status, nil
+	}
+
+	switch {
+	case statusCode == http.StatusAccepted:
+		status.State = OperationInProgress
+	case statusCode == http.StatusOK || statusCode == http.StatusCreated || statusCode == http.StatusNoContent:
+		status.State = OperationSucceeded
+	case statusCode >= http.StatusBadRequest && statusCode < http.StatusInternalServerError:
+		apiResponse := ErrorResponse{}
+		json.Unmarshal(resp.Body(), &apiResponse)
+		status.State = OperationFailed
+		status.Error = apiResponse.Error
+		if status.Error == nil {
+			status.Error = &OperationError{Code: strconv.Itoa(statusCode), Message: resp.String()}
+		}
+	default:
+		return OperationStatus{}, armError(statusCode, resp.Body())
+	}
+	return status, nil
+}
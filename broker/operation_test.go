@@ -0,0 +1,67 @@
+package broker_test
+
+import (
+	"encoding/base64"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/zeqing-guo/AzureBlockchainBroker/broker"
+)
+
+var _ = Describe("Operation", func() {
+	Describe("OperationData", func() {
+		It("should decode the operation it encodes", func() {
+			operation := Operation{
+				Kind:              "deprovision",
+				AsyncOperationURL: "https://management.azure.com/operations/1?api-version=2016-06-01",
+				LocationURL:       "https://management.azure.com/operationresults/1?api-version=2016-06-01",
+				RetryAfter:        15,
+			}
+			data := operation.OperationData()
+			Expect(data).To(HavePrefix("deprovision:"))
+
+			decoded, err := ParseOperationData(data)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(decoded).To(Equal(operation))
+			Expect(decoded.Trackable()).To(BeTrue())
+		})
+
+		It("should encode an operation without URLs as its kind", func() {
+			operation := Operation{Kind: "provision"}
+			Expect(operation.OperationData()).To(Equal("provision"))
+			Expect(operation.Trackable()).To(BeFalse())
+		})
+
+		It("should accept the operation data of older brokers", func() {
+			operation, err := ParseOperationData("update:8f2c1c9e-8a51-4b0e-9f5b-7f0a1e0b6a3d")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(operation.Kind).To(Equal("update"))
+			Expect(operation.Trackable()).To(BeFalse())
+		})
+
+		It("should raise an error for operation data which it cannot decode", func() {
+			_, err := ParseOperationData("provision:not base64!")
+			Expect(err).To(MatchError(ContainSubstring("Error in decoding operationData")))
+			_, err = ParseOperationData("provision:" + base64.RawURLEncoding.EncodeToString([]byte("not json")))
+			Expect(err).To(MatchError(ContainSubstring("Error in decoding operationData")))
+		})
+
+		It("should raise an error for an unknown kind", func() {
+			_, err := ParseOperationData("bind:instance-id")
+			Expect(err).To(MatchError(ContainSubstring("unrecognized operationData")))
+			_, err = ParseOperationData("")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("OperationError", func() {
+		It("should include the details", func() {
+			err := &OperationError{
+				Code:    "DeploymentFailed",
+				Message: "At least one resource deployment operation failed.",
+				Details: []OperationError{{Code: "Conflict", Message: "The resource already exists."}},
+			}
+			Expect(err.Error()).To(Equal("DeploymentFailed: At least one resource deployment operation failed.; Conflict: The resource already exists."))
+		})
+	})
+})
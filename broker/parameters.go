@@ -0,0 +1,201 @@
+package broker
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ProvisionParameters holds the template parameters which can be overridden
+// per instance with `cf create-service -c`. Nil fields keep the broker defaults.
+type ProvisionParameters struct {
+	EthereumNetworkID       *uint64 `json:"ethereumNetworkID,omitempty"`
+	NumConsortiumMembers    *uint64 `json:"numConsortiumMembers,omitempty"`
+	NumMiningNodesPerMember *uint64 `json:"numMiningNodesPerMember,omitempty"`
+	MNNodeVMSize            *string `json:"mnNodeVMSize,omitempty"`
+	NumTXNodes              *uint64 `json:"numTXNodes,omitempty"`
+	TXNodeVMSize            *string `json:"txNodeVMSize,omitempty"`
+	Location                *string `json:"location,omitempty"`
+	// Template holds the values of any parameters of the template of the
+	// service, e.g. of a network type other than ethereum-consortium
+	Template map[string]interface{} `json:"template,omitempty"`
+}
+
+func ParseProvisionParameters(rawParameters json.RawMessage) (ProvisionParameters, error) {
+	parameters := ProvisionParameters{}
+	if len(bytes.TrimSpace(rawParameters)) == 0 {
+		return parameters, nil
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(rawParameters))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&parameters); err != nil {
+		return ProvisionParameters{}, fmt.Errorf("Invalid parameters: %v", err)
+	}
+	if err := parameters.Validate(); err != nil {
+		return ProvisionParameters{}, err
+	}
+	return parameters, nil
+}
+
+// Validate checks what the template does not declare. The template
+// parameters are validated against the template, see
+// DeploymentClient.ValidateParameters.
+func (p ProvisionParameters) Validate() error {
+	invalid := []string{}
+	if p.Location != nil && strings.TrimSpace(*p.Location) == "" {
+		invalid = append(invalid, "location should not be empty")
+	}
+
+	if len(invalid) > 0 {
+		return errors.New("Invalid parameters: " + strings.Join(invalid, "; "))
+	}
+	return nil
+}
+
+// Merge returns the parameters overridden by the given ones.
+func (p ProvisionParameters) Merge(o ProvisionParameters) ProvisionParameters {
+	if o.EthereumNetworkID != nil {
+		p.EthereumNetworkID = o.EthereumNetworkID
+	}
+	if o.NumConsortiumMembers != nil {
+		p.NumConsortiumMembers = o.NumConsortiumMembers
+	}
+	if o.NumMiningNodesPerMember != nil {
+		p.NumMiningNodesPerMember = o.NumMiningNodesPerMember
+	}
+	if o.MNNodeVMSize != nil {
+		p.MNNodeVMSize = o.MNNodeVMSize
+	}
+	if o.NumTXNodes != nil {
+		p.NumTXNodes = o.NumTXNodes
+	}
+	if o.TXNodeVMSize != nil {
+		p.TXNodeVMSize = o.TXNodeVMSize
+	}
+	if o.Location != nil {
+		p.Location = o.Location
+	}
+	if len(o.Template) > 0 {
+		template := map[string]interface{}{}
+		for name, value := range p.Template {
+			template[name] = value
+		}
+		for name, value := range o.Template {
+			template[name] = value
+		}
+		p.Template = template
+	}
+	return p
+}
+
+// Equal tells whether both parameters set the same values, whatever the
+// representation of the values of the template.
+func (p ProvisionParameters) Equal(o ProvisionParameters) bool {
+	left, err := json.Marshal(p)
+	if err != nil {
+		return false
+	}
+	right, err := json.Marshal(o)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(left, right)
+}
+
+// networkParameters returns the names of the given parameters which only an
+// ethereum-consortium network has.
+func (p ProvisionParameters) networkParameters() []string {
+	names := []string{}
+	if p.EthereumNetworkID != nil {
+		names = append(names, "ethereumNetworkID")
+	}
+	if p.NumConsortiumMembers != nil {
+		names = append(names, "numConsortiumMembers")
+	}
+	if p.NumMiningNodesPerMember != nil {
+		names = append(names, "numMiningNodesPerMember")
+	}
+	if p.MNNodeVMSize != nil {
+		names = append(names, "mnNodeVMSize")
+	}
+	if p.NumTXNodes != nil {
+		names = append(names, "numTXNodes")
+	}
+	if p.TXNodeVMSize != nil {
+		names = append(names, "txNodeVMSize")
+	}
+	return names
+}
+
+// Apply returns a copy of the blockchain configuration with the parameters
+// overridden by the instance.
+func (config BlockchainConfig) Apply(p ProvisionParameters) BlockchainConfig {
+	if p.EthereumNetworkID != nil {
+		config.ethereumNetworkID = *p.EthereumNetworkID
+	}
+	if p.NumConsortiumMembers != nil {
+		config.numConsortiumMembers = *p.NumConsortiumMembers
+	}
+	if p.NumMiningNodesPerMember != nil {
+		config.numMiningNodesPerMember = *p.NumMiningNodesPerMember
+	}
+	if p.MNNodeVMSize != nil {
+		config.mnNodeVMSize = *p.MNNodeVMSize
+	}
+	if p.NumTXNodes != nil {
+		config.numTXNodes = *p.NumTXNodes
+	}
+	if p.TXNodeVMSize != nil {
+		config.txNodeVMSize = *p.TXNodeVMSize
+	}
+	return config
+}
+
+// deployedParameters extracts the overridable parameters from the
+// `properties.parameters` of an existing deployment.
+func deployedParameters(properties DeploymentProperties) ProvisionParameters {
+	parameters := ProvisionParameters{}
+	uint64Value := func(name string) *uint64 {
+		value, ok := properties.Parameters[name].Value.(float64)
+		if !ok || value < 0 {
+			return nil
+		}
+		result := uint64(value)
+		return &result
+	}
+	stringValue := func(name string) *string {
+		value, ok := properties.Parameters[name].Value.(string)
+		if !ok {
+			return nil
+		}
+		return &value
+	}
+
+	parameters.EthereumNetworkID = uint64Value("ethereumNetworkID")
+	parameters.NumConsortiumMembers = uint64Value("numConsortiumMembers")
+	parameters.NumMiningNodesPerMember = uint64Value("numMiningNodesPerMember")
+	parameters.MNNodeVMSize = stringValue("mnNodeVMSize")
+	parameters.NumTXNodes = uint64Value("numTXNodes")
+	parameters.TXNodeVMSize = stringValue("txNodeVMSize")
+	return parameters
+}
+
+// ValidateUpdate checks the parameters which cannot be changed after the
+// network has been deployed.
+func (p ProvisionParameters) ValidateUpdate() error {
+	invalid := []string{}
+	if p.EthereumNetworkID != nil {
+		invalid = append(invalid, "ethereumNetworkID cannot be changed")
+	}
+	if p.Location != nil {
+		invalid = append(invalid, "location cannot be changed")
+	}
+
+	if len(invalid) > 0 {
+		return errors.New("Invalid parameters: " + strings.Join(invalid, "; "))
+	}
+	return nil
+}
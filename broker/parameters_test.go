@@ -0,0 +1,126 @@
+package broker_test
+
+import (
+	"encoding/json"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/zeqing-guo/AzureBlockchainBroker/broker"
+)
+
+var _ = Describe("ProvisionParameters", func() {
+	var (
+		rawParameters json.RawMessage
+		parameters    ProvisionParameters
+		err           error
+	)
+
+	JustBeforeEach(func() {
+		parameters, err = ParseProvisionParameters(rawParameters)
+	})
+
+	Context("Given no parameters", func() {
+		BeforeEach(func() {
+			rawParameters = nil
+		})
+
+		It("should keep the broker defaults", func() {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(parameters).To(Equal(ProvisionParameters{}))
+		})
+	})
+
+	Context("Given valid parameters", func() {
+		BeforeEach(func() {
+			rawParameters = json.RawMessage(`{
+				"numConsortiumMembers": 3,
+				"numMiningNodesPerMember": 2,
+				"mnNodeVMSize": "Standard_D2_v2",
+				"numTXNodes": 2,
+				"txNodeVMSize": "Standard_A2",
+				"ethereumNetworkID": 10101,
+				"location": "westus"
+			}`)
+		})
+
+		It("should parse all of them", func() {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(*parameters.NumConsortiumMembers).To(Equal(uint64(3)))
+			Expect(*parameters.NumMiningNodesPerMember).To(Equal(uint64(2)))
+			Expect(*parameters.MNNodeVMSize).To(Equal("Standard_D2_v2"))
+			Expect(*parameters.NumTXNodes).To(Equal(uint64(2)))
+			Expect(*parameters.TXNodeVMSize).To(Equal("Standard_A2"))
+			Expect(*parameters.EthereumNetworkID).To(Equal(uint64(10101)))
+			Expect(*parameters.Location).To(Equal("westus"))
+		})
+	})
+
+	Context("Given malformed JSON", func() {
+		BeforeEach(func() {
+			rawParameters = json.RawMessage(`{"numTXNodes":`)
+		})
+
+		It("should raise an error", func() {
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("Given an unknown parameter", func() {
+		BeforeEach(func() {
+			rawParameters = json.RawMessage(`{"adminPassword": "secret"}`)
+		})
+
+		It("should raise an error", func() {
+			Expect(err).To(MatchError(ContainSubstring("adminPassword")))
+		})
+	})
+
+	Context("Given a negative number", func() {
+		BeforeEach(func() {
+			rawParameters = json.RawMessage(`{"numTXNodes": -1}`)
+		})
+
+		It("should raise an error", func() {
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("Given an empty location", func() {
+		BeforeEach(func() {
+			rawParameters = json.RawMessage(`{"location": " "}`)
+		})
+
+		It("should raise an error", func() {
+			Expect(err).To(MatchError("Invalid parameters: location should not be empty"))
+		})
+	})
+
+	Describe("ValidateUpdate", func() {
+		It("should allow changing the topology", func() {
+			parameters, err := ParseProvisionParameters(json.RawMessage(`{"numTXNodes": 3, "mnNodeVMSize": "Standard_D2_v2"}`))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(parameters.ValidateUpdate()).To(Succeed())
+		})
+
+		It("should not allow changing the network ID or the location", func() {
+			parameters, err := ParseProvisionParameters(json.RawMessage(`{"ethereumNetworkID": 10101, "location": "westus"}`))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(parameters.ValidateUpdate()).To(MatchError("Invalid parameters: ethereumNetworkID cannot be changed; location cannot be changed"))
+		})
+	})
+
+	Describe("Equal", func() {
+		It("should compare the values, not their order or their representation", func() {
+			parameters, err := ParseProvisionParameters(json.RawMessage(`{"numTXNodes": 3, "template": {"a": 1, "b": "x"}}`))
+			Expect(err).NotTo(HaveOccurred())
+			same, err := ParseProvisionParameters(json.RawMessage(`{"template": {"b": "x", "a": 1.0}, "numTXNodes": 3}`))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(parameters.Equal(same)).To(BeTrue())
+
+			other, err := ParseProvisionParameters(json.RawMessage(`{"numTXNodes": 4, "template": {"a": 1, "b": "x"}}`))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(parameters.Equal(other)).To(BeFalse())
+			Expect(ProvisionParameters{}.Equal(ProvisionParameters{Template: map[string]interface{}{}})).To(BeTrue())
+		})
+	})
+})
@@ -0,0 +1,158 @@
+package broker
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// how long a what-if is polled before the broker gives up on it
+	whatIfTimeout = time.Minute
+	// how long a what-if is polled during a provision, which the platform
+	// times out after 60 seconds
+	provisionWhatIfTimeout = 5 * time.Second
+	// the wait between the polls of a what-if without Retry-After
+	whatIfPollInterval = time.Second
+)
+
+// ValidationError is the refusal of ARM to deploy a template, e.g. because
+// its parameters are invalid, the subscription lacks quota or a policy
+// forbids a resource. It is returned before anything is deployed.
+type ValidationError struct {
+	Err *OperationError
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("The deployment failed the validation of Azure: %v", e.Err)
+}
+
+// whatIfTimeoutError is a what-if which did not finish in time.
+type whatIfTimeoutError struct {
+	deploymentName string
+	timeout        time.Duration
+}
+
+func (e *whatIfTimeoutError) Error() string {
+	return fmt.Sprintf("What-if of deployment %s did not finish within %s", e.deploymentName, e.timeout)
+}
+
+// WhatIfChange is a change which a deployment would make to a resource.
+type WhatIfChange struct {
+	ResourceID string `json:"resourceId"`
+	// ChangeType is Create, Delete, Ignore, Deploy, NoChange or Modify
+	ChangeType string `json:"changeType"`
+}
+
+// WhatIfResult is the result of a what-if operation.
+type WhatIfResult struct {
+	Status     string `json:"status"`
+	Properties *struct {
+		Changes []WhatIfChange `json:"changes"`
+	} `json:"properties,omitempty"`
+	Error *OperationError `json:"error,omitempty"`
+}
+
+func (c *AzureRESTClient) deploymentURL(scope Scope) string {
+	return fmt.Sprintf("%s/subscriptions/%s/resourceGroups/%s/providers/%s/%s/%s",
+		c.environment.ResourceManagerEndpointURL,
+		scope.SubscriptionID,
+		scope.ResourceGroupName,
+		restAPIProvider,
+		restAPIDeployments,
+		scope.DeploymentName,
+	)
+}
+
+// ValidateDeployment asks ARM whether the deployment would be accepted,
+// without deploying it. The resource group must exist. A refusal of ARM is
+// a *ValidationError.
+func (c *AzureRESTClient) ValidateDeployment(scope Scope, template *map[string]interface{}, templateLink *Link, parameters *map[string]interface{}) error {
+	queries := map[string]string{
+		"api-version": c.environment.APIVersions.Template,
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"properties": deploymentProperties(template, templateLink, parameters, nil),
+	})
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.send(http.MethodPost, c.deploymentURL(scope)+"/validate", queries, body)
+	if err != nil {
+		return err
+	}
+	statusCode := resp.StatusCode()
+	// older versions of the API answer a refusal with 200 and its error
+	if statusCode == http.StatusOK || statusCode == http.StatusBadRequest {
+		result := struct {
+			Error *OperationError `json:"error"`
+		}{}
+		if err := json.Unmarshal(resp.Body(), &result); err == nil && result.Error != nil {
+			return &ValidationError{Err: result.Error}
+		}
+		if statusCode == http.StatusOK {
+			return nil
+		}
+	}
+	return armError(statusCode, resp.Body())
+}
+
+// WhatIf returns the changes which the deployment would make to the
+// resource group, without deploying it. A refusal of ARM is a
+// *ValidationError. The result is polled for up to the timeout.
+func (c *AzureRESTClient) WhatIf(scope Scope, template *map[string]interface{}, templateLink *Link, parameters *map[string]interface{}, timeout time.Duration) ([]WhatIfChange, error) {
+	if c.environment.APIVersions.WhatIf == "" {
+		return nil, fmt.Errorf("What-if is not supported in the environment %s", c.cloudConfig.Azure.Environment)
+	}
+	queries := map[string]string{
+		"api-version": c.environment.APIVersions.WhatIf,
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"properties": deploymentProperties(template, templateLink, parameters, nil),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.send(http.MethodPost, c.deploymentURL(scope)+"/whatIf", queries, body)
+	deadline := time.Now().Add(timeout)
+	// the result is polled at the Location of the operation, which carries
+	// its own api-version
+	for err == nil && resp.StatusCode() == http.StatusAccepted {
+		location := resp.Header().Get("Location")
+		if location == "" {
+			return nil, fmt.Errorf("No Location in the response of what-if of deployment %s", scope.DeploymentName)
+		}
+		wait := whatIfPollInterval
+		if retryAfter, err := strconv.Atoi(resp.Header().Get("Retry-After")); err == nil {
+			wait = time.Duration(retryAfter) * time.Second
+		}
+		if time.Now().Add(wait).After(deadline) {
+			return nil, &whatIfTimeoutError{deploymentName: scope.DeploymentName, timeout: timeout}
+		}
+		time.Sleep(wait)
+		resp, err = c.send(http.MethodGet, location, nil, nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	statusCode := resp.StatusCode()
+	if statusCode != http.StatusOK && statusCode != http.StatusBadRequest {
+		return nil, armError(statusCode, resp.Body())
+	}
+	result := WhatIfResult{}
+	if err := json.Unmarshal(resp.Body(), &result); err != nil {
+		return nil, fmt.Errorf("Error in parse what-if result: %v", err)
+	}
+	if result.Error != nil {
+		return nil, &ValidationError{Err: result.Error}
+	}
+	if statusCode != http.StatusOK || result.Properties == nil {
+		return nil, armError(statusCode, resp.Body())
+	}
+	return result.Properties.Changes, nil
+}
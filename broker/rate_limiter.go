@@ -0,0 +1,177 @@
+package broker
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	resty "gopkg.in/resty.v0"
+)
+
+const (
+	headerRemainingReads  = "x-ms-ratelimit-remaining-subscription-reads"
+	headerRemainingWrites = "x-ms-ratelimit-remaining-subscription-writes"
+)
+
+var subscriptionInURL = regexp.MustCompile(`(?i)/subscriptions/([^/?]+)`)
+
+// RateBudget is what ARM last reported of the rate limits of a
+// subscription. The remaining requests are -1 until ARM reports them.
+type RateBudget struct {
+	RemainingReads  int       `json:"remaining_reads"`
+	RemainingWrites int       `json:"remaining_writes"`
+	QueuedWrites    int       `json:"queued_writes"`
+	ThrottledUntil  time.Time `json:"throttled_until"`
+	UpdatedAt       time.Time `json:"updated_at"`
+}
+
+type subscriptionLimit struct {
+	budget RateBudget
+	// nextWrite is the time of the last write reserved, which the next
+	// write is paced from
+	nextWrite time.Time
+}
+
+// rateLimiter paces the requests to ARM by subscription, which may be shared
+// with other brokers and tools. It slows down as the remaining requests
+// reported by ARM approach 0, and holds every request of a subscription
+// which ARM throttled until its Retry-After.
+type rateLimiter struct {
+	logger        lager.Logger
+	config        HTTPConfig
+	mutex         sync.Mutex
+	subscriptions map[string]*subscriptionLimit
+}
+
+func newRateLimiter(logger lager.Logger, config HTTPConfig) *rateLimiter {
+	return &rateLimiter{
+		logger:        logger.Session("rate-limiter"),
+		config:        config,
+		subscriptions: map[string]*subscriptionLimit{},
+	}
+}
+
+func (l *rateLimiter) subscription(hostURL string) (string, *subscriptionLimit) {
+	subscriptionID := ""
+	if match := subscriptionInURL.FindStringSubmatch(hostURL); match != nil {
+		subscriptionID = match[1]
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	limit, ok := l.subscriptions[subscriptionID]
+	if !ok {
+		limit = &subscriptionLimit{budget: RateBudget{RemainingReads: -1, RemainingWrites: -1}}
+		l.subscriptions[subscriptionID] = limit
+	}
+	return subscriptionID, limit
+}
+
+// acquire waits until the request may be sent, and returns the function to
+// call with its response. The attempt is the number of the retry of the
+// request, which the wait after a throttled response without Retry-After
+// grows with.
+func (l *rateLimiter) acquire(method, hostURL string, attempt int) func(*resty.Response) {
+	subscriptionID, limit := l.subscription(hostURL)
+	write := method != http.MethodGet && method != http.MethodHead
+
+	if wait := l.reserve(limit, write); wait > 0 {
+		l.logger.Info("wait", lager.Data{"subscriptionID": subscriptionID, "method": method, "wait": wait.String()})
+		time.Sleep(wait)
+	}
+	if write {
+		l.mutex.Lock()
+		limit.budget.QueuedWrites--
+		l.mutex.Unlock()
+	}
+
+	return func(resp *resty.Response) {
+		if resp != nil {
+			l.update(subscriptionID, limit, resp, attempt)
+		}
+	}
+}
+
+// reserve returns how long to hold a request: until the end of the
+// throttling, and longer as the remaining requests fall below the threshold.
+// The writes are paced one after the other, so each one reserves its slot
+// after the writes reserved before it.
+func (l *rateLimiter) reserve(limit *subscriptionLimit, write bool) time.Duration {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := time.Now()
+	start := now
+	if limit.budget.ThrottledUntil.After(start) {
+		start = limit.budget.ThrottledUntil
+	}
+	remaining := limit.budget.RemainingReads
+	if write {
+		remaining = limit.budget.RemainingWrites
+	}
+	delay := time.Duration(0)
+	threshold := l.config.RateLimitThreshold
+	if remaining >= 0 && remaining < threshold {
+		delay = l.config.RateLimitMaxDelay * time.Duration(threshold-remaining) / time.Duration(threshold)
+	}
+	if write {
+		if delay > 0 && limit.nextWrite.After(start) {
+			start = limit.nextWrite
+		}
+		limit.nextWrite = start.Add(delay)
+		limit.budget.QueuedWrites++
+	}
+	return start.Add(delay).Sub(now)
+}
+
+func (l *rateLimiter) update(subscriptionID string, limit *subscriptionLimit, resp *resty.Response, attempt int) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	budget := &limit.budget
+	now := time.Now()
+	if reads, err := strconv.Atoi(resp.Header().Get(headerRemainingReads)); err == nil {
+		budget.RemainingReads = reads
+		budget.UpdatedAt = now
+	}
+	if writes, err := strconv.Atoi(resp.Header().Get(headerRemainingWrites)); err == nil {
+		budget.RemainingWrites = writes
+		budget.UpdatedAt = now
+	}
+	threshold := l.config.RateLimitThreshold
+	if (budget.RemainingReads >= 0 && budget.RemainingReads < threshold) || (budget.RemainingWrites >= 0 && budget.RemainingWrites < threshold) {
+		l.logger.Info("approaching-limit", lager.Data{"subscriptionID": subscriptionID, "budget": *budget})
+	}
+	if resp.StatusCode() == http.StatusTooManyRequests {
+		budget.ThrottledUntil = now.Add(retryWait(l.config, attempt, resp))
+		budget.UpdatedAt = now
+		l.logger.Info("throttled", lager.Data{"subscriptionID": subscriptionID, "budget": *budget})
+	}
+}
+
+// Budgets returns the rate budget of every subscription by its ID.
+func (l *rateLimiter) Budgets() map[string]RateBudget {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	budgets := map[string]RateBudget{}
+	for subscriptionID, limit := range l.subscriptions {
+		budgets[subscriptionID] = limit.budget
+	}
+	return budgets
+}
+
+// RateBudgets returns what ARM last reported of the rate limits of every
+// subscription which the client sent requests to.
+func (c *AzureRESTClient) RateBudgets() map[string]RateBudget {
+	return c.rateLimiter.Budgets()
+}
+
+// RateLimitHandler serves the rate budgets as JSON, e.g. on the debug
+// server.
+func (c *AzureRESTClient) RateLimitHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", contentTypeJSON)
+		json.NewEncoder(w).Encode(c.RateBudgets())
+	})
+}
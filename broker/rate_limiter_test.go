@@ -0,0 +1,158 @@
+package broker_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager/lagertest"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/zeqing-guo/AzureBlockchainBroker/broker"
+	"github.com/zeqing-guo/AzureBlockchainBroker/fakeazure"
+)
+
+var _ = Describe("RateLimiter", func() {
+	var (
+		server     *fakeazure.Server
+		config     fakeazure.Config
+		httpConfig HTTPConfig
+		client     *AzureRESTClient
+		scope      Scope
+	)
+
+	BeforeEach(func() {
+		config = fakeazure.Config{}
+		httpConfig = *NewHTTPConfig(0, "", "", 0, time.Millisecond, 5*time.Millisecond, 100, 200*time.Millisecond)
+		scope = Scope{SubscriptionID: "subscription-id", ResourceGroupName: "group", Location: "westus"}
+	})
+
+	JustBeforeEach(func() {
+		server = fakeazure.NewServer(config)
+		azureConfig := *NewAzureConfig(AzureCloud, "tenant-id", "client-id", "client-secret")
+		var err error
+		client, err = NewAzureResourceAccountRESTClient(lagertest.NewTestLogger("rate-limiter"), *NewCloudConfig(azureConfig, AzureStackConfig{}, server.Endpoints(), CredentialConfig{}, httpConfig))
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	timed := func(f func()) time.Duration {
+		start := time.Now()
+		f()
+		return time.Since(start)
+	}
+
+	It("should record the remaining requests of the subscription", func() {
+		Expect(client.RateBudgets()).To(BeEmpty())
+		server.RateLimits(11999, 1199)
+		_, err := client.CheckResourceStatus(scope)
+		Expect(err).NotTo(HaveOccurred())
+
+		budget := client.RateBudgets()["subscription-id"]
+		Expect(budget.RemainingReads).To(Equal(11999))
+		Expect(budget.RemainingWrites).To(Equal(1199))
+
+		recorder := httptest.NewRecorder()
+		client.RateLimitHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/rate-limits", nil))
+		budgets := map[string]RateBudget{}
+		Expect(json.Unmarshal(recorder.Body.Bytes(), &budgets)).To(Succeed())
+		Expect(budgets).To(HaveKey("subscription-id"))
+		Expect(budgets["subscription-id"].RemainingReads).To(Equal(11999))
+	})
+
+	It("should slow down as the remaining requests approach the limit", func() {
+		server.RateLimits(0, 1199)
+		_, err := client.CheckResourceStatus(scope)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(timed(func() {
+			_, err = client.CheckResourceStatus(scope)
+			Expect(err).NotTo(HaveOccurred())
+		})).To(BeNumerically(">=", 200*time.Millisecond))
+
+		// the writes still have budget
+		Expect(timed(func() {
+			_, err = client.CreateGroup(scope, nil)
+			Expect(err).NotTo(HaveOccurred())
+		})).To(BeNumerically("<", 100*time.Millisecond))
+	})
+
+	Context("when ARM throttles the subscription", func() {
+		BeforeEach(func() {
+			config.RetryAfter = 1
+		})
+
+		It("should hold the requests until the Retry-After", func() {
+			server.Throttle(1)
+			_, err := client.CheckResourceStatus(scope)
+			Expect(err).To(MatchError(ContainSubstring("Error Code: 429")))
+			Expect(client.RateBudgets()["subscription-id"].ThrottledUntil).To(BeTemporally(">", time.Now()))
+
+			Expect(timed(func() {
+				_, err = client.CheckResourceStatus(scope)
+				Expect(err).NotTo(HaveOccurred())
+			})).To(BeNumerically(">=", 900*time.Millisecond))
+		})
+	})
+
+	Context("when ARM throttles a request which is retried", func() {
+		BeforeEach(func() {
+			config.RetryAfter = 1
+			httpConfig.RetryCount = 1
+		})
+
+		It("should wait for the Retry-After once", func() {
+			server.Throttle(1)
+			elapsed := timed(func() {
+				_, err := client.CheckResourceStatus(scope)
+				Expect(err).NotTo(HaveOccurred())
+			})
+			Expect(elapsed).To(BeNumerically(">=", 900*time.Millisecond))
+			Expect(elapsed).To(BeNumerically("<", 1500*time.Millisecond))
+		})
+	})
+
+	Context("with latency", func() {
+		BeforeEach(func() {
+			config.Latency = 100 * time.Millisecond
+		})
+
+		writes := func(n int) time.Duration {
+			return timed(func() {
+				var wg sync.WaitGroup
+				for i := 0; i < n; i++ {
+					wg.Add(1)
+					go func() {
+						defer GinkgoRecover()
+						defer wg.Done()
+						_, err := client.CreateGroup(scope, nil)
+						Expect(err).NotTo(HaveOccurred())
+					}()
+				}
+				wg.Wait()
+			})
+		}
+
+		It("should send the writes in parallel while the budget lasts", func() {
+			// the first request gets the token
+			_, err := client.CheckResourceStatus(scope)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(writes(3)).To(BeNumerically("<", 200*time.Millisecond))
+		})
+
+		It("should pace the writes as the budget runs low", func() {
+			server.RateLimits(11999, 50)
+			_, err := client.CheckResourceStatus(scope)
+			Expect(err).NotTo(HaveOccurred())
+
+			// every write waits 100ms after the one before it
+			Expect(writes(3)).To(BeNumerically(">=", 300*time.Millisecond))
+		})
+	})
+})
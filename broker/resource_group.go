@@ -0,0 +1,90 @@
+package broker
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Version is the version of the broker, set at build time with
+// -ldflags "-X github.com/zeqing-guo/AzureBlockchainBroker/broker.Version=<version>".
+var Version = "dev"
+
+// The tags of the resource group of an instance
+const (
+	TagInstanceID       = "blockchain-broker-instance-id"
+	TagOrganizationGUID = "blockchain-broker-organization-guid"
+	TagSpaceGUID        = "blockchain-broker-space-guid"
+	TagPlanID           = "blockchain-broker-plan-id"
+	TagBrokerVersion    = "blockchain-broker-version"
+)
+
+var resourceGroupNamePattern = regexp.MustCompile(`^[-\w.()]{1,90}$`)
+
+var repeatedHyphens = regexp.MustCompile(`-{2,}`)
+
+func validResourceGroupName(name string) bool {
+	return resourceGroupNamePattern.MatchString(name) && !strings.HasSuffix(name, ".")
+}
+
+// GroupConflictError is a resource group which exists with the name of the
+// group of an instance, but which the broker did not create for it.
+type GroupConflictError struct {
+	ResourceGroupName string
+}
+
+func (e *GroupConflictError) Error() string {
+	return fmt.Sprintf("The resource group %s exists and was not created by the broker for the instance", e.ResourceGroupName)
+}
+
+// GroupDeletingError is the resource group of an instance which is being
+// deleted, so it can be deployed into only once it is gone.
+type GroupDeletingError struct {
+	ResourceGroupName string
+}
+
+func (e *GroupDeletingError) Error() string {
+	return fmt.Sprintf("The resource group %s is being deleted, please retry later", e.ResourceGroupName)
+}
+
+// ResourceGroupName returns the name of the resource group of an instance.
+// {id} is the instance ID, {shortid}, {org} and {space} the first 8
+// characters of the instance ID, of the organization GUID and of the space
+// GUID. The hyphens around an empty placeholder are collapsed.
+func (config *ResourceGroupConfig) ResourceGroupName(instanceID, organizationGUID, spaceGUID string) string {
+	if config.NameFormat == "" {
+		return instanceID
+	}
+	name := strings.NewReplacer(
+		"{prefix}", config.Prefix,
+		"{id}", instanceID,
+		"{shortid}", short(instanceID),
+		"{org}", short(organizationGUID),
+		"{space}", short(spaceGUID),
+	).Replace(config.NameFormat)
+	return strings.Trim(repeatedHyphens.ReplaceAllString(name, "-"), "-")
+}
+
+func short(guid string) string {
+	if len(guid) > 8 {
+		return guid[:8]
+	}
+	return guid
+}
+
+// resourceGroupTags returns the tags of the resource group of the instance,
+// which tell the instance it was created for.
+func resourceGroupTags(instance InstanceRecord) map[string]string {
+	tags := map[string]string{
+		TagInstanceID:    instance.InstanceID,
+		TagPlanID:        instance.PlanID,
+		TagBrokerVersion: Version,
+	}
+	if instance.OrganizationGUID != "" {
+		tags[TagOrganizationGUID] = instance.OrganizationGUID
+	}
+	if instance.SpaceGUID != "" {
+		tags[TagSpaceGUID] = instance.SpaceGUID
+	}
+	return tags
+}
@@ -0,0 +1,209 @@
+package broker
+
+import (
+	"fmt"
+	"strings"
+
+	resty "gopkg.in/resty.v0"
+)
+
+// The network types which the services of the catalog can deploy.
+const (
+	NetworkEthereumConsortium = "ethereum-consortium"
+	NetworkHyperledgerFabric  = "hyperledger-fabric"
+)
+
+// OutputNames are the names of the outputs of a template which hold the URLs
+// of the admin site and the RPC endpoint of the network.
+type OutputNames struct {
+	AdminSite   string `json:"adminSite,omitempty"`
+	RPCEndpoint string `json:"rpcEndpoint,omitempty"`
+}
+
+// NetworkType is a kind of blockchain network. It maps the blockchain
+// configuration of an instance to the parameters of its template, and tells
+// which outputs of the deployment the bindings get.
+type NetworkType interface {
+	// TemplateParameters returns the values of the template parameters which
+	// come from the blockchain configuration. The parameters of the plan and
+	// of the instance are added to them.
+	TemplateParameters(blockchainConfig BlockchainConfig) map[string]interface{}
+	// Outputs returns the default names of the outputs of the template.
+	Outputs() OutputNames
+	// Ethereum tells whether the network serves the Ethereum JSON-RPC, so
+	// every binding gets an Ethereum account.
+	Ethereum() bool
+}
+
+var networkTypes = map[string]NetworkType{
+	NetworkEthereumConsortium: consortiumNetwork{},
+	NetworkHyperledgerFabric:  fabricNetwork{},
+}
+
+var ethereumOutputs = OutputNames{AdminSite: outputAdminSite, RPCEndpoint: outputEthereumRPCEndpoint}
+
+// consortiumNetwork is the Ethereum consortium network, whose template
+// parameters are the blockchain configuration of the broker.
+type consortiumNetwork struct{}
+
+func (consortiumNetwork) TemplateParameters(blockchainConfig BlockchainConfig) map[string]interface{} {
+	return blockchainParameters(blockchainConfig)
+}
+
+func (consortiumNetwork) Outputs() OutputNames { return ethereumOutputs }
+
+func (consortiumNetwork) Ethereum() bool { return true }
+
+// fabricNetwork is a Hyperledger Fabric network. Its template only shares
+// the naming and the administrator of the VMs with the blockchain
+// configuration; its topology is given by the template parameters of the
+// plans and the instances. It serves no RPC endpoint, only the API of the
+// network.
+type fabricNetwork struct{}
+
+func (fabricNetwork) TemplateParameters(blockchainConfig BlockchainConfig) map[string]interface{} {
+	return map[string]interface{}{
+		"namePrefix":    blockchainConfig.namePrefix,
+		"adminUsername": blockchainConfig.adminUsername,
+		"adminPassword": blockchainConfig.adminPassword,
+	}
+}
+
+func (fabricNetwork) Outputs() OutputNames { return OutputNames{AdminSite: outputFabricAPIEndpoint} }
+
+func (fabricNetwork) Ethereum() bool { return false }
+
+// Service is a service offering of the broker: a network type, the ARM
+// template which deploys it and the plans of the service.
+type Service struct {
+	ID          string   `json:"id"`
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Tags        []string `json:"tags,omitempty"`
+	NetworkType string   `json:"networkType"`
+	// the template of an ethereum-consortium service defaults to the template
+	// of the broker
+	TemplatePath   string      `json:"templatePath,omitempty"`
+	TemplateURL    string      `json:"templateURL,omitempty"`
+	TemplateSHA256 string      `json:"templateSHA256,omitempty"`
+	Outputs        OutputNames `json:"outputs"`
+	Plans          []Plan      `json:"plans"`
+
+	template *Template
+}
+
+func (s *Service) templateConfig() *TemplateConfig {
+	return NewTemplateConfig(s.TemplatePath, s.TemplateURL, s.TemplateSHA256)
+}
+
+func (s *Service) networkType() NetworkType {
+	return networkTypes[s.NetworkType]
+}
+
+// Validate checks the service, but not its plans.
+func (s *Service) Validate() error {
+	if _, ok := networkTypes[s.NetworkType]; !ok {
+		return fmt.Errorf("Unsupported networkType: %s", s.NetworkType)
+	}
+	config := s.templateConfig()
+	if err := config.Validate(); err != nil {
+		return err
+	}
+	if s.NetworkType != NetworkEthereumConsortium && config.Path == "" && config.URL == "" {
+		return fmt.Errorf("Missing required parameters when 'networkType' is '%s': templatePath or templateURL", s.NetworkType)
+	}
+	return nil
+}
+
+// LoadTemplate loads the template of the service if it has its own.
+func (s *Service) LoadTemplate(client *resty.Client) error {
+	template, err := LoadTemplate(client, *s.templateConfig())
+	if err != nil {
+		return err
+	}
+	if template != nil {
+		s.template = template
+	}
+	return nil
+}
+
+// FindPlan returns the plan of the service with the ID.
+func (s *Service) FindPlan(planID string) (Plan, bool) {
+	for _, plan := range s.Plans {
+		if plan.ID == planID {
+			return plan, true
+		}
+	}
+	return Plan{}, false
+}
+
+// ValidateProvisionParameters checks that the parameters of a plan or an
+// instance apply to the network type of the service.
+func (s *Service) ValidateProvisionParameters(parameters ProvisionParameters) error {
+	// the broker sets the parameters of the consortium template itself, and
+	// relies on them, e.g. on the password of the default account
+	if s.NetworkType == NetworkEthereumConsortium {
+		if len(parameters.Template) > 0 {
+			return fmt.Errorf("Invalid parameters: template does not apply to %s services, their parameters are given by name", NetworkEthereumConsortium)
+		}
+		return nil
+	}
+	if names := parameters.networkParameters(); len(names) > 0 {
+		return fmt.Errorf("Invalid parameters: %s only apply to %s services, the parameters of the template are given in template", strings.Join(names, ", "), NetworkEthereumConsortium)
+	}
+	return nil
+}
+
+// TemplateParameters returns the values of the template parameters of an
+// instance: those of the blockchain configuration, overridden by those of
+// the given maps in order. The values of the blockchain configuration are
+// only given to the parameters which the template of a service other than
+// an ethereum-consortium one declares.
+func (s *Service) TemplateParameters(blockchainConfig BlockchainConfig, overrides ...map[string]interface{}) map[string]interface{} {
+	values := s.networkType().TemplateParameters(blockchainConfig)
+	if s.NetworkType != NetworkEthereumConsortium {
+		for name := range values {
+			if _, ok := s.template.Parameters[name]; !ok {
+				delete(values, name)
+			}
+		}
+	}
+	for _, override := range overrides {
+		for name, value := range override {
+			values[name] = value
+		}
+	}
+	return values
+}
+
+// ValidateParameters checks the values of the template parameters against
+// the parameters of the template, before deploying it.
+func (s *Service) ValidateParameters(values map[string]interface{}) error {
+	return s.template.Parameters.Validate(values)
+}
+
+// TemplateVersion returns the content version and the SHA-256 of the
+// template of the service.
+func (s *Service) TemplateVersion() (version string, sha256 string) {
+	return s.template.Version, s.template.SHA256
+}
+
+// Endpoints returns the URLs of the admin site and the RPC endpoint in the
+// outputs of a deployment.
+func (s *Service) Endpoints(outputs map[string]interface{}) (adminSiteURL string, rpcURL string) {
+	names := s.outputNames()
+	adminSiteURL, _ = outputs[names.AdminSite].(string)
+	rpcURL, _ = outputs[names.RPCEndpoint].(string)
+	return adminSiteURL, rpcURL
+}
+
+func (s *Service) outputNames() OutputNames {
+	names := s.networkType().Outputs()
+	if s.Outputs.AdminSite != "" {
+		names.AdminSite = s.Outputs.AdminSite
+	}
+	if s.Outputs.RPCEndpoint != "" {
+		names.RPCEndpoint = s.Outputs.RPCEndpoint
+	}
+	return names
+}
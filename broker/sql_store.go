@@ -0,0 +1,182 @@
+package broker
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// The statements only use syntax shared by MySQL and SQLite.
+var sqlStoreSchema = []string{
+	`CREATE TABLE IF NOT EXISTS service_instances (
+		instance_id VARCHAR(255) NOT NULL PRIMARY KEY,
+		plan_id VARCHAR(255) NOT NULL,
+		resource_group_name VARCHAR(255) NOT NULL,
+		deployment_name VARCHAR(255) NOT NULL,
+		created_at VARCHAR(64) NOT NULL,
+		record TEXT NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS service_bindings (
+		instance_id VARCHAR(255) NOT NULL,
+		binding_id VARCHAR(255) NOT NULL,
+		created_at VARCHAR(64) NOT NULL,
+		record TEXT NOT NULL,
+		PRIMARY KEY (instance_id, binding_id)
+	)`,
+}
+
+// SQLStore keeps the records in a SQL database. The driver, e.g. mysql or
+// sqlite3, has to be registered by the caller.
+type SQLStore struct {
+	db *sql.DB
+}
+
+func NewSQLStore(driverName, dataSourceName string) (*SQLStore, error) {
+	db, err := sql.Open(driverName, dataSourceName)
+	if err != nil {
+		return nil, fmt.Errorf("Error in open database: %v", err)
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("Error in connect database: %v", err)
+	}
+	for _, statement := range sqlStoreSchema {
+		if _, err := db.Exec(statement); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("Error in create tables: %v", err)
+		}
+	}
+	return &SQLStore{db: db}, nil
+}
+
+func (s *SQLStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *SQLStore) GetInstance(instanceID string) (InstanceRecord, error) {
+	var record string
+	err := s.db.QueryRow("SELECT record FROM service_instances WHERE instance_id = ?", instanceID).Scan(&record)
+	if err == sql.ErrNoRows {
+		return InstanceRecord{}, ErrRecordNotFound
+	}
+	if err != nil {
+		return InstanceRecord{}, err
+	}
+	instance := InstanceRecord{}
+	if err := json.Unmarshal([]byte(record), &instance); err != nil {
+		return InstanceRecord{}, fmt.Errorf("Error in parse instance %s: %v", instanceID, err)
+	}
+
+	rows, err := s.db.Query("SELECT record FROM service_bindings WHERE instance_id = ?", instanceID)
+	if err != nil {
+		return InstanceRecord{}, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if err := rows.Scan(&record); err != nil {
+			return InstanceRecord{}, err
+		}
+		binding := BindingRecord{}
+		if err := json.Unmarshal([]byte(record), &binding); err != nil {
+			return InstanceRecord{}, fmt.Errorf("Error in parse binding of instance %s: %v", instanceID, err)
+		}
+		if instance.Bindings == nil {
+			instance.Bindings = map[string]BindingRecord{}
+		}
+		instance.Bindings[binding.BindingID] = binding
+	}
+	return instance, rows.Err()
+}
+
+func (s *SQLStore) ListInstances() ([]InstanceRecord, error) {
+	rows, err := s.db.Query("SELECT instance_id, record FROM service_instances")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	instances := []InstanceRecord{}
+	for rows.Next() {
+		var instanceID, record string
+		if err := rows.Scan(&instanceID, &record); err != nil {
+			return nil, err
+		}
+		instance := InstanceRecord{}
+		if err := json.Unmarshal([]byte(record), &instance); err != nil {
+			return nil, fmt.Errorf("Error in parse instance %s: %v", instanceID, err)
+		}
+		instances = append(instances, instance)
+	}
+	return instances, rows.Err()
+}
+
+func (s *SQLStore) PutInstance(instance InstanceRecord) error {
+	instance.Bindings = nil
+	record, err := json.Marshal(instance)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(
+		"REPLACE INTO service_instances (instance_id, plan_id, resource_group_name, deployment_name, created_at, record) VALUES (?, ?, ?, ?, ?, ?)",
+		instance.InstanceID,
+		instance.PlanID,
+		instance.ResourceGroupName,
+		instance.DeploymentName,
+		instance.CreatedAt.UTC().Format(time.RFC3339),
+		string(record),
+	)
+	return err
+}
+
+func (s *SQLStore) DeleteInstance(instanceID string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM service_bindings WHERE instance_id = ?", instanceID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM service_instances WHERE instance_id = ?", instanceID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *SQLStore) PutBinding(instanceID string, binding BindingRecord) error {
+	var count int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM service_instances WHERE instance_id = ?", instanceID).Scan(&count); err != nil {
+		return err
+	}
+	if count == 0 {
+		return ErrRecordNotFound
+	}
+	record, err := json.Marshal(binding)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(
+		"REPLACE INTO service_bindings (instance_id, binding_id, created_at, record) VALUES (?, ?, ?, ?)",
+		instanceID,
+		binding.BindingID,
+		binding.CreatedAt.UTC().Format(time.RFC3339),
+		string(record),
+	)
+	return err
+}
+
+func (s *SQLStore) DeleteBinding(instanceID string, bindingID string) error {
+	result, err := s.db.Exec("DELETE FROM service_bindings WHERE instance_id = ? AND binding_id = ?", instanceID, bindingID)
+	if err != nil {
+		return err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
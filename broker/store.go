@@ -0,0 +1,81 @@
+package broker
+
+import (
+	"errors"
+	"time"
+)
+
+type InstanceState string
+
+const (
+	StateProvisioning   InstanceState = "provisioning"
+	StateUpdating       InstanceState = "updating"
+	StateSucceeded      InstanceState = "succeeded"
+	StateFailed         InstanceState = "failed"
+	StateDeprovisioning InstanceState = "deprovisioning"
+)
+
+var ErrRecordNotFound = errors.New("record not found")
+
+// BindingRecord is a binding and the address of its Ethereum account. The
+// private key of the account is never recorded.
+type BindingRecord struct {
+	BindingID string    `json:"binding_id"`
+	AppGUID   string    `json:"app_guid"`
+	Address   string    `json:"address,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// CleanupRecord is the deletion of the resource group of a failed provision.
+type CleanupRecord struct {
+	// After is when the grace period of the failed resources ends
+	After time.Time `json:"after"`
+	// Operation is the deletion of the group once it has started
+	Operation *Operation `json:"operation,omitempty"`
+	Done      bool       `json:"done,omitempty"`
+}
+
+// InstanceRecord is what the broker knows about a provisioned instance, so
+// it can answer without querying Azure and survive restarts. TemplateVersion
+// and TemplateSHA256 identify the template which was deployed last.
+// GroupCreated tells whether the broker created the resource group, which it
+// only cleans up then, and Failure describes why the last operation failed.
+// FailedOperation is the kind of the operation which failed, as only a
+// failed provision may be provisioned again.
+// OperationData is the operation of the provision, which is handed again to
+// a provision of the same instance while it is in progress.
+type InstanceRecord struct {
+	InstanceID        string                   `json:"instance_id"`
+	ServiceID         string                   `json:"service_id"`
+	PlanID            string                   `json:"plan_id"`
+	OrganizationGUID  string                   `json:"organization_guid,omitempty"`
+	SpaceGUID         string                   `json:"space_guid,omitempty"`
+	Parameters        ProvisionParameters      `json:"parameters"`
+	DeploymentName    string                   `json:"deployment_name"`
+	ResourceGroupName string                   `json:"resource_group_name"`
+	Location          string                   `json:"location"`
+	State             InstanceState            `json:"state"`
+	Outputs           map[string]interface{}   `json:"outputs,omitempty"`
+	TemplateVersion   string                   `json:"template_version,omitempty"`
+	TemplateSHA256    string                   `json:"template_sha256,omitempty"`
+	GroupCreated      bool                     `json:"group_created,omitempty"`
+	OperationData     string                   `json:"operation_data,omitempty"`
+	Failure           string                   `json:"failure,omitempty"`
+	FailedOperation   string                   `json:"failed_operation,omitempty"`
+	Cleanup           *CleanupRecord           `json:"cleanup,omitempty"`
+	CreatedAt         time.Time                `json:"created_at"`
+	Bindings          map[string]BindingRecord `json:"bindings,omitempty"`
+}
+
+// Store persists the instances and bindings of the broker. PutInstance
+// never changes the bindings of an instance; they are managed with
+// PutBinding and DeleteBinding, and removed with the instance.
+type Store interface {
+	GetInstance(instanceID string) (InstanceRecord, error)
+	// ListInstances returns every instance, without its bindings
+	ListInstances() ([]InstanceRecord, error)
+	PutInstance(instance InstanceRecord) error
+	DeleteInstance(instanceID string) error
+	PutBinding(instanceID string, binding BindingRecord) error
+	DeleteBinding(instanceID string, bindingID string) error
+}
@@ -0,0 +1,193 @@
+package broker_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/zeqing-guo/AzureBlockchainBroker/broker"
+)
+
+func itBehavesLikeAStore(newStore func() Store) {
+	var (
+		store    Store
+		instance InstanceRecord
+	)
+
+	BeforeEach(func() {
+		store = newStore()
+		numTXNodes := uint64(2)
+		instance = InstanceRecord{
+			InstanceID:        "instance-id",
+			ServiceID:         "service-id",
+			PlanID:            "plan-id",
+			Parameters:        ProvisionParameters{NumTXNodes: &numTXNodes},
+			DeploymentName:    "deployment-name",
+			ResourceGroupName: "resource-group-name",
+			Location:          "westus",
+			State:             StateProvisioning,
+			CreatedAt:         time.Date(2017, 8, 22, 6, 44, 6, 0, time.UTC),
+		}
+	})
+
+	It("should not find an unknown instance", func() {
+		_, err := store.GetInstance("unknown")
+		Expect(err).To(Equal(ErrRecordNotFound))
+	})
+
+	It("should get the instance which was put", func() {
+		Expect(store.PutInstance(instance)).To(Succeed())
+
+		recorded, err := store.GetInstance("instance-id")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(recorded.InstanceID).To(Equal("instance-id"))
+		Expect(recorded.PlanID).To(Equal("plan-id"))
+		Expect(*recorded.Parameters.NumTXNodes).To(Equal(uint64(2)))
+		Expect(recorded.DeploymentName).To(Equal("deployment-name"))
+		Expect(recorded.ResourceGroupName).To(Equal("resource-group-name"))
+		Expect(recorded.State).To(Equal(StateProvisioning))
+		Expect(recorded.CreatedAt.Equal(instance.CreatedAt)).To(BeTrue())
+	})
+
+	It("should replace the instance", func() {
+		Expect(store.PutInstance(instance)).To(Succeed())
+		instance.State = StateSucceeded
+		instance.Outputs = map[string]interface{}{"ethereum-rpc-endpoint": "http://rpc"}
+		Expect(store.PutInstance(instance)).To(Succeed())
+
+		recorded, err := store.GetInstance("instance-id")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(recorded.State).To(Equal(StateSucceeded))
+		Expect(recorded.Outputs).To(HaveKeyWithValue("ethereum-rpc-endpoint", "http://rpc"))
+	})
+
+	It("should list the instances without their bindings", func() {
+		Expect(store.PutInstance(instance)).To(Succeed())
+		Expect(store.PutBinding("instance-id", BindingRecord{BindingID: "binding-id", AppGUID: "app-guid"})).To(Succeed())
+		instance.InstanceID = "other-instance-id"
+		instance.State = StateFailed
+		instance.Cleanup = &CleanupRecord{After: time.Date(2017, 8, 22, 7, 44, 6, 0, time.UTC)}
+		Expect(store.PutInstance(instance)).To(Succeed())
+
+		instances, err := store.ListInstances()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(instances).To(HaveLen(2))
+		for _, recorded := range instances {
+			Expect(recorded.Bindings).To(BeEmpty())
+			if recorded.InstanceID == "other-instance-id" {
+				Expect(recorded.Cleanup.After.Equal(instance.Cleanup.After)).To(BeTrue())
+			}
+		}
+	})
+
+	It("should delete the instance", func() {
+		Expect(store.PutInstance(instance)).To(Succeed())
+		Expect(store.DeleteInstance("instance-id")).To(Succeed())
+
+		_, err := store.GetInstance("instance-id")
+		Expect(err).To(Equal(ErrRecordNotFound))
+		Expect(store.DeleteInstance("instance-id")).To(Succeed())
+	})
+
+	Context("with bindings", func() {
+		BeforeEach(func() {
+			Expect(store.PutInstance(instance)).To(Succeed())
+			Expect(store.PutBinding("instance-id", BindingRecord{BindingID: "binding-id", AppGUID: "app-guid"})).To(Succeed())
+		})
+
+		It("should get the instance with its bindings", func() {
+			recorded, err := store.GetInstance("instance-id")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(recorded.Bindings).To(HaveLen(1))
+			Expect(recorded.Bindings["binding-id"].AppGUID).To(Equal("app-guid"))
+		})
+
+		It("should keep the bindings when the instance is put", func() {
+			instance.State = StateSucceeded
+			Expect(store.PutInstance(instance)).To(Succeed())
+
+			recorded, err := store.GetInstance("instance-id")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(recorded.Bindings).To(HaveKey("binding-id"))
+		})
+
+		It("should delete a binding", func() {
+			Expect(store.DeleteBinding("instance-id", "binding-id")).To(Succeed())
+
+			recorded, err := store.GetInstance("instance-id")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(recorded.Bindings).To(BeEmpty())
+			Expect(store.DeleteBinding("instance-id", "binding-id")).To(Equal(ErrRecordNotFound))
+		})
+
+		It("should delete the bindings with the instance", func() {
+			Expect(store.DeleteInstance("instance-id")).To(Succeed())
+			Expect(store.PutInstance(instance)).To(Succeed())
+
+			recorded, err := store.GetInstance("instance-id")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(recorded.Bindings).To(BeEmpty())
+		})
+	})
+
+	It("should not bind an unknown instance", func() {
+		Expect(store.PutBinding("unknown", BindingRecord{BindingID: "binding-id"})).To(Equal(ErrRecordNotFound))
+	})
+}
+
+var _ = Describe("Store", func() {
+	var tempDir string
+
+	BeforeEach(func() {
+		var err error
+		tempDir, err = ioutil.TempDir("", "store")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tempDir)
+	})
+
+	Describe("FileStore", func() {
+		itBehavesLikeAStore(func() Store {
+			store, err := NewFileStore(filepath.Join(tempDir, "state.json"))
+			Expect(err).NotTo(HaveOccurred())
+			return store
+		})
+
+		It("should load the records after a restart", func() {
+			path := filepath.Join(tempDir, "state.json")
+			store, err := NewFileStore(path)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(store.PutInstance(InstanceRecord{InstanceID: "instance-id", PlanID: "plan-id"})).To(Succeed())
+			Expect(store.PutBinding("instance-id", BindingRecord{BindingID: "binding-id"})).To(Succeed())
+
+			store, err = NewFileStore(path)
+			Expect(err).NotTo(HaveOccurred())
+			recorded, err := store.GetInstance("instance-id")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(recorded.PlanID).To(Equal("plan-id"))
+			Expect(recorded.Bindings).To(HaveKey("binding-id"))
+		})
+
+		It("should raise an error for a corrupted file", func() {
+			path := filepath.Join(tempDir, "state.json")
+			Expect(ioutil.WriteFile(path, []byte("{"), 0600)).To(Succeed())
+
+			_, err := NewFileStore(path)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("SQLStore", func() {
+		itBehavesLikeAStore(func() Store {
+			store, err := NewSQLStore("sqlite3", filepath.Join(tempDir, "state.db"))
+			Expect(err).NotTo(HaveOccurred())
+			return store
+		})
+	})
+})
@@ -0,0 +1,291 @@
+package broker
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	resty "gopkg.in/resty.v0"
+)
+
+// TemplateConfig is where the ARM template of the blockchain is loaded from,
+// a path or a URL, and its SHA-256, which is required for a URL so that the
+// template cannot change under the broker. A path is trusted without it, as
+// the file is pushed with the broker and only changes when it is redeployed;
+// its SHA-256 is still checked if given.
+type TemplateConfig struct {
+	Path   string
+	URL    string
+	SHA256 string
+}
+
+func NewTemplateConfig(path, url, sha256 string) *TemplateConfig {
+	myConf := new(TemplateConfig)
+
+	myConf.Path = path
+	myConf.URL = url
+	myConf.SHA256 = strings.ToLower(sha256)
+
+	return myConf
+}
+
+func (config *TemplateConfig) Validate() error {
+	if config.Path != "" && config.URL != "" {
+		return errors.New("Only one of templatePath and templateURL can be given")
+	}
+	if config.URL != "" && config.SHA256 == "" {
+		return errors.New("Missing required parameters when 'templateURL' is given: templateSHA256")
+	}
+	if config.SHA256 != "" {
+		if digest, err := hex.DecodeString(config.SHA256); err != nil || len(digest) != sha256.Size {
+			return fmt.Errorf("templateSHA256 should be %d hexadecimal characters", 2*sha256.Size)
+		}
+	}
+	return nil
+}
+
+// Template is an ARM template which the broker deploys inline, so what it
+// provisions only changes with its configuration.
+type Template struct {
+	Source     string
+	Version    string
+	SHA256     string
+	Parameters TemplateParameters
+	Content    map[string]interface{}
+}
+
+// LoadTemplate loads the template of the config, and checks its SHA-256. It
+// returns nil if no template is configured.
+func LoadTemplate(client *resty.Client, config TemplateConfig) (*Template, error) {
+	var (
+		source string
+		body   []byte
+	)
+	switch {
+	case config.Path != "":
+		source = config.Path
+		var err error
+		body, err = ioutil.ReadFile(config.Path)
+		if err != nil {
+			return nil, fmt.Errorf("Error in reading the template: %v", err)
+		}
+	case config.URL != "":
+		source = config.URL
+		resp, err := client.R().Get(config.URL)
+		if err != nil {
+			return nil, fmt.Errorf("Error in downloading the template from %s: %v", config.URL, err)
+		}
+		if resp.StatusCode() != http.StatusOK {
+			return nil, fmt.Errorf("Error in downloading the template from %s: StatusCode: %d", config.URL, resp.StatusCode())
+		}
+		body = resp.Body()
+	default:
+		return nil, nil
+	}
+	return ParseTemplate(source, body, config.SHA256)
+}
+
+// ParseTemplate parses the template, whose SHA-256 must be the expected one
+// unless it is empty.
+func ParseTemplate(source string, body []byte, expectedSHA256 string) (*Template, error) {
+	digest := sha256.Sum256(body)
+	actualSHA256 := hex.EncodeToString(digest[:])
+	if expectedSHA256 != "" && !strings.EqualFold(actualSHA256, expectedSHA256) {
+		return nil, fmt.Errorf("The SHA-256 of the template %s is %s, not %s", source, actualSHA256, expectedSHA256)
+	}
+	content := map[string]interface{}{}
+	if err := json.Unmarshal(body, &content); err != nil {
+		return nil, fmt.Errorf("Error in parsing the template %s: %v", source, err)
+	}
+	version, _ := content["contentVersion"].(string)
+	if version == "" {
+		return nil, fmt.Errorf("No contentVersion in the template %s", source)
+	}
+	if _, ok := content["resources"]; !ok {
+		return nil, fmt.Errorf("No resources in the template %s", source)
+	}
+	declarations := struct {
+		Parameters TemplateParameters `json:"parameters"`
+	}{}
+	if err := json.Unmarshal(body, &declarations); err != nil {
+		return nil, fmt.Errorf("Error in parsing the parameters of the template %s: %v", source, err)
+	}
+	return &Template{
+		Source:     source,
+		Version:    version,
+		SHA256:     actualSHA256,
+		Parameters: declarations.Parameters,
+		Content:    content,
+	}, nil
+}
+
+// TemplateParameter is the declaration of a parameter in the `parameters`
+// of an ARM template.
+type TemplateParameter struct {
+	Type          string        `json:"type"`
+	DefaultValue  interface{}   `json:"defaultValue,omitempty"`
+	AllowedValues []interface{} `json:"allowedValues,omitempty"`
+	MinValue      *float64      `json:"minValue,omitempty"`
+	MaxValue      *float64      `json:"maxValue,omitempty"`
+	MinLength     *int          `json:"minLength,omitempty"`
+	MaxLength     *int          `json:"maxLength,omitempty"`
+}
+
+// TemplateParameters are the parameters of an ARM template by name.
+type TemplateParameters map[string]TemplateParameter
+
+// Validate checks the values of the parameters by name against their
+// declarations: every parameter without a default value is required, and
+// the values must be of the declared type, among the allowed values, and
+// within the declared range and length.
+func (p TemplateParameters) Validate(values map[string]interface{}) error {
+	invalid := []string{}
+	for _, name := range sortedKeys(p) {
+		declaration := p[name]
+		value, ok := values[name]
+		if !ok {
+			if declaration.DefaultValue == nil {
+				invalid = append(invalid, fmt.Sprintf("%s is required", name))
+			}
+			continue
+		}
+		invalid = append(invalid, declaration.validate(name, value)...)
+	}
+	for _, name := range sortedKeys(values) {
+		if _, ok := p[name]; !ok {
+			invalid = append(invalid, fmt.Sprintf("%s is not a parameter of the template", name))
+		}
+	}
+
+	if len(invalid) > 0 {
+		return errors.New("Invalid parameters: " + strings.Join(invalid, "; "))
+	}
+	return nil
+}
+
+func (d TemplateParameter) validate(name string, value interface{}) []string {
+	switch strings.ToLower(d.Type) {
+	case "string", "securestring":
+		s, ok := value.(string)
+		if !ok {
+			return []string{fmt.Sprintf("%s should be a string", name)}
+		}
+		if message := d.validateLength(name, len(s)); message != "" {
+			return []string{message}
+		}
+	case "int":
+		number, ok := numberValue(value)
+		if !ok || number != math.Trunc(number) {
+			return []string{fmt.Sprintf("%s should be an integer", name)}
+		}
+		if message := d.validateRange(name, number); message != "" {
+			return []string{message}
+		}
+	case "bool":
+		if _, ok := value.(bool); !ok {
+			return []string{fmt.Sprintf("%s should be a boolean", name)}
+		}
+	case "array":
+		array, ok := value.([]interface{})
+		if !ok {
+			return []string{fmt.Sprintf("%s should be an array", name)}
+		}
+		if message := d.validateLength(name, len(array)); message != "" {
+			return []string{message}
+		}
+	case "object", "secureobject":
+		if _, ok := value.(map[string]interface{}); !ok {
+			return []string{fmt.Sprintf("%s should be an object", name)}
+		}
+	}
+
+	if len(d.AllowedValues) > 0 && !d.allows(value) {
+		// the values of secure parameters never appear in the errors
+		if strings.HasPrefix(strings.ToLower(d.Type), "secure") {
+			return []string{fmt.Sprintf("%s is not an allowed value", name)}
+		}
+		return []string{fmt.Sprintf("%s is not an allowed value: %v", name, value)}
+	}
+	return nil
+}
+
+func (d TemplateParameter) validateRange(name string, number float64) string {
+	switch {
+	case d.MinValue != nil && d.MaxValue != nil && (number < *d.MinValue || number > *d.MaxValue):
+		return fmt.Sprintf("%s should be in [%s, %s]", name, formatNumber(*d.MinValue), formatNumber(*d.MaxValue))
+	case d.MinValue != nil && number < *d.MinValue:
+		return fmt.Sprintf("%s should be %s or more", name, formatNumber(*d.MinValue))
+	case d.MaxValue != nil && number > *d.MaxValue:
+		return fmt.Sprintf("%s should be %s or less", name, formatNumber(*d.MaxValue))
+	}
+	return ""
+}
+
+func (d TemplateParameter) validateLength(name string, length int) string {
+	switch {
+	case d.MinLength != nil && d.MaxLength != nil && (length < *d.MinLength || length > *d.MaxLength):
+		return fmt.Sprintf("The length of %s should be in [%d, %d]", name, *d.MinLength, *d.MaxLength)
+	case d.MinLength != nil && length < *d.MinLength:
+		return fmt.Sprintf("The length of %s should be %d or more", name, *d.MinLength)
+	case d.MaxLength != nil && length > *d.MaxLength:
+		return fmt.Sprintf("The length of %s should be %d or less", name, *d.MaxLength)
+	}
+	return ""
+}
+
+func (d TemplateParameter) allows(value interface{}) bool {
+	number, isNumber := numberValue(value)
+	for _, allowed := range d.AllowedValues {
+		if allowedNumber, ok := numberValue(allowed); ok && isNumber {
+			if allowedNumber == number {
+				return true
+			}
+			continue
+		}
+		if reflect.DeepEqual(allowed, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// numberValue returns the value as a float64 if it is a number, whether it
+// is from JSON or from the broker configuration.
+func numberValue(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case json.Number:
+		f, err := v.Float64()
+		return f, err == nil
+	}
+	return 0, false
+}
+
+func formatNumber(number float64) string {
+	return strconv.FormatFloat(number, 'f', -1, 64)
+}
+
+func sortedKeys(m interface{}) []string {
+	keys := []string{}
+	for _, key := range reflect.ValueOf(m).MapKeys() {
+		keys = append(keys, key.String())
+	}
+	sort.Strings(keys)
+	return keys
+}
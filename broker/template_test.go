@@ -0,0 +1,152 @@
+package broker_test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/zeqing-guo/AzureBlockchainBroker/broker"
+)
+
+var _ = Describe("Template", func() {
+	var (
+		body      []byte
+		sha256Sum string
+	)
+
+	BeforeEach(func() {
+		var err error
+		body, err = ioutil.ReadFile("testdata/template.json")
+		Expect(err).NotTo(HaveOccurred())
+		digest := sha256.Sum256(body)
+		sha256Sum = hex.EncodeToString(digest[:])
+	})
+
+	Describe("TemplateConfig", func() {
+		It("should require the SHA-256 of a template URL", func() {
+			Expect(NewTemplateConfig("", "https://example.com/template.json", "").Validate()).To(MatchError("Missing required parameters when 'templateURL' is given: templateSHA256"))
+			Expect(NewTemplateConfig("", "https://example.com/template.json", sha256Sum).Validate()).To(Succeed())
+		})
+
+		It("should not accept both a path and a URL", func() {
+			Expect(NewTemplateConfig("template.json", "https://example.com/template.json", sha256Sum).Validate()).To(MatchError("Only one of templatePath and templateURL can be given"))
+		})
+
+		It("should not accept a malformed SHA-256", func() {
+			Expect(NewTemplateConfig("template.json", "", "abc").Validate()).To(HaveOccurred())
+		})
+	})
+
+	Describe("LoadTemplate", func() {
+		It("should load the template of the path", func() {
+			template, err := LoadTemplate(nil, *NewTemplateConfig("testdata/template.json", "", sha256Sum))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(template.Version).To(Equal("1.0.0.0"))
+			Expect(template.SHA256).To(Equal(sha256Sum))
+			Expect(template.Content).To(HaveKey("resources"))
+		})
+
+		It("should download the template of the URL", func() {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write(body)
+			}))
+			defer server.Close()
+			client, err := NewHTTPClient(HTTPConfig{})
+			Expect(err).NotTo(HaveOccurred())
+
+			template, err := LoadTemplate(client, *NewTemplateConfig("", server.URL, sha256Sum))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(template.Source).To(Equal(server.URL))
+			Expect(template.Version).To(Equal("1.0.0.0"))
+		})
+
+		It("should refuse a template whose SHA-256 is not the pinned one", func() {
+			_, err := LoadTemplate(nil, *NewTemplateConfig("testdata/template.json", "", "00"+sha256Sum[2:]))
+			Expect(err).To(MatchError(ContainSubstring("The SHA-256 of the template testdata/template.json is " + sha256Sum)))
+		})
+
+		It("should return nil without a template", func() {
+			Expect(LoadTemplate(nil, TemplateConfig{})).To(BeNil())
+		})
+	})
+
+	Describe("ParseTemplate", func() {
+		It("should require a contentVersion", func() {
+			_, err := ParseTemplate("template.json", []byte(`{"resources": []}`), "")
+			Expect(err).To(MatchError("No contentVersion in the template template.json"))
+		})
+
+		It("should parse the declarations of the parameters", func() {
+			template, err := ParseTemplate("template.json", body, "")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(template.Parameters["mnNodeVMSize"].AllowedValues).To(ContainElement("Standard_D1_v2"))
+			Expect(*template.Parameters["numConsortiumMembers"].MaxValue).To(Equal(5.0))
+			Expect(*template.Parameters["namePrefix"].MaxLength).To(Equal(6))
+		})
+	})
+
+	Describe("TemplateParameters", func() {
+		var (
+			parameters TemplateParameters
+			values     map[string]interface{}
+		)
+
+		BeforeEach(func() {
+			template, err := ParseTemplate("template.json", body, "")
+			Expect(err).NotTo(HaveOccurred())
+			parameters = template.Parameters
+			values = map[string]interface{}{
+				"namePrefix":                "ethnet",
+				"adminUsername":             "gethadmin",
+				"adminPassword":             "aZure1234567",
+				"ethereumAccountPsswd":      "aZure1234567",
+				"ethereumAccountPassphrase": "aZure1234567",
+				"ethereumNetworkID":         uint64(553289),
+				"numConsortiumMembers":      uint64(2),
+				"numMiningNodesPerMember":   uint64(1),
+				"mnNodeVMSize":              "Standard_D1_v2",
+				"numTXNodes":                uint64(1),
+				"txNodeVMSize":              "Standard_D1_v2",
+			}
+		})
+
+		It("should accept values within the declarations", func() {
+			Expect(parameters.Validate(values)).To(Succeed())
+		})
+
+		It("should report every value out of range", func() {
+			values["numConsortiumMembers"] = uint64(6)
+			values["numMiningNodesPerMember"] = uint64(0)
+			values["ethereumNetworkID"] = uint64(4)
+			Expect(parameters.Validate(values)).To(MatchError("Invalid parameters: ethereumNetworkID should be in [5, 2147483647]; numConsortiumMembers should be in [2, 5]; numMiningNodesPerMember should be in [1, 19]"))
+		})
+
+		It("should refuse a value which is not allowed", func() {
+			values["txNodeVMSize"] = "Standard_G5"
+			Expect(parameters.Validate(values)).To(MatchError("Invalid parameters: txNodeVMSize is not an allowed value: Standard_G5"))
+		})
+
+		It("should check the length of the strings", func() {
+			values["namePrefix"] = "ethnetwork"
+			values["ethereumAccountPsswd"] = "short"
+			Expect(parameters.Validate(values)).To(MatchError("Invalid parameters: The length of ethereumAccountPsswd should be 12 or more; The length of namePrefix should be 6 or less"))
+		})
+
+		It("should check the types", func() {
+			values["numTXNodes"] = 1.5
+			values["adminUsername"] = 1
+			Expect(parameters.Validate(values)).To(MatchError("Invalid parameters: adminUsername should be a string; numTXNodes should be an integer"))
+		})
+
+		It("should require the parameters without default values, and no others", func() {
+			delete(values, "namePrefix")
+			delete(values, "numTXNodes")
+			values["location"] = "westus"
+			Expect(parameters.Validate(values)).To(MatchError("Invalid parameters: namePrefix is required; location is not a parameter of the template"))
+		})
+	})
+})
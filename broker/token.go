@@ -0,0 +1,315 @@
+package broker
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/pkcs12"
+	resty "gopkg.in/resty.v0"
+)
+
+// The authentications of the service principal
+const (
+	AuthenticationClientSecret    = "clientSecret"
+	AuthenticationCertificate     = "certificate"
+	AuthenticationManagedIdentity = "managedIdentity"
+)
+
+const (
+	managedIdentityAPIVersion = "2018-02-01"
+	clientAssertionType       = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+	clientAssertionLifetime   = 10 * time.Minute
+)
+
+// ManagedIdentityEndpoint is the token endpoint of the Instance Metadata
+// Service of Azure VMs.
+var ManagedIdentityEndpoint = "http://169.254.169.254/metadata/identity/oauth2/token"
+
+// TokenProvider gets tokens for the resource manager of the environment.
+type TokenProvider interface {
+	Token() (AzureToken, error)
+}
+
+// NewTokenProvider returns the token provider of the authentication in the
+// credential config. A certificate is loaded here, so a broken one fails at
+// start.
+func NewTokenProvider(cloudConfig CloudConfig, environment Environment, client *resty.Client) (TokenProvider, error) {
+	azure := cloudConfig.Azure
+	switch cloudConfig.Credential.Authentication {
+	case "", AuthenticationClientSecret:
+		return &clientSecretProvider{
+			client:     client,
+			http:       cloudConfig.HTTP,
+			tokenURL:   tokenEndpoint(environment, cloudConfig),
+			apiVersion: environment.APIVersions.ActiveDirectory,
+			resource:   environment.audience(),
+			clientID:   azure.ClientID,
+			secret:     azure.ClientSecret,
+		}, nil
+	case AuthenticationCertificate:
+		certificate, key, err := LoadCertificate(cloudConfig.Credential.CertificatePath, cloudConfig.Credential.CertificatePassword)
+		if err != nil {
+			return nil, err
+		}
+		return &clientCertificateProvider{
+			client:      client,
+			http:        cloudConfig.HTTP,
+			tokenURL:    tokenEndpoint(environment, cloudConfig),
+			apiVersion:  environment.APIVersions.ActiveDirectory,
+			resource:    environment.audience(),
+			clientID:    azure.ClientID,
+			certificate: certificate,
+			key:         key,
+		}, nil
+	case AuthenticationManagedIdentity:
+		return &managedIdentityProvider{
+			client:   client,
+			http:     cloudConfig.HTTP,
+			endpoint: ManagedIdentityEndpoint,
+			resource: environment.audience(),
+			clientID: azure.ClientID,
+		}, nil
+	}
+	return nil, fmt.Errorf("Unsupported authentication: %s", cloudConfig.Credential.Authentication)
+}
+
+// clientSecretProvider gets tokens with the client secret of the service
+// principal.
+type clientSecretProvider struct {
+	client     *resty.Client
+	http       HTTPConfig
+	tokenURL   string
+	apiVersion string
+	resource   string
+	clientID   string
+	secret     string
+}
+
+func (p *clientSecretProvider) Token() (AzureToken, error) {
+	body := url.Values{
+		"grant_type":    {"client_credentials"},
+		"client_id":     {p.clientID},
+		"client_secret": {p.secret},
+		"resource":      {p.resource},
+		"scope":         {"user_impersonation"},
+	}
+	return postTokenRequest(p.client, p.http, p.tokenURL, p.apiVersion, body)
+}
+
+// clientCertificateProvider gets tokens with a client assertion signed by
+// the certificate of the service principal.
+type clientCertificateProvider struct {
+	client      *resty.Client
+	http        HTTPConfig
+	tokenURL    string
+	apiVersion  string
+	resource    string
+	clientID    string
+	certificate *x509.Certificate
+	key         *rsa.PrivateKey
+}
+
+func (p *clientCertificateProvider) Token() (AzureToken, error) {
+	assertion, err := p.clientAssertion()
+	if err != nil {
+		return AzureToken{}, err
+	}
+	body := url.Values{
+		"grant_type":            {"client_credentials"},
+		"client_id":             {p.clientID},
+		"client_assertion_type": {clientAssertionType},
+		"client_assertion":      {assertion},
+		"resource":              {p.resource},
+	}
+	return postTokenRequest(p.client, p.http, p.tokenURL, p.apiVersion, body)
+}
+
+// clientAssertion is a JWT signed with RS256, which names the certificate
+// by its SHA-1 thumbprint.
+func (p *clientCertificateProvider) clientAssertion() (string, error) {
+	thumbprint := sha1.Sum(p.certificate.Raw)
+	jti, err := newUUID()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	header, _ := json.Marshal(map[string]string{
+		"alg": "RS256",
+		"typ": "JWT",
+		"x5t": base64.RawURLEncoding.EncodeToString(thumbprint[:]),
+	})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"aud": p.tokenURL,
+		"iss": p.clientID,
+		"sub": p.clientID,
+		"jti": jti,
+		"nbf": now.Unix(),
+		"exp": now.Add(clientAssertionLifetime).Unix(),
+	})
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	hashed := sha256.Sum256([]byte(signingInput))
+	signature, err := rsa.SignPKCS1v15(nil, p.key, crypto.SHA256, hashed[:])
+	if err != nil {
+		return "", fmt.Errorf("Error in signing the client assertion: %v", err)
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// managedIdentityProvider gets tokens of the managed identity of the VM from
+// the Instance Metadata Service. The client ID selects a user-assigned
+// identity.
+type managedIdentityProvider struct {
+	client   *resty.Client
+	http     HTTPConfig
+	endpoint string
+	resource string
+	clientID string
+}
+
+func (p *managedIdentityProvider) Token() (AzureToken, error) {
+	resp, err := sendWithRetry(p.http, func() (*resty.Response, error) {
+		request := p.client.R().
+			SetHeader("Metadata", "true").
+			SetHeader("User-Agent", userAgent).
+			SetQueryParam("api-version", managedIdentityAPIVersion).
+			SetQueryParam("resource", p.resource)
+		if p.clientID != "" {
+			request.SetQueryParam("client_id", p.clientID)
+		}
+		return request.Get(p.endpoint)
+	})
+	if err != nil {
+		return AzureToken{}, err
+	}
+	return parseTokenResponse(p.endpoint, resp)
+}
+
+func postTokenRequest(client *resty.Client, config HTTPConfig, tokenURL, apiVersion string, body url.Values) (AzureToken, error) {
+	resp, err := sendWithRetry(config, func() (*resty.Response, error) {
+		return client.R().
+			SetHeaders(map[string]string{
+				"Content-Type": contentTypeWWW,
+				"User-Agent":   userAgent,
+			}).
+			SetQueryParam("api-version", apiVersion).
+			SetBody(body.Encode()).
+			Post(tokenURL)
+	})
+	if err != nil {
+		return AzureToken{}, err
+	}
+	return parseTokenResponse(tokenURL, resp)
+}
+
+func parseTokenResponse(tokenURL string, resp *resty.Response) (AzureToken, error) {
+	if resp.StatusCode() != http.StatusOK {
+		return AzureToken{}, fmt.Errorf("Error in getting a token from %s: HTTP CODE: %#v", tokenURL, resp.StatusCode())
+	}
+	// Azure AD returns the numbers as strings, ADFS as numbers
+	responseBody := struct {
+		ExpiresOn   json.Number `json:"expires_on"`
+		ExpiresIn   json.Number `json:"expires_in"`
+		AccessToken string      `json:"access_token"`
+	}{}
+	if err := json.Unmarshal(resp.Body(), &responseBody); err != nil {
+		return AzureToken{}, err
+	}
+	token := AzureToken{AccessToken: responseBody.AccessToken}
+	if expiresOn, err := strconv.ParseInt(string(responseBody.ExpiresOn), 10, 64); err == nil {
+		token.ExpiresOn = time.Unix(expiresOn, 0)
+	} else if expiresIn, err := strconv.ParseInt(string(responseBody.ExpiresIn), 10, 64); err == nil {
+		token.ExpiresOn = time.Now().Add(time.Duration(expiresIn) * time.Second)
+	} else {
+		return AzureToken{}, fmt.Errorf("No expires_on in the token from %s", tokenURL)
+	}
+	return token, nil
+}
+
+// LoadCertificate reads the certificate and the RSA private key of the
+// service principal from a PFX file, which ends with .pfx or .p12, or from a
+// PEM file.
+func LoadCertificate(path, password string) (*x509.Certificate, *rsa.PrivateKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error in reading the certificate: %v", err)
+	}
+	var (
+		certificate *x509.Certificate
+		key         interface{}
+	)
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".pfx", ".p12":
+		key, certificate, err = pkcs12.Decode(data, password)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Error in decoding the PFX certificate: %v", err)
+		}
+	default:
+		certificate, key, err = decodePEM(data, password)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, nil, errors.New("The private key of the certificate is not an RSA key")
+	}
+	return certificate, rsaKey, nil
+}
+
+func decodePEM(data []byte, password string) (*x509.Certificate, interface{}, error) {
+	var (
+		certificate *x509.Certificate
+		key         interface{}
+	)
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		der := block.Bytes
+		if x509.IsEncryptedPEMBlock(block) {
+			var err error
+			if der, err = x509.DecryptPEMBlock(block, []byte(password)); err != nil {
+				return nil, nil, fmt.Errorf("Error in decrypting the private key: %v", err)
+			}
+		}
+		var err error
+		switch block.Type {
+		case "CERTIFICATE":
+			// the first certificate is the one of the key
+			if certificate == nil {
+				certificate, err = x509.ParseCertificate(der)
+			}
+		case "RSA PRIVATE KEY":
+			key, err = x509.ParsePKCS1PrivateKey(der)
+		case "PRIVATE KEY":
+			key, err = x509.ParsePKCS8PrivateKey(der)
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("Error in parsing the %s: %v", strings.ToLower(block.Type), err)
+		}
+	}
+	if certificate == nil {
+		return nil, nil, errors.New("No certificate in the PEM file")
+	}
+	if key == nil {
+		return nil, nil, errors.New("No private key in the PEM file")
+	}
+	return certificate, key, nil
+}
@@ -0,0 +1,202 @@
+package broker_test
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager/lagertest"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	. "github.com/zeqing-guo/AzureBlockchainBroker/broker"
+	"github.com/zeqing-guo/AzureBlockchainBroker/fakeazure"
+)
+
+var _ = Describe("Token", func() {
+	const tokenRequest = "POST /tenant-id/oauth2/token"
+
+	var server *fakeazure.Server
+
+	BeforeEach(func() {
+		server = fakeazure.NewServer(fakeazure.Config{})
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	newClient := func(clientSecret string, credentialConfig CredentialConfig) (*AzureRESTClient, error) {
+		azureConfig := *NewAzureConfig(AzureCloud, "tenant-id", "client-id", clientSecret)
+		return NewAzureResourceAccountRESTClient(lagertest.NewTestLogger("token"), *NewCloudConfig(azureConfig, AzureStackConfig{}, server.Endpoints(), credentialConfig, HTTPConfig{}))
+	}
+
+	groupExist := func(client *AzureRESTClient) {
+		_, err := client.GroupExist(Scope{SubscriptionID: "subscription-id", ResourceGroupName: "group"})
+		Expect(err).NotTo(HaveOccurred())
+	}
+
+	tokenRequestValues := func() url.Values {
+		values, err := url.ParseQuery(string(server.LastRequestBody(tokenRequest)))
+		Expect(err).NotTo(HaveOccurred())
+		return values
+	}
+
+	It("should authenticate with the client secret by default", func() {
+		client, err := newClient("client-secret", CredentialConfig{})
+		Expect(err).NotTo(HaveOccurred())
+		groupExist(client)
+
+		values := tokenRequestValues()
+		Expect(values.Get("client_secret")).To(Equal("client-secret"))
+		Expect(values.Get("client_assertion")).To(BeEmpty())
+	})
+
+	Context("with a certificate", func() {
+		verifyAssertion := func(certificatePath, password string) {
+			client, err := newClient("", *NewCredentialConfig(AuthenticationCertificate, certificatePath, password, 0))
+			Expect(err).NotTo(HaveOccurred())
+			groupExist(client)
+
+			values := tokenRequestValues()
+			Expect(values.Get("client_secret")).To(BeEmpty())
+			Expect(values.Get("client_assertion_type")).To(Equal("urn:ietf:params:oauth:client-assertion-type:jwt-bearer"))
+
+			parts := strings.Split(values.Get("client_assertion"), ".")
+			Expect(parts).To(HaveLen(3))
+			claims := map[string]interface{}{}
+			payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+			Expect(err).NotTo(HaveOccurred())
+			Expect(json.Unmarshal(payload, &claims)).To(Succeed())
+			Expect(claims).To(HaveKeyWithValue("iss", "client-id"))
+			Expect(claims).To(HaveKeyWithValue("sub", "client-id"))
+			Expect(claims).To(HaveKeyWithValue("aud", server.URL+"/tenant-id/oauth2/token"))
+
+			certificate, _, err := LoadCertificate(certificatePath, password)
+			Expect(err).NotTo(HaveOccurred())
+			signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+			Expect(err).NotTo(HaveOccurred())
+			hashed := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+			Expect(rsa.VerifyPKCS1v15(certificate.PublicKey.(*rsa.PublicKey), crypto.SHA256, hashed[:], signature)).To(Succeed())
+		}
+
+		It("should sign the client assertion with a PEM certificate", func() {
+			verifyAssertion("testdata/certificate.pem", "")
+		})
+
+		It("should sign the client assertion with a PFX certificate", func() {
+			verifyAssertion("testdata/certificate.pfx", "password")
+		})
+
+		It("should raise an error for a wrong PFX password", func() {
+			_, err := newClient("", *NewCredentialConfig(AuthenticationCertificate, "testdata/certificate.pfx", "wrong", 0))
+			Expect(err).To(MatchError(ContainSubstring("Error in decoding the PFX certificate")))
+		})
+
+		It("should raise an error for a file without a private key", func() {
+			_, err := newClient("", *NewCredentialConfig(AuthenticationCertificate, "testdata/error_not_found.json", "", 0))
+			Expect(err).To(MatchError("No certificate in the PEM file"))
+		})
+	})
+
+	Context("with a managed identity", func() {
+		var endpoint string
+
+		BeforeEach(func() {
+			endpoint = ManagedIdentityEndpoint
+			ManagedIdentityEndpoint = server.URL + "/metadata/identity/oauth2/token"
+		})
+
+		AfterEach(func() {
+			ManagedIdentityEndpoint = endpoint
+		})
+
+		It("should get the tokens from the Instance Metadata Service", func() {
+			client, err := newClient("", *NewCredentialConfig(AuthenticationManagedIdentity, "", "", 0))
+			Expect(err).NotTo(HaveOccurred())
+			groupExist(client)
+
+			Expect(server.Requests()).To(ContainElement("GET /metadata/identity/oauth2/token"))
+			Expect(server.Requests()).NotTo(ContainElement(tokenRequest))
+		})
+	})
+
+	Context("when the token is refused", func() {
+		It("should refresh the token once and send the request again", func() {
+			client, err := newClient("client-secret", CredentialConfig{})
+			Expect(err).NotTo(HaveOccurred())
+			groupExist(client)
+			Expect(server.TokensIssued()).To(Equal(1))
+
+			server.ExpireTokens()
+			var wg sync.WaitGroup
+			for i := 0; i < 5; i++ {
+				wg.Add(1)
+				go func() {
+					defer GinkgoRecover()
+					defer wg.Done()
+					groupExist(client)
+				}()
+			}
+			wg.Wait()
+			Expect(server.TokensIssued()).To(Equal(2))
+		})
+	})
+
+	It("should retry the token requests which fail to be served", func() {
+		server.FailTokens(2)
+		azureConfig := *NewAzureConfig(AzureCloud, "tenant-id", "client-id", "client-secret")
+		client, err := NewAzureResourceAccountRESTClient(lagertest.NewTestLogger("token"), *NewCloudConfig(azureConfig, AzureStackConfig{}, server.Endpoints(), CredentialConfig{}, *NewHTTPConfig(0, "", "", 2, time.Millisecond, 10*time.Millisecond, 0, 0)))
+		Expect(err).NotTo(HaveOccurred())
+		groupExist(client)
+
+		requests := 0
+		for _, request := range server.Requests() {
+			if request == tokenRequest {
+				requests++
+			}
+		}
+		Expect(requests).To(Equal(3))
+	})
+
+	It("should refresh the token ahead of its expiry", func() {
+		// the fake issues tokens which expire in an hour
+		client, err := newClient("client-secret", *NewCredentialConfig(AuthenticationClientSecret, "", "", 2*time.Hour))
+		Expect(err).NotTo(HaveOccurred())
+		groupExist(client)
+		groupExist(client)
+		Expect(server.TokensIssued()).To(Equal(2))
+
+		client, err = newClient("client-secret", *NewCredentialConfig(AuthenticationClientSecret, "", "", 5*time.Minute))
+		Expect(err).NotTo(HaveOccurred())
+		groupExist(client)
+		groupExist(client)
+		Expect(server.TokensIssued()).To(Equal(3))
+	})
+
+	It("should raise an error for an unsupported authentication", func() {
+		_, err := newClient("", *NewCredentialConfig("password", "", "", 0))
+		Expect(err).To(MatchError("Unsupported authentication: password"))
+	})
+})
+
+var _ = Describe("CredentialConfig", func() {
+	It("should require the certificate path of a certificate", func() {
+		err := NewCredentialConfig(AuthenticationCertificate, "", "", 0).Validate()
+		Expect(err).To(MatchError("Missing required parameters when 'authentication' is 'certificate': certificatePath"))
+	})
+
+	It("should refuse a negative token refresh skew", func() {
+		err := NewCredentialConfig(AuthenticationClientSecret, "", "", -time.Minute).Validate()
+		Expect(err).To(MatchError("tokenRefreshSkew should not be negative"))
+	})
+
+	It("should accept the managed identity", func() {
+		Expect(NewCredentialConfig(AuthenticationManagedIdentity, "", "", 0).Validate()).To(Succeed())
+	})
+})
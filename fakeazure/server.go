@@ -0,0 +1,741 @@
+// Package fakeazure is an in-process fake of the Azure AD token endpoint and
+// of the resource groups and deployments API of ARM, so the broker can be
+// tested without Azure.
+package fakeazure
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zeqing-guo/AzureBlockchainBroker/broker"
+)
+
+const (
+	// Audience is the token audience in the endpoints metadata of the
+	// server, as an Azure Stack serves it.
+	Audience = "https://management.fakeazure.local/"
+
+	stateAccepted  = "Accepted"
+	stateRunning   = "Running"
+	stateSucceeded = "Succeeded"
+	stateFailed    = "Failed"
+	stateDeleting  = "Deleting"
+)
+
+type Config struct {
+	// Latency is added to every response.
+	Latency time.Duration
+	// RetryAfter is the Retry-After in seconds of throttled responses,
+	// none if it is 0.
+	RetryAfter int
+	// Polls is how many times an operation is polled before it finishes.
+	Polls int
+	// Outputs are the outputs of every succeeded deployment.
+	Outputs map[string]interface{}
+	// WhatIfRetryAfter answers what-if with 202 and the Retry-After in
+	// seconds, if it is not 0, and its result once it has been polled.
+	WhatIfRetryAfter int
+	// UntrackedDeletions answers the deletions of resource groups with 202
+	// but without the headers to follow them by, so they are followed by
+	// polling the group.
+	UntrackedDeletions bool
+}
+
+// DefaultOutputs are the outputs of the blockchain template.
+func DefaultOutputs() map[string]interface{} {
+	return map[string]interface{}{
+		"admin-site":            "http://ethnet-dns.westus.cloudapp.azure.com",
+		"ethereum-rpc-endpoint": "http://ethnet-dns.westus.cloudapp.azure.com:8545",
+	}
+}
+
+type Server struct {
+	*httptest.Server
+
+	mutex      sync.Mutex
+	config     Config
+	tokens     map[string]bool
+	issued     int
+	groups     map[string]*group
+	operations map[string]*operation
+	throttled  int
+	// the token requests to fail with 503
+	failedTokens int
+	// the rate limits sent with the responses, none if negative
+	remainingReads  int
+	remainingWrites int
+	failures        []failure
+	failure         *broker.OperationError
+	deletionFailure *broker.OperationError
+	requests        []string
+	lastRequest     map[string]json.RawMessage
+	// the requests to ARM wait until hold is closed, if it is not nil
+	hold chan struct{}
+	held int
+}
+
+type group struct {
+	name        string
+	location    string
+	tags        map[string]string
+	state       string
+	deployments map[string]*deployment
+	// deletion is the untracked deletion of the group
+	deletion *operation
+}
+
+type deployment struct {
+	name       string
+	state      string
+	properties map[string]interface{}
+	err        *broker.OperationError
+}
+
+// operation is a long-running operation, which finishes after it has been
+// polled config.Polls times.
+type operation struct {
+	id        string
+	remaining int
+	done      bool
+	failed    bool
+	err       *broker.OperationError
+	finish    func()
+	// result is the body of the result of a finished operation, if any
+	result interface{}
+}
+
+type failure struct {
+	method     string
+	statusCode int
+	err        broker.OperationError
+}
+
+func NewServer(config Config) *Server {
+	if config.Polls <= 0 {
+		config.Polls = 1
+	}
+	if config.Outputs == nil {
+		config.Outputs = DefaultOutputs()
+	}
+	s := &Server{
+		config:      config,
+		tokens:      map[string]bool{},
+		groups:      map[string]*group{},
+		operations:  map[string]*operation{},
+		lastRequest: map[string]json.RawMessage{},
+		// ARM sends them, but the broker must not depend on them
+		remainingReads:  -1,
+		remainingWrites: -1,
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// Endpoints points the broker at the server. Without the Active Directory
+// endpoint, an AzureStack environment discovers it from the endpoints
+// metadata of the server.
+func (s *Server) Endpoints() broker.EndpointConfig {
+	return *broker.NewEndpointConfig(s.URL+"/", s.URL)
+}
+
+// RateLimits sends the remaining reads and writes of the subscription with
+// every response of ARM, none if they are negative.
+func (s *Server) RateLimits(reads, writes int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.remainingReads, s.remainingWrites = reads, writes
+}
+
+// Throttle answers the next n requests to ARM with 429.
+func (s *Server) Throttle(n int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.throttled = n
+}
+
+// FailTokens answers the next n token requests with 503.
+func (s *Server) FailTokens(n int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.failedTokens = n
+}
+
+// FailNext answers the next request to ARM with the method, e.g. PUT, with
+// the status code and the error.
+func (s *Server) FailNext(method string, statusCode int, code, message string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.failures = append(s.failures, failure{
+		method:     method,
+		statusCode: statusCode,
+		err:        broker.OperationError{Code: code, Message: message},
+	})
+}
+
+// FailDeployments makes the deployments started from now on fail with the
+// error, or succeed again if it is nil.
+func (s *Server) FailDeployments(err *broker.OperationError) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.failure = err
+}
+
+// FailDeletions makes the deletions of resource groups started from now on
+// fail with the error, or succeed again if it is nil.
+func (s *Server) FailDeletions(err *broker.OperationError) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.deletionFailure = err
+}
+
+// Hold makes the requests to ARM wait until release is called.
+func (s *Server) Hold() (release func()) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	hold := make(chan struct{})
+	s.hold = hold
+	return func() {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		if s.hold == hold {
+			s.hold = nil
+		}
+		close(hold)
+	}
+}
+
+// Held is how many requests to ARM are waiting to be released.
+func (s *Server) Held() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.held
+}
+
+// ExpireTokens makes every token issued so far invalid.
+func (s *Server) ExpireTokens() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.tokens = map[string]bool{}
+}
+
+// TokensIssued is how many tokens have been issued.
+func (s *Server) TokensIssued() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.issued
+}
+
+// Requests returns the method and the path of every request received.
+func (s *Server) Requests() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]string{}, s.requests...)
+}
+
+// LastRequestBody returns the body of the last request with the method and
+// the path, e.g. "PUT /subscriptions/.../deployments/name".
+func (s *Server) LastRequestBody(request string) json.RawMessage {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.lastRequest[request]
+}
+
+// ResourceGroupExists tells whether the resource group exists, even if it is
+// being deleted.
+func (s *Server) ResourceGroupExists(name string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	_, ok := s.groups[strings.ToLower(name)]
+	return ok
+}
+
+// AddResourceGroup creates a resource group, e.g. one which was not created
+// by the broker.
+func (s *Server) AddResourceGroup(name, location string, tags map[string]string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.groups[strings.ToLower(name)] = &group{name: name, location: location, tags: tags, state: stateSucceeded, deployments: map[string]*deployment{}}
+}
+
+// DeleteResourceGroup starts the deletion of the resource group, e.g. by
+// someone else than the broker. It finishes once the group is polled.
+func (s *Server) DeleteResourceGroup(name string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if g, ok := s.groups[strings.ToLower(name)]; ok {
+		g.state = stateDeleting
+		g.deletion = s.newOperation(func() {
+			delete(s.groups, strings.ToLower(name))
+		})
+	}
+}
+
+// ResourceGroupTags returns the tags of the resource group.
+func (s *Server) ResourceGroupTags(name string) map[string]string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if g, ok := s.groups[strings.ToLower(name)]; ok {
+		return g.tags
+	}
+	return nil
+}
+
+// DeploymentState returns the provisioning state of the deployment, or an
+// empty string if it does not exist.
+func (s *Server) DeploymentState(groupName, deploymentName string) string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if g, ok := s.groups[strings.ToLower(groupName)]; ok {
+		if d, ok := g.deployments[strings.ToLower(deploymentName)]; ok {
+			return d.state
+		}
+	}
+	return ""
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.config.Latency > 0 {
+		time.Sleep(s.config.Latency)
+	}
+	body, _ := ioutil.ReadAll(r.Body)
+	// the broker joins the endpoint and the path with a double slash
+	p := path.Clean(r.URL.Path)
+	segments := strings.Split(strings.Trim(p, "/"), "/")
+
+	s.mutex.Lock()
+	if hold := s.hold; hold != nil && segments[0] == "subscriptions" {
+		s.held++
+		s.mutex.Unlock()
+		<-hold
+		s.mutex.Lock()
+		s.held--
+	}
+	defer s.mutex.Unlock()
+	request := r.Method + " " + p
+	s.requests = append(s.requests, request)
+	if len(body) > 0 {
+		s.lastRequest[request] = body
+	}
+
+	if p == "/metadata/endpoints" && r.Method == http.MethodGet {
+		s.serveEndpointsMetadata(w)
+		return
+	}
+	// the token endpoint of the managed identity in the Instance Metadata
+	// Service, see broker.ManagedIdentityEndpoint
+	if p == "/metadata/identity/oauth2/token" && r.Method == http.MethodGet {
+		if r.Header.Get("Metadata") != "true" {
+			writeError(w, http.StatusBadRequest, "invalid_request", "Required metadata header not specified")
+			return
+		}
+		s.issueToken(w)
+		return
+	}
+	// ADFS has no tenant in the path
+	if strings.HasSuffix(p, "/oauth2/token") && len(segments) <= 3 && r.Method == http.MethodPost {
+		s.issueToken(w)
+		return
+	}
+
+	if !s.tokens[strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")] {
+		writeError(w, http.StatusUnauthorized, "AuthenticationFailed", "Authentication failed. The 'Authorization' header is missing or invalid.")
+		return
+	}
+	if s.remainingReads >= 0 {
+		w.Header().Set("x-ms-ratelimit-remaining-subscription-reads", strconv.Itoa(s.remainingReads))
+	}
+	if s.remainingWrites >= 0 {
+		w.Header().Set("x-ms-ratelimit-remaining-subscription-writes", strconv.Itoa(s.remainingWrites))
+	}
+	if s.throttled > 0 {
+		s.throttled--
+		if s.config.RetryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(s.config.RetryAfter))
+		}
+		writeError(w, http.StatusTooManyRequests, "TooManyRequests", "The request is being throttled.")
+		return
+	}
+	for i, f := range s.failures {
+		if f.method == r.Method {
+			s.failures = append(s.failures[:i], s.failures[i+1:]...)
+			writeError(w, f.statusCode, f.err.Code, f.err.Message)
+			return
+		}
+	}
+
+	switch {
+	case len(segments) == 2 && segments[0] == "operations":
+		s.serveAsyncOperation(w, segments[1])
+	case len(segments) == 2 && segments[0] == "operationresults":
+		s.serveOperationResult(w, segments[1])
+	case len(segments) == 4 && segments[0] == "subscriptions" && strings.EqualFold(segments[2], "resourcegroups"):
+		s.serveResourceGroup(w, r, segments[3], body)
+	case len(segments) >= 8 && segments[0] == "subscriptions" && strings.EqualFold(segments[2], "resourcegroups") &&
+		strings.EqualFold(segments[4], "providers") && strings.EqualFold(segments[5], "Microsoft.Resources") &&
+		segments[6] == "deployments":
+		if len(segments) == 9 && segments[8] == "operations" {
+			s.serveDeploymentOperations(w, segments[3], segments[7])
+			return
+		}
+		if len(segments) == 9 && r.Method == http.MethodPost && (segments[8] == "validate" || segments[8] == "whatIf") {
+			s.servePreflight(w, segments[1], segments[3], segments[7], segments[8], body)
+			return
+		}
+		s.serveDeployment(w, r, segments[3], segments[7], body)
+	default:
+		writeError(w, http.StatusNotFound, "NotFound", fmt.Sprintf("No route for %s", request))
+	}
+}
+
+func (s *Server) serveEndpointsMetadata(w http.ResponseWriter) {
+	metadata := broker.EndpointsMetadata{}
+	metadata.Authentication.LoginEndpoint = s.URL + "/"
+	metadata.Authentication.Audiences = []string{Audience}
+	writeJSON(w, http.StatusOK, metadata)
+}
+
+func (s *Server) issueToken(w http.ResponseWriter) {
+	if s.failedTokens > 0 {
+		s.failedTokens--
+		writeError(w, http.StatusServiceUnavailable, "temporarily_unavailable", "The service is temporarily unavailable.")
+		return
+	}
+	s.issued++
+	token := fmt.Sprintf("fake-token-%d", s.issued)
+	s.tokens[token] = true
+	writeJSON(w, http.StatusOK, map[string]string{
+		"token_type":   "Bearer",
+		"access_token": token,
+		"expires_in":   "3600",
+		"expires_on":   strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10),
+	})
+}
+
+func (s *Server) serveResourceGroup(w http.ResponseWriter, r *http.Request, name string, body []byte) {
+	g, ok := s.groups[strings.ToLower(name)]
+	switch r.Method {
+	case http.MethodHead:
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodGet:
+		if ok && g.deletion != nil {
+			s.advance(g.deletion)
+			_, ok = s.groups[strings.ToLower(name)]
+		}
+		if !ok {
+			writeError(w, http.StatusNotFound, "ResourceGroupNotFound", fmt.Sprintf("Resource group '%s' could not be found.", name))
+			return
+		}
+		writeJSON(w, http.StatusOK, g.model())
+	case http.MethodPut:
+		request := struct {
+			Location string            `json:"location"`
+			Tags     map[string]string `json:"tags"`
+		}{}
+		json.Unmarshal(body, &request)
+		if request.Location == "" {
+			writeError(w, http.StatusBadRequest, "LocationRequired", "The location property is required for this definition.")
+			return
+		}
+		statusCode := http.StatusOK
+		if !ok {
+			g = &group{name: name, deployments: map[string]*deployment{}}
+			s.groups[strings.ToLower(name)] = g
+			statusCode = http.StatusCreated
+		}
+		g.location = request.Location
+		g.tags = request.Tags
+		g.state = stateSucceeded
+		writeJSON(w, statusCode, g.model())
+	case http.MethodDelete:
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		g.state = stateDeleting
+		failure := s.deletionFailure
+		o := s.newOperation(func() {
+			if failure != nil {
+				g.state = stateSucceeded
+				return
+			}
+			delete(s.groups, strings.ToLower(name))
+		})
+		o.err = failure
+		o.failed = failure != nil
+		if s.config.UntrackedDeletions {
+			g.deletion = o
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+		w.Header().Set("Location", s.URL+"/operationresults/"+o.id)
+		w.Header().Set("Retry-After", "1")
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "MethodNotAllowed", r.Method)
+	}
+}
+
+func (s *Server) serveDeployment(w http.ResponseWriter, r *http.Request, groupName, name string, body []byte) {
+	g, ok := s.groups[strings.ToLower(groupName)]
+	if !ok {
+		writeError(w, http.StatusNotFound, "ResourceGroupNotFound", fmt.Sprintf("Resource group '%s' could not be found.", groupName))
+		return
+	}
+	d, ok := g.deployments[strings.ToLower(name)]
+	switch r.Method {
+	case http.MethodGet:
+		if !ok {
+			writeError(w, http.StatusNotFound, "DeploymentNotFound", fmt.Sprintf("Deployment '%s' could not be found.", name))
+			return
+		}
+		writeJSON(w, http.StatusOK, d.model(g, s.config.Outputs))
+	case http.MethodPut:
+		request := struct {
+			Properties map[string]interface{} `json:"properties"`
+		}{}
+		if err := json.Unmarshal(body, &request); err != nil || request.Properties == nil {
+			writeError(w, http.StatusBadRequest, "InvalidRequestContent", "The request content was invalid and could not be deserialized.")
+			return
+		}
+		if ok && (d.state == stateAccepted || d.state == stateRunning) {
+			writeError(w, http.StatusConflict, "DeploymentActive", fmt.Sprintf("The deployment '%s' is still active.", name))
+			return
+		}
+		statusCode := http.StatusOK
+		if !ok {
+			d = &deployment{name: name}
+			g.deployments[strings.ToLower(name)] = d
+			statusCode = http.StatusCreated
+		}
+		d.state = stateAccepted
+		d.properties = request.Properties
+		d.err = nil
+		failure := s.failure
+		o := s.newOperation(func() {
+			if failure != nil {
+				d.state = stateFailed
+				d.err = failure
+				return
+			}
+			d.state = stateSucceeded
+		})
+		o.err = failure
+		o.failed = failure != nil
+		w.Header().Set("Azure-AsyncOperation", s.URL+"/operations/"+o.id)
+		writeJSON(w, statusCode, d.model(g, s.config.Outputs))
+	case http.MethodDelete:
+		if !ok {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		delete(g.deployments, strings.ToLower(name))
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "MethodNotAllowed", r.Method)
+	}
+}
+
+// servePreflight validates a deployment, or answers what-if with the
+// creation of every resource of an inline template. Either fails with the
+// errors of FailNext.
+func (s *Server) servePreflight(w http.ResponseWriter, subscriptionID, groupName, name, action string, body []byte) {
+	g, ok := s.groups[strings.ToLower(groupName)]
+	if !ok {
+		writeError(w, http.StatusNotFound, "ResourceGroupNotFound", fmt.Sprintf("Resource group '%s' could not be found.", groupName))
+		return
+	}
+	request := struct {
+		Properties *struct {
+			Template *struct {
+				Resources []struct {
+					Type string `json:"type"`
+					Name string `json:"name"`
+				} `json:"resources"`
+			} `json:"template"`
+		} `json:"properties"`
+	}{}
+	if err := json.Unmarshal(body, &request); err != nil || request.Properties == nil {
+		writeError(w, http.StatusBadRequest, "InvalidRequestContent", "The request content was invalid and could not be deserialized.")
+		return
+	}
+	if action == "validate" {
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"id":         "/subscriptions/" + subscriptionID + "/resourceGroups/" + g.name + "/providers/Microsoft.Resources/deployments/" + name,
+			"name":       name,
+			"properties": map[string]interface{}{"provisioningState": stateSucceeded},
+		})
+		return
+	}
+	changes := []broker.WhatIfChange{}
+	if request.Properties.Template != nil {
+		for _, resource := range request.Properties.Template.Resources {
+			changes = append(changes, broker.WhatIfChange{
+				ResourceID: "/subscriptions/" + subscriptionID + "/resourceGroups/" + g.name + "/providers/" + resource.Type + "/" + resource.Name,
+				ChangeType: "Create",
+			})
+		}
+	}
+	result := map[string]interface{}{
+		"status":     stateSucceeded,
+		"properties": map[string]interface{}{"changes": changes},
+	}
+	if s.config.WhatIfRetryAfter > 0 {
+		o := s.newOperation(func() {})
+		o.result = result
+		w.Header().Set("Location", s.URL+"/operationresults/"+o.id)
+		w.Header().Set("Retry-After", strconv.Itoa(s.config.WhatIfRetryAfter))
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+func (s *Server) serveDeploymentOperations(w http.ResponseWriter, groupName, name string) {
+	g, ok := s.groups[strings.ToLower(groupName)]
+	if !ok {
+		writeError(w, http.StatusNotFound, "ResourceGroupNotFound", fmt.Sprintf("Resource group '%s' could not be found.", groupName))
+		return
+	}
+	d, ok := g.deployments[strings.ToLower(name)]
+	if !ok {
+		writeError(w, http.StatusNotFound, "DeploymentNotFound", fmt.Sprintf("Deployment '%s' could not be found.", name))
+		return
+	}
+	operations := []interface{}{}
+	if d.state == stateFailed && d.err != nil {
+		operations = append(operations, map[string]interface{}{
+			"operationId": "1",
+			"properties": map[string]interface{}{
+				"provisioningState": stateFailed,
+				"statusCode":        "BadRequest",
+				"statusMessage":     map[string]interface{}{"error": d.err},
+				"targetResource": map[string]string{
+					"resourceType": "Microsoft.Compute/virtualMachines",
+					"resourceName": "tx0",
+				},
+			},
+		})
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"value": operations})
+}
+
+func (s *Server) serveAsyncOperation(w http.ResponseWriter, id string) {
+	o, ok := s.operations[id]
+	if !ok {
+		writeError(w, http.StatusNotFound, "NotFound", fmt.Sprintf("Operation '%s' could not be found.", id))
+		return
+	}
+	s.advance(o)
+	status := map[string]interface{}{"status": stateRunning}
+	if o.done {
+		status["status"] = stateSucceeded
+		if o.failed {
+			status["status"] = stateFailed
+			status["error"] = o.err
+		}
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+func (s *Server) serveOperationResult(w http.ResponseWriter, id string) {
+	o, ok := s.operations[id]
+	if !ok {
+		writeError(w, http.StatusNotFound, "NotFound", fmt.Sprintf("Operation '%s' could not be found.", id))
+		return
+	}
+	s.advance(o)
+	if !o.done {
+		w.Header().Set("Location", s.URL+"/operationresults/"+o.id)
+		w.Header().Set("Retry-After", "1")
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+	if o.failed {
+		writeJSON(w, http.StatusBadRequest, broker.ErrorResponse{Error: o.err})
+		return
+	}
+	if o.result != nil {
+		writeJSON(w, http.StatusOK, o.result)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) newOperation(finish func()) *operation {
+	o := &operation{
+		id:        strconv.Itoa(len(s.operations) + 1),
+		remaining: s.config.Polls,
+		finish:    finish,
+	}
+	s.operations[o.id] = o
+	return o
+}
+
+func (s *Server) advance(o *operation) {
+	if o.done {
+		return
+	}
+	o.remaining--
+	if o.remaining <= 0 {
+		o.done = true
+		o.finish()
+	}
+}
+
+func (g *group) model() broker.ResourceGroup {
+	return broker.ResourceGroup{
+		ID:         "/subscriptions/fake/resourceGroups/" + g.name,
+		Name:       g.name,
+		Location:   g.location,
+		Tags:       g.tags,
+		Properties: &broker.ResourceGroupProperties{ProvisioningState: g.state},
+	}
+}
+
+func (d *deployment) model(g *group, outputs map[string]interface{}) broker.Deployment {
+	properties := &broker.DeploymentProperties{
+		ProvisioningState: d.state,
+		Parameters:        map[string]broker.DeploymentValue{},
+		Error:             d.err,
+	}
+	if parameters, ok := d.properties["parameters"].(map[string]interface{}); ok {
+		for name, parameter := range parameters {
+			if parameter, ok := parameter.(map[string]interface{}); ok {
+				properties.Parameters[name] = broker.DeploymentValue{Value: parameter["value"]}
+			}
+		}
+	}
+	if d.state == stateSucceeded {
+		properties.Outputs = map[string]broker.DeploymentValue{}
+		for name, value := range outputs {
+			properties.Outputs[name] = broker.DeploymentValue{Type: "String", Value: value}
+		}
+	}
+	return broker.Deployment{
+		ID:         "/subscriptions/fake/resourceGroups/" + g.name + "/providers/Microsoft.Resources/deployments/" + d.name,
+		Name:       d.name,
+		Properties: properties,
+	}
+}
+
+func writeJSON(w http.ResponseWriter, statusCode int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(body)
+}
+
+func writeError(w http.ResponseWriter, statusCode int, code, message string) {
+	writeJSON(w, statusCode, broker.ErrorResponse{Error: &broker.OperationError{Code: code, Message: message}})
+}
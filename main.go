@@ -1,13 +1,20 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
+	"math/big"
+	"net/http"
 	"os"
+	"time"
 
 	"code.cloudfoundry.org/debugserver"
 	"code.cloudfoundry.org/lager"
 	"code.cloudfoundry.org/lager/lagerflags"
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/mattn/go-sqlite3"
 	"github.com/pivotal-cf/brokerapi"
 	"github.com/tedsuo/ifrit"
 	"github.com/tedsuo/ifrit/grouper"
@@ -35,6 +42,37 @@ var serviceID = flag.String(
 	"(optional) - ID of the service to register with cloud controller",
 )
 
+var catalogPath = flag.String(
+	"catalogPath",
+	"",
+	"(optional) - Path to a JSON file describing the services and their plans. A single plan using the blockchain configuration is offered if not given.",
+)
+
+// State store
+var stateStore = flag.String(
+	"stateStore",
+	"file",
+	"(optional) - Where to record the instances and bindings. file or sql.",
+)
+
+var stateFilePath = flag.String(
+	"stateFilePath",
+	"azureblockchainbroker-state.json",
+	"(optional) - Path to the JSON file recording the instances and bindings when stateStore is file.",
+)
+
+var dbDriver = flag.String(
+	"dbDriver",
+	"",
+	"Required when stateStore is sql. The database driver. mysql or sqlite3.",
+)
+
+var dbDataSource = flag.String(
+	"dbDataSource",
+	"",
+	"Required when stateStore is sql. The data source name of the database, e.g. user:password@tcp(host:3306)/dbname for mysql.",
+)
+
 // Azure
 var environment = flag.String(
 	"environment",
@@ -57,7 +95,91 @@ var clientID = flag.String(
 var clientSecret = flag.String(
 	"clientSecret",
 	"",
-	"[REQUIRED] - The client secret for your service principal.",
+	"Required when authentication is clientSecret. The client secret for your service principal.",
+)
+
+var authentication = flag.String(
+	"authentication",
+	"clientSecret",
+	"How the service principal authenticates. clientSecret, certificate or managedIdentity.",
+)
+
+var certificatePath = flag.String(
+	"certificatePath",
+	"",
+	"Required when authentication is certificate. Path to a PEM file or a PFX (.pfx or .p12) file with the certificate and the private key of your service principal.",
+)
+
+var certificatePassword = flag.String(
+	"certificatePassword",
+	"",
+	"The password of the PFX file or of the encrypted private key in certificatePath.",
+)
+
+var httpTimeout = flag.Duration(
+	"httpTimeout",
+	60*time.Second,
+	"The timeout of every request to Azure.",
+)
+
+var httpProxy = flag.String(
+	"httpProxy",
+	"",
+	"The proxy of the requests to Azure, e.g. http://proxy:3128. The proxy in HTTPS_PROXY is used if it is empty.",
+)
+
+var caBundlePath = flag.String(
+	"caBundlePath",
+	"",
+	"Path to a PEM file of CAs which are trusted besides the system ones, e.g. the CA of your AzureStack deployment.",
+)
+
+var retryCount = flag.Int(
+	"retryCount",
+	3,
+	"How many times a request to Azure is retried when it is throttled, fails with 408 or 5xx, or does not get through.",
+)
+
+var retryWaitTime = flag.Duration(
+	"retryWaitTime",
+	time.Second,
+	"The wait before the first retry, which doubles at every retry. Retry-After of Azure takes precedence.",
+)
+
+var retryMaxWaitTime = flag.Duration(
+	"retryMaxWaitTime",
+	30*time.Second,
+	"The longest wait between retries.",
+)
+
+var rateLimitThreshold = flag.Int(
+	"rateLimitThreshold",
+	100,
+	"The remaining reads or writes of the subscription, as reported by Azure, below which the requests are delayed. 0 to disable.",
+)
+
+var rateLimitMaxDelay = flag.Duration(
+	"rateLimitMaxDelay",
+	5*time.Second,
+	"The delay of a request when no reads or writes of the subscription remain.",
+)
+
+var tokenRefreshSkew = flag.Duration(
+	"tokenRefreshSkew",
+	5*time.Minute,
+	"How long before its expiry a token is refreshed.",
+)
+
+var resourceManagerEndpoint = flag.String(
+	"resourceManagerEndpoint",
+	"",
+	"Overrides the Azure Resource Manager endpoint of the environment, e.g. https://management.local.azurestack.external/.",
+)
+
+var activeDirectoryEndpoint = flag.String(
+	"activeDirectoryEndpoint",
+	"",
+	"Overrides the Azure Active Directory endpoint of the environment, e.g. https://login.microsoftonline.com.",
 )
 
 var azureStackDomain = flag.String(
@@ -69,13 +191,13 @@ var azureStackDomain = flag.String(
 var azureStackAuthentication = flag.String(
 	"azureStackAuthentication",
 	"",
-	"Required when environment is AzureStack. The authentication type for your AzureStack deployment. AzureAD, AzureStackAD or AzureStack.",
+	"Required when environment is AzureStack. The authentication type for your AzureStack deployment. AzureAD, AzureStackAD or ADFS.",
 )
 
 var azureStackResource = flag.String(
 	"azureStackResource",
 	"",
-	"Required when environment is AzureStack. The token resource for your AzureStack deployment.",
+	"Required when environment is AzureStack. The token resource for your AzureStack deployment, e.g. https://management.<tenant>.onmicrosoft.com/<guid>.",
 )
 
 var azureStackEndpointPrefix = flag.String(
@@ -97,6 +219,24 @@ var location = flag.String(
 	"[REQUIRED] - The location for deploying template",
 )
 
+var resourceGroupPrefix = flag.String(
+	"resourceGroupPrefix",
+	"blockchain",
+	"(optional) - The {prefix} of resourceGroupNameFormat.",
+)
+
+var resourceGroupNameFormat = flag.String(
+	"resourceGroupNameFormat",
+	"{prefix}-{org}-{space}-{shortid}",
+	"(optional) - The name of the resource group of an instance. {prefix} is resourceGroupPrefix, {id} the instance ID, {shortid}, {org} and {space} the first 8 characters of the instance ID, of the organization GUID and of the space GUID. It should contain {id} or {shortid}.",
+)
+
+var whatIf = flag.Bool(
+	"whatIf",
+	false,
+	"(optional) - Ask Azure for the changes of every new deployment before deploying it, besides validating it. Not supported by AzureStack.",
+)
+
 // Blockchain configuration
 var namePrefix = flag.String(
 	"namePrefix",
@@ -164,9 +304,70 @@ var txNodeVMSize = flag.String(
 	"(optional) - Size of the virtual machine for transaction nodes",
 )
 
+var templatePath = flag.String(
+	"templatePath",
+	"",
+	"[REQUIRED unless templateURL is given] - Path to the ARM template of the blockchain, which is deployed inline. Only the ethereum-consortium services of the catalog which have their own template can do without one.",
+)
+
+var templateURL = flag.String(
+	"templateURL",
+	"",
+	"[REQUIRED unless templatePath is given] - URL of the ARM template of the blockchain, which is downloaded at start and deployed inline. templateSHA256 is required with it.",
+)
+
+var templateSHA256 = flag.String(
+	"templateSHA256",
+	"",
+	"[REQUIRED if templateURL is given] - The SHA-256 of the template in hexadecimal. The broker refuses to start if the template does not match it, which is checked for templatePath too if given.",
+)
+
+var cleanupFailedProvisions = flag.Bool(
+	"cleanupFailedProvisions",
+	true,
+	"(optional) - Delete the resource group which the broker created for a provision that failed.",
+)
+
+var cleanupGracePeriod = flag.Duration(
+	"cleanupGracePeriod",
+	0,
+	"(optional) - How long the resource group of a failed provision is kept for debugging before it is deleted. A retried provision deletes it right away.",
+)
+
+var bindingFundAmount = flag.String(
+	"bindingFundAmount",
+	"0",
+	"(optional) - Wei sent from the default Ethereum account to the account of every new binding, 0 to disable",
+)
+
+// Dry run, a subcommand given after the flags of the broker
+var dryRunFlags = flag.NewFlagSet("dry-run", flag.ExitOnError)
+
+var dryRunServiceID = dryRunFlags.String(
+	"serviceID",
+	"",
+	"(optional) - ID of the service of the plan. The plan is looked up in every service if not given.",
+)
+
+var dryRunPlanID = dryRunFlags.String(
+	"planID",
+	"",
+	"[REQUIRED] - ID of the plan to provision.",
+)
+
+var dryRunParameters = dryRunFlags.String(
+	"parameters",
+	"{}",
+	"(optional) - The provisioning parameters in JSON, as given to cf create-service -c.",
+)
+
+// how often the resource groups of the failed provisions are cleaned up
+const cleanupInterval = time.Minute
+
 var (
 	username string
 	password string
+	dryRun   bool
 )
 
 func main() {
@@ -175,7 +376,12 @@ func main() {
 
 	checkParams()
 
-	sink, err := lager.NewRedactingWriterSink(os.Stdout, lager.INFO, nil, nil)
+	// the output of a dry run is its result
+	logWriter := os.Stdout
+	if dryRun {
+		logWriter = os.Stderr
+	}
+	sink, err := lager.NewRedactingWriterSink(logWriter, lager.INFO, nil, nil)
 	if err != nil {
 		panic(err)
 	}
@@ -183,16 +389,34 @@ func main() {
 	logger.Info("start")
 	defer logger.Info("end")
 
-	server := createServer(logger)
-
+	serviceBroker, store := createBroker(logger)
+	if dryRun {
+		runDryRun(serviceBroker)
+		return
+	}
+	members := grouper.Members{
+		{"broker-api", createServer(logger, serviceBroker)},
+	}
+	if *cleanupFailedProvisions {
+		members = append(members, grouper.Member{"janitor", createJanitor(serviceBroker)})
+	}
 	if dbgAddr := debugserver.DebugAddress(flag.CommandLine); dbgAddr != "" {
-		server = utils.ProcessRunnerFor(grouper.Members{
-			{"debug-server", debugserver.Runner(dbgAddr, logSink)},
-			{"broker-api", server},
-		})
+		debugHandler := http.NewServeMux()
+		debugHandler.Handle("/rate-limits", serviceBroker.RateLimitHandler())
+		debugHandler.Handle("/", debugserver.Handler(logSink))
+		members = append(grouper.Members{
+			{"debug-server", http_server.New(dbgAddr, debugHandler)},
+		}, members...)
+	}
+
+	// the members stop in reverse order, so the store is closed last
+	if closer, ok := store.(io.Closer); ok {
+		members = append(grouper.Members{
+			{"state-store", createStoreCloser(closer)},
+		}, members...)
 	}
 
-	process := ifrit.Invoke(server)
+	process := ifrit.Invoke(utils.ProcessRunnerFor(members))
 	logger.Info("started")
 	utils.UntilTerminated(logger, process)
 }
@@ -201,6 +425,16 @@ func parseCommandLine() {
 	lagerflags.AddFlags(flag.CommandLine)
 	debugserver.AddFlags(flag.CommandLine)
 	flag.Parse()
+
+	if flag.NArg() > 0 {
+		if flag.Arg(0) != "dry-run" {
+			fmt.Fprintf(os.Stderr, "\nError: unknown command %s\n\n", flag.Arg(0))
+			flag.Usage()
+			os.Exit(1)
+		}
+		dryRun = true
+		dryRunFlags.Parse(flag.Args()[1:])
+	}
 }
 
 func parseEnvironment() {
@@ -209,50 +443,30 @@ func parseEnvironment() {
 }
 
 func checkParams() {
-	vmSizes := []string{
-		"Standard_A1",
-		"Standard_A2",
-		"Standard_A3",
-		"Standard_A4",
-		"Standard_A5",
-		"Standard_A6",
-		"Standard_A7",
-		"Standard_D1",
-		"Standard_D2",
-		"Standard_D3",
-		"Standard_D4",
-		"Standard_D11",
-		"Standard_D12",
-		"Standard_D13",
-		"Standard_D14",
-		"Standard_D1_v2",
-		"Standard_D2_v2",
-		"Standard_D3_v2",
-		"Standard_D4_v2",
-		"Standard_D5_v2",
-		"Standard_D11_v2",
-		"Standard_D12_v2",
-		"Standard_D13_v2",
-		"Standard_D14_v2",
-		"Standard_D15_v2",
-		"Standard_F1",
-		"Standard_F2",
-		"Standard_F4",
-		"Standard_F8",
-		"Standard_F16",
-	}
-
 	if *adminPassword == "" {
 		fmt.Fprint(os.Stderr, "\nError: adminPassword is required\n\n")
 		flag.Usage()
 		os.Exit(1)
 	}
-	if *clientID == "" {
+	credentialConfig := broker.NewCredentialConfig(*authentication, *certificatePath, *certificatePassword, *tokenRefreshSkew)
+	if err := credentialConfig.Validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "\nError: %s\n\n", err)
+		flag.Usage()
+		os.Exit(1)
+	}
+	httpConfig := broker.NewHTTPConfig(*httpTimeout, *httpProxy, *caBundlePath, *retryCount, *retryWaitTime, *retryMaxWaitTime, *rateLimitThreshold, *rateLimitMaxDelay)
+	if err := httpConfig.Validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "\nError: %s\n\n", err)
+		flag.Usage()
+		os.Exit(1)
+	}
+	// the managed identity of the VM needs no client ID
+	if *clientID == "" && *authentication != broker.AuthenticationManagedIdentity {
 		fmt.Fprint(os.Stderr, "\nError: clientID is required\n\n")
 		flag.Usage()
 		os.Exit(1)
 	}
-	if *clientSecret == "" {
+	if *clientSecret == "" && *authentication == broker.AuthenticationClientSecret {
 		fmt.Fprint(os.Stderr, "\nError: clientSecret is required\n\n")
 		flag.Usage()
 		os.Exit(1)
@@ -282,81 +496,85 @@ func checkParams() {
 		flag.Usage()
 		os.Exit(1)
 	}
-	if *subscriptionID == "" {
-		fmt.Fprint(os.Stderr, "\nError: subscriptionID is required\n\n")
-		flag.Usage()
-		os.Exit(1)
-	}
-	if *tenantID == "" {
-		fmt.Fprint(os.Stderr, "\nError: tenantID is required\n\n")
+	if *stateStore != "file" && *stateStore != "sql" {
+		fmt.Fprint(os.Stderr, "\nstateStore should be file or sql\n\n")
 		flag.Usage()
 		os.Exit(1)
 	}
-
-	// template parameters requirements
-	if len(*namePrefix) > 6 {
-		fmt.Fprint(os.Stderr, "\nnamePrefix should be 6 alphanumeric characters or less\n\n")
+	if *stateStore == "file" && *stateFilePath == "" {
+		fmt.Fprint(os.Stderr, "\nError: stateFilePath is required when stateStore is file\n\n")
 		flag.Usage()
 		os.Exit(1)
 	}
-	if len(*adminUsername) < 1 || len(*adminUsername) > 64 {
-		fmt.Fprint(os.Stderr, "\nadminUsername should be not be void and 64 characters or less\n\n")
+	if *stateStore == "sql" && (*dbDriver == "" || *dbDataSource == "") {
+		fmt.Fprint(os.Stderr, "\nError: dbDriver and dbDataSource are required when stateStore is sql\n\n")
 		flag.Usage()
 		os.Exit(1)
 	}
-	if len(*adminPassword) < 12 || len(*adminPassword) > 72 {
-		fmt.Fprint(os.Stderr, "\nadminPassword should be in [12, 64]\n\n")
+	if *subscriptionID == "" {
+		fmt.Fprint(os.Stderr, "\nError: subscriptionID is required\n\n")
 		flag.Usage()
 		os.Exit(1)
 	}
-	if len(*ethereumAccountPsswd) < 12 {
-		fmt.Fprint(os.Stderr, "\nethereumAccountPsswd should be 12 alphanumeric characters or more\n\n")
+	if *tenantID == "" {
+		fmt.Fprint(os.Stderr, "\nError: tenantID is required\n\n")
 		flag.Usage()
 		os.Exit(1)
 	}
-	if len(*ethereumAccountPassphrase) < 12 {
-		fmt.Fprint(os.Stderr, "\nethereumAccountPassphrase should be 12 alphanumeric characters or more\n\n")
-		flag.Usage()
-		os.Exit(1)
+	if *environment == broker.AzureStack {
+		azureStackConfig := broker.NewAzureStackConfig(*azureStackDomain, *azureStackAuthentication, *azureStackResource, *azureStackEndpointPrefix)
+		if err := azureStackConfig.Validate(); err != nil {
+			fmt.Fprintf(os.Stderr, "\nError: %s\n\n", err)
+			flag.Usage()
+			os.Exit(1)
+		}
 	}
-	fmt.Println(ethereumNetworkID)
-	if (*ethereumNetworkID < 5) || (*ethereumNetworkID >= 2147483648) {
-		fmt.Fprint(os.Stderr, "\nethereumNetworkID should be in [5, 2^31)\n\n")
+
+	resourceGroupConfig := broker.NewResourceGroupConfig(*resourceGroupPrefix, *resourceGroupNameFormat)
+	if err := resourceGroupConfig.Validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "\nError: %s\n\n", err)
 		flag.Usage()
 		os.Exit(1)
 	}
-	if *numConsortiumMembers < 2 || *numConsortiumMembers > 5 {
-		fmt.Fprint(os.Stderr, "\nnumConsortiumMembers should be in [2, 5]\n\n")
+	templateConfig := broker.NewTemplateConfig(*templatePath, *templateURL, *templateSHA256)
+	if err := templateConfig.Validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "\nError: %s\n\n", err)
 		flag.Usage()
 		os.Exit(1)
 	}
-	if *numMiningNodesPerMember < 1 || *numMiningNodesPerMember > 19 {
-		fmt.Fprint(os.Stderr, "\nnumMiningNodesPerMember should be in [1, 19]\n\n")
+	cleanupConfig := broker.NewCleanupConfig(*cleanupFailedProvisions, *cleanupGracePeriod)
+	if err := cleanupConfig.Validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "\nError: %s\n\n", err)
 		flag.Usage()
 		os.Exit(1)
 	}
-	if !stringInSlice(*mnNodeVMSize, vmSizes) {
-		fmt.Fprint(os.Stderr, "\nUnsupported mining node VM size\n\n")
+	if amount, ok := new(big.Int).SetString(*bindingFundAmount, 10); !ok || amount.Sign() < 0 {
+		fmt.Fprint(os.Stderr, "\nbindingFundAmount should be a non-negative integer of wei\n\n")
 		flag.Usage()
 		os.Exit(1)
 	}
-	if !stringInSlice(*txNodeVMSize, vmSizes) {
-		fmt.Fprint(os.Stderr, "\nUnsupported transaction node VM size\n\n")
-		flag.Usage()
+	if dryRun && *dryRunPlanID == "" {
+		fmt.Fprint(os.Stderr, "\nError: planID is required\n\n")
+		dryRunFlags.Usage()
 		os.Exit(1)
 	}
 }
 
-func stringInSlice(a string, list []string) bool {
-	for _, b := range list {
-		if b == a {
-			return true
-		}
+// runDryRun checks a provision of the plan with ARM without deploying it,
+// and prints the changes it would make.
+func runDryRun(serviceBroker *broker.ServiceBroker) {
+	changes, err := serviceBroker.DryRun(*dryRunServiceID, *dryRunPlanID, json.RawMessage(*dryRunParameters))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "\nError: %s\n\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("The provision of plan %s is valid\n", *dryRunPlanID)
+	for _, change := range changes {
+		fmt.Printf("%s\t%s\n", change.ChangeType, change.ResourceID)
 	}
-	return false
 }
 
-func createServer(logger lager.Logger) ifrit.Runner {
+func createBroker(logger lager.Logger) (*broker.ServiceBroker, broker.Store) {
 	azureConfig := broker.NewAzureConfig(
 		*environment,
 		*tenantID,
@@ -364,7 +582,10 @@ func createServer(logger lager.Logger) ifrit.Runner {
 		*clientSecret,
 	)
 	azureStackConfig := broker.NewAzureStackConfig(*azureStackDomain, *azureStackAuthentication, *azureStackResource, *azureStackEndpointPrefix)
-	cloudConfig := broker.NewCloudConfig(*azureConfig, *azureStackConfig)
+	endpointConfig := broker.NewEndpointConfig(*resourceManagerEndpoint, *activeDirectoryEndpoint)
+	credentialConfig := broker.NewCredentialConfig(*authentication, *certificatePath, *certificatePassword, *tokenRefreshSkew)
+	httpConfig := broker.NewHTTPConfig(*httpTimeout, *httpProxy, *caBundlePath, *retryCount, *retryWaitTime, *retryMaxWaitTime, *rateLimitThreshold, *rateLimitMaxDelay)
+	cloudConfig := broker.NewCloudConfig(*azureConfig, *azureStackConfig, *endpointConfig, *credentialConfig, *httpConfig)
 
 	resourceConfig := broker.NewResourceConfig(
 		*subscriptionID,
@@ -374,7 +595,9 @@ func createServer(logger lager.Logger) ifrit.Runner {
 		"",
 		false,
 		false,
+		*whatIf,
 	)
+	resourceGroupConfig := broker.NewResourceGroupConfig(*resourceGroupPrefix, *resourceGroupNameFormat)
 
 	blockchainConfig := broker.NewBlockchainConfig(
 		*namePrefix,
@@ -390,19 +613,83 @@ func createServer(logger lager.Logger) ifrit.Runner {
 		*txNodeVMSize,
 	)
 
-	credentials := brokerapi.BrokerCredentials{Username: username, Password: password}
+	httpClient, err := broker.NewHTTPClient(*httpConfig)
+	utils.ExitOnFailure(logger, err)
+	template, err := broker.LoadTemplate(httpClient, *broker.NewTemplateConfig(*templatePath, *templateURL, *templateSHA256))
+	utils.ExitOnFailure(logger, err)
+
+	fundAmount, _ := new(big.Int).SetString(*bindingFundAmount, 10)
+	bindingConfig := broker.NewBindingConfig(fundAmount)
+	cleanupConfig := broker.NewCleanupConfig(*cleanupFailedProvisions, *cleanupGracePeriod)
+
+	catalog := broker.DefaultCatalog()
+	if *catalogPath != "" {
+		catalog, err = broker.LoadCatalog(*catalogPath)
+		utils.ExitOnFailure(logger, err)
+		err = catalog.LoadTemplates(httpClient)
+		utils.ExitOnFailure(logger, err)
+	}
+
+	var store broker.Store
+	if *stateStore == "sql" {
+		store, err = broker.NewSQLStore(*dbDriver, *dbDataSource)
+	} else {
+		store, err = broker.NewFileStore(*stateFilePath)
+	}
+	utils.ExitOnFailure(logger, err)
+
 	serviceBroker, err := broker.New(
 		logger,
 		*cloudConfig,
 		*resourceConfig,
+		*resourceGroupConfig,
 		*blockchainConfig,
+		template,
+		*bindingConfig,
+		*cleanupConfig,
+		catalog,
+		store,
 		*serviceName,
 		*serviceID,
 	)
 	if err != nil {
 		panic(err)
 	}
-	handler := brokerapi.New(serviceBroker, logger.Session("broker-api"), credentials)
+	return serviceBroker, store
+}
+
+func createServer(logger lager.Logger, serviceBroker *broker.ServiceBroker) ifrit.Runner {
+	credentials := brokerapi.BrokerCredentials{Username: username, Password: password}
+	handler := broker.NewHandler(serviceBroker, logger.Session("broker-api"), credentials)
 
 	return http_server.New(*atAddress, handler)
 }
+
+// createStoreCloser closes the state store, e.g. the connections of the SQL
+// store, when the broker stops.
+func createStoreCloser(store io.Closer) ifrit.Runner {
+	return ifrit.RunFunc(func(signals <-chan os.Signal, ready chan<- struct{}) error {
+		close(ready)
+		<-signals
+		return store.Close()
+	})
+}
+
+// createJanitor cleans up the resource groups of the failed provisions
+// periodically.
+func createJanitor(serviceBroker *broker.ServiceBroker) ifrit.Runner {
+	return ifrit.RunFunc(func(signals <-chan os.Signal, ready chan<- struct{}) error {
+		ticker := time.NewTicker(cleanupInterval)
+		defer ticker.Stop()
+		close(ready)
+
+		for {
+			select {
+			case <-ticker.C:
+				serviceBroker.CleanUp()
+			case <-signals:
+				return nil
+			}
+		}
+	})
+}
@@ -19,6 +19,7 @@ import (
 	"github.com/pivotal-cf/brokerapi"
 	"github.com/tedsuo/ifrit"
 	"github.com/tedsuo/ifrit/ginkgomon"
+	"github.com/zeqing-guo/AzureBlockchainBroker/fakeazure"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -138,7 +139,7 @@ var _ = Describe("Main", func() {
 			serviceName, serviceID                                                                                                                                                                              string
 			username, password                                                                                                                                                                                  string
 			tenantID, clientID, clientSecret                                                                                                                                                                    string
-			subscriptionID, location, resourceGroupName                                                                                                                                                         string
+			subscriptionID, location                                                                                                                                                                            string
 			namePrefix, adminUsername, adminPassword, ethereumAccountPsswd, ethereumAccountPassphrase, ethereumNetworkID, numConsortiumMembers, numMiningNodesPerMember, mnNodeVMSize, numTXNodes, txNodeVMSize string
 
 			process ifrit.Process
@@ -153,7 +154,6 @@ var _ = Describe("Main", func() {
 			clientSecret = "clientSecret"
 			subscriptionID = "subscriptionID"
 			location = "location"
-			resourceGroupName = "resourceGroupName"
 			namePrefix = "namePr"
 			adminUsername = "adminUsername"
 			adminPassword = "aZure1234567"
@@ -166,6 +166,7 @@ var _ = Describe("Main", func() {
 			numTXNodes = "1"
 			txNodeVMSize = "Standard_A1"
 
+			args = []string{}
 			args = append(args, "--listenAddr", listenAddr)
 			args = append(args, "--serviceName", serviceName)
 			args = append(args, "--serviceID", serviceID)
@@ -185,6 +186,7 @@ var _ = Describe("Main", func() {
 			args = append(args, "--mnNodeVMSize", mnNodeVMSize)
 			args = append(args, "--numTXNodes", numTXNodes)
 			args = append(args, "--txNodeVMSize", txNodeVMSize)
+			args = append(args, "--templatePath", "broker/testdata/template.json")
 
 			os.Setenv("USERNAME", username)
 			os.Setenv("PASSWORD", password)
@@ -229,5 +231,79 @@ var _ = Describe("Main", func() {
 			Expect(catalog.Services[0].Plans[0].Name).To(Equal("AzureBlockchain"))
 			Expect(catalog.Services[0].Plans[0].Description).To(Equal("Azure Blockchain"))
 		})
+
+		Context("Has a catalog file", func() {
+			BeforeEach(func() {
+				args = append(args, "--catalogPath", "catalog.json")
+			})
+
+			It("should offer the plans in the catalog file", func() {
+				resp, err := httpDoWithAuth("GET", "/v2/catalog", nil)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(resp.StatusCode).To(Equal(200))
+
+				bytes, err := ioutil.ReadAll(resp.Body)
+				Expect(err).NotTo(HaveOccurred())
+
+				var catalog brokerapi.CatalogResponse
+				err = json.Unmarshal(bytes, &catalog)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(catalog.Services[0].Plans).To(HaveLen(3))
+				Expect(catalog.Services[0].Plans[0].Name).To(Equal("dev"))
+				Expect(catalog.Services[0].Plans[1].Name).To(Equal("small"))
+				Expect(catalog.Services[0].Plans[1].ID).To(Equal("7c0b2254-7e68-11e7-bbe1-000d3a818256"))
+				Expect(catalog.Services[0].Plans[2].Name).To(Equal("production"))
+			})
+		})
+	})
+
+	Context("Dry-runs a plan", func() {
+		var (
+			server *fakeazure.Server
+			args   []string
+		)
+
+		BeforeEach(func() {
+			server = fakeazure.NewServer(fakeazure.Config{})
+			args = []string{
+				"--tenantID", "tenantID",
+				"--clientID", "clientID",
+				"--clientSecret", "clientSecret",
+				"--subscriptionID", "subscriptionID",
+				"--location", "westus",
+				"--resourceManagerEndpoint", server.URL + "/",
+				"--activeDirectoryEndpoint", server.URL,
+				"--adminPassword", "aZure1234567",
+				"--ethereumAccountPsswd", "aZure1234567",
+				"--ethereumAccountPassphrase", "aZure1234567",
+				"--namePrefix", "namePr",
+				"--templatePath", "broker/testdata/template.json",
+				"dry-run",
+				"--planID", "7c0b2254-7e68-11e7-bbe1-000d3a818256",
+				"--parameters", `{"numTXNodes": 2}`,
+			}
+		})
+
+		AfterEach(func() {
+			server.Close()
+		})
+
+		It("should validate the provision with Azure", func() {
+			session, err := gexec.Start(exec.Command(binaryPath, args...), GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session, 10*time.Second).Should(gexec.Exit(0))
+			Expect(session.Out).To(gbytes.Say("The provision of plan 7c0b2254-7e68-11e7-bbe1-000d3a818256 is valid"))
+		})
+
+		It("should fail if Azure does not validate the provision", func() {
+			server.FailNext(http.MethodPost, http.StatusBadRequest, "InvalidTemplateDeployment", "Operation results in exceeding quota limits of Core.")
+
+			session, err := gexec.Start(exec.Command(binaryPath, args...), GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session, 10*time.Second).Should(gexec.Exit(1))
+			Expect(session.Err).To(gbytes.Say("Error: The deployment failed the validation of Azure: InvalidTemplateDeployment: Operation results in exceeding quota limits of Core."))
+		})
 	})
 })